@@ -0,0 +1,308 @@
+// Package battlelog stores battle logs compactly. A full models.BattleLog
+// snapshots both decks after every round, which for long battles is most of
+// its size. The compact form keeps the starting decks and each round's
+// actions and rebuilds the snapshots on read by replaying the actions. Any
+// change the actions don't explain (a boss enraging, say) is kept as a patch
+// on the round, so expanding always gives back exactly the original log.
+package battlelog
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"imperium/models"
+)
+
+const (
+	FormatFull    = "full"
+	FormatCompact = "compact"
+)
+
+// Compact is a battle log in the compact format. Version is the version of
+// the log model it holds, as in models.BattleLog.
+type Compact struct {
+	Format            string              `json:"format"`
+	Version           int                 `json:"version"`
+	Rules             *models.BattleRules `json:"rules,omitempty"`
+	Winner            string              `json:"winner"`
+	TotalRounds       int                 `json:"total_rounds"`
+	AttackerRemaining int                 `json:"attacker_remaining"`
+	DefenderRemaining int                 `json:"defender_remaining"`
+	StartedAt         time.Time           `json:"started_at"`
+	// DurationMs is the usual round length; rounds only store theirs when it
+	// differs.
+	DurationMs   int64               `json:"duration_ms"`
+	AttackerDeck []models.BattleCard `json:"attacker_deck"`
+	DefenderDeck []models.BattleCard `json:"defender_deck"`
+	Entries      []CompactEntry      `json:"entries"`
+}
+
+// CompactEntry is one round. Timestamp and DurationMs are only set when they
+// don't follow from the log's start and usual round length. AttackerDeck and
+// DefenderDeck replace a whole deck when its cards changed in a way the
+// actions don't explain; Patches replace single cards.
+type CompactEntry struct {
+	Round        int                      `json:"round"`
+	TurnSide     string                   `json:"turn_side"`
+	Actions      []models.BattleLogAction `json:"actions"`
+	Timestamp    *time.Time               `json:"timestamp,omitempty"`
+	DurationMs   *int64                   `json:"duration_ms,omitempty"`
+	AttackerDeck *[]models.BattleCard     `json:"attacker_deck,omitempty"`
+	DefenderDeck *[]models.BattleCard     `json:"defender_deck,omitempty"`
+	Patches      []CardPatch              `json:"patches,omitempty"`
+}
+
+// CardPatch sets a card on one side to the given state after a round.
+type CardPatch struct {
+	Side string            `json:"side"`
+	Card models.BattleCard `json:"card"`
+}
+
+// Compress turns a full log into the compact format. The starting decks are
+// optional; without them the first round stores full decks instead.
+func Compress(bl models.BattleLog, attackerDeck, defenderDeck []models.BattleCard) Compact {
+	c := Compact{
+		Format:            FormatCompact,
+		Version:           bl.Version,
+		Rules:             bl.Rules,
+		Winner:            bl.Winner,
+		TotalRounds:       bl.TotalRounds,
+		AttackerRemaining: bl.AttackerRemaining,
+		DefenderRemaining: bl.DefenderRemaining,
+		AttackerDeck:      copyDeck(attackerDeck),
+		DefenderDeck:      copyDeck(defenderDeck),
+		Entries:           make([]CompactEntry, 0, len(bl.Entries)),
+	}
+	if len(bl.Entries) > 0 {
+		c.StartedAt = bl.Entries[0].Timestamp
+		c.DurationMs = bl.Entries[0].DurationMs
+	}
+
+	s := newReplay(copyDeck(c.AttackerDeck), copyDeck(c.DefenderDeck))
+	at := c.StartedAt
+	for _, e := range bl.Entries {
+		ce := CompactEntry{Round: e.Round, TurnSide: e.TurnSide, Actions: e.Actions}
+		if !e.Timestamp.Equal(at) {
+			ts := e.Timestamp
+			ce.Timestamp = &ts
+		}
+		if e.DurationMs != c.DurationMs {
+			d := e.DurationMs
+			ce.DurationMs = &d
+		}
+		at = e.Timestamp.Add(time.Duration(e.DurationMs) * time.Millisecond)
+
+		s.play(e)
+		ce.AttackerDeck, ce.Patches = diffDeck("attacker", s.attacker, e.AttackerDeck, ce.Patches)
+		ce.DefenderDeck, ce.Patches = diffDeck("defender", s.defender, e.DefenderDeck, ce.Patches)
+		s.attacker = copyDeck(e.AttackerDeck)
+		s.defender = copyDeck(e.DefenderDeck)
+
+		c.Entries = append(c.Entries, ce)
+	}
+	return c
+}
+
+// Expand rebuilds the full log from the compact format.
+func Expand(c Compact) models.BattleLog {
+	bl := models.BattleLog{
+		Version:           c.Version,
+		Rules:             c.Rules,
+		Entries:           make([]models.BattleLogEntry, 0, len(c.Entries)),
+		Winner:            c.Winner,
+		TotalRounds:       c.TotalRounds,
+		AttackerRemaining: c.AttackerRemaining,
+		DefenderRemaining: c.DefenderRemaining,
+	}
+
+	s := newReplay(copyDeck(c.AttackerDeck), copyDeck(c.DefenderDeck))
+	at := c.StartedAt
+	for _, ce := range c.Entries {
+		e := models.BattleLogEntry{
+			Round:      ce.Round,
+			TurnSide:   ce.TurnSide,
+			Timestamp:  at,
+			DurationMs: c.DurationMs,
+			Actions:    ce.Actions,
+		}
+		if ce.Timestamp != nil {
+			e.Timestamp = *ce.Timestamp
+		}
+		if ce.DurationMs != nil {
+			e.DurationMs = *ce.DurationMs
+		}
+		at = e.Timestamp.Add(time.Duration(e.DurationMs) * time.Millisecond)
+
+		s.play(e)
+		if ce.AttackerDeck != nil {
+			s.attacker = copyDeck(*ce.AttackerDeck)
+		}
+		if ce.DefenderDeck != nil {
+			s.defender = copyDeck(*ce.DefenderDeck)
+		}
+		for _, p := range ce.Patches {
+			deck := s.deck(p.Side)
+			if i := cardIndex(*deck, p.Card.ID); i >= 0 {
+				(*deck)[i] = copyCard(p.Card)
+			}
+		}
+		e.AttackerDeck = copyDeck(s.attacker)
+		e.DefenderDeck = copyDeck(s.defender)
+
+		bl.Entries = append(bl.Entries, e)
+	}
+	return bl
+}
+
+// replay tracks both decks while a log's actions are played back.
+type replay struct {
+	attacker []models.BattleCard
+	defender []models.BattleCard
+}
+
+func newReplay(attacker, defender []models.BattleCard) *replay {
+	return &replay{attacker: attacker, defender: defender}
+}
+
+func (s *replay) deck(side string) *[]models.BattleCard {
+	if side == "attacker" {
+		return &s.attacker
+	}
+	return &s.defender
+}
+
+// play applies one round the way the engine does: rampage first, then the
+// logged actions. Anything else is left to the round's patches.
+func (s *replay) play(e models.BattleLogEntry) {
+	rampage(s.attacker)
+	rampage(s.defender)
+
+	// Where the last card died on each side, so a deathrattle spawn takes its
+	// place instead of going in front.
+	diedAt := map[string]int{}
+	hits := 0
+	for _, a := range e.Actions {
+		switch a.Type {
+		case "attack":
+			if a.DefenderID == nil || a.Damage == nil {
+				continue
+			}
+			side := hitSide(e.TurnSide, hits)
+			if a.TargetSide != nil {
+				side = *a.TargetSide
+			}
+			hits++
+			deck := s.deck(side)
+			if i := cardIndex(*deck, *a.DefenderID); i >= 0 {
+				(*deck)[i].CurrentHP -= *a.Damage
+			}
+		case "card_died":
+			if a.DiedCardID == nil || a.DiedSide == nil {
+				continue
+			}
+			deck := s.deck(*a.DiedSide)
+			if i := cardIndex(*deck, *a.DiedCardID); i >= 0 {
+				*deck = append((*deck)[:i], (*deck)[i+1:]...)
+				diedAt[*a.DiedSide] = i
+			}
+		case "spawn_card":
+			if a.Side == nil || a.SpawnedCard == nil {
+				continue
+			}
+			deck := s.deck(*a.Side)
+			i, ok := diedAt[*a.Side]
+			if !ok || i > len(*deck) {
+				i = 0
+			}
+			delete(diedAt, *a.Side)
+			spawned := copyCard(*a.SpawnedCard)
+			*deck = append((*deck)[:i], append([]models.BattleCard{spawned}, (*deck)[i:]...)...)
+		case "phase":
+			if a.CardID == nil || a.Phase == nil || *a.Phase != "taunt" {
+				continue
+			}
+			for _, side := range []string{"attacker", "defender"} {
+				deck := s.deck(side)
+				if i := cardIndex(*deck, *a.CardID); i >= 0 {
+					(*deck)[i].Effects = append((*deck)[i].Effects, "taunt")
+					break
+				}
+			}
+		}
+	}
+}
+
+// diffDeck compares the replayed deck with the real one. When the same cards
+// are there in the same order, the ones that differ become patches; otherwise
+// the whole real deck is returned to store.
+func diffDeck(side string, got, want []models.BattleCard, patches []CardPatch) (*[]models.BattleCard, []CardPatch) {
+	if len(got) != len(want) {
+		deck := copyDeck(want)
+		return &deck, patches
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			deck := copyDeck(want)
+			return &deck, patches
+		}
+	}
+	for i := range want {
+		if !sameCard(got[i], want[i]) {
+			patches = append(patches, CardPatch{Side: side, Card: copyCard(want[i])})
+		}
+	}
+	return nil, patches
+}
+
+// sameCard compares two cards, treating nil and empty effects alike.
+func sameCard(a, b models.BattleCard) bool {
+	if len(a.Effects) != len(b.Effects) {
+		return false
+	}
+	for i := range a.Effects {
+		if a.Effects[i] != b.Effects[i] {
+			return false
+		}
+	}
+	a.Effects, b.Effects = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func rampage(deck []models.BattleCard) {
+	for i := range deck {
+		for _, e := range deck[i].Effects {
+			if e == "rampage" || strings.HasPrefix(e, "rampage:") {
+				deck[i].CurrentHP++
+				deck[i].MaxHP++
+				break
+			}
+		}
+	}
+}
+
+func cardIndex(deck []models.BattleCard, id int64) int {
+	for i := range deck {
+		if deck[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyCard copies a card with its own, never nil, effects slice, the way the
+// engine snapshots them.
+func copyCard(c models.BattleCard) models.BattleCard {
+	effects := make([]string, len(c.Effects))
+	copy(effects, c.Effects)
+	c.Effects = effects
+	return c
+}
+
+func copyDeck(deck []models.BattleCard) []models.BattleCard {
+	out := make([]models.BattleCard, len(deck))
+	for i, c := range deck {
+		out[i] = copyCard(c)
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package battlelog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"imperium/engine"
+	"imperium/models"
+)
+
+func card(id int64, hp, attack int16, effects ...string) models.BattleCard {
+	if effects == nil {
+		effects = []string{}
+	}
+	return models.BattleCard{
+		ID:        id,
+		CardID:    "card",
+		Name:      "Card",
+		CurrentHP: hp,
+		MaxHP:     hp,
+		Attack:    attack,
+		Rarity:    "common",
+		Effects:   effects,
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompressExpandRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		attacker []models.BattleCard
+		defender []models.BattleCard
+		rules    engine.Rules
+	}{
+		{
+			name:     "plain",
+			attacker: []models.BattleCard{card(1, 10, 3), card(2, 8, 4)},
+			defender: []models.BattleCard{card(3, 12, 2), card(4, 6, 5)},
+			rules:    engine.StandardRules,
+		},
+		{
+			name:     "thorns and rampage",
+			attacker: []models.BattleCard{card(1, 10, 3, "thorns:1"), card(2, 8, 4)},
+			defender: []models.BattleCard{card(3, 12, 2, "rampage"), card(4, 6, 5, "taunt")},
+			rules:    engine.StandardRules,
+		},
+		{
+			name:     "deathrattle spawns",
+			attacker: []models.BattleCard{card(1, 4, 3, "deathrattle", "spawns:cobblestone"), card(2, 8, 4)},
+			defender: []models.BattleCard{card(3, 5, 3, "deathrattle"), card(4, 6, 5)},
+			rules:    engine.StandardRules,
+		},
+		{
+			name:     "boss hooks",
+			attacker: []models.BattleCard{card(1, 20, 4), card(2, 20, 4)},
+			defender: []models.BattleCard{card(3, 60, 3, "taunt_below:50", "summon:3:2:1", "enrage:4:50")},
+			rules:    engine.StandardRules,
+		},
+		{
+			name:     "sudden death",
+			attacker: []models.BattleCard{card(1, 50, 1, "no_attack")},
+			defender: []models.BattleCard{card(2, 50, 1, "no_attack")},
+			rules:    engine.Rules{MaxRounds: 5, Tiebreak: engine.TiebreakSuddenDeath, FirstMover: engine.FirstCoinFlip, Seed: 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bl := engine.RunBattleWith(tt.attacker, tt.defender, tt.rules)
+			want := mustJSON(t, bl)
+
+			for _, decks := range []struct {
+				name               string
+				attacker, defender []models.BattleCard
+			}{
+				{"with starting decks", tt.attacker, tt.defender},
+				{"without starting decks", nil, nil},
+			} {
+				c := Compress(bl, decks.attacker, decks.defender)
+				if got := mustJSON(t, Expand(c)); got != want {
+					t.Errorf("%s: Expand(Compress(log)) differs from the log\n got %s\nwant %s", decks.name, got, want)
+				}
+
+				// And the same through storage.
+				got, err := Decode([]byte(mustJSON(t, c)))
+				if err != nil {
+					t.Fatalf("%s: Decode: %v", decks.name, err)
+				}
+				if got := mustJSON(t, got); got != want {
+					t.Errorf("%s: stored compact log decodes differently\n got %s\nwant %s", decks.name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package battlelog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"imperium/models"
+)
+
+// Stored logs carry the version of the log model they were written with;
+// logs without one are version 1. Reading a log upgrades it one version at a
+// time to models.BattleLogVersion, so replays of old battles keep working
+// whatever the model looks like now.
+//
+//	1  the original log, stored in full until the compact format arrived.
+//	   Attack ids in battles from before then may name the wrong card, and
+//	   rounds before bosses had phases have no phase actions.
+//	2  attack actions say which side took the damage (target_side).
+//	3  the log records the rules the battle was played by (rules).
+var upgrades = map[int]func(*models.BattleLog){
+	1: upgradeV1,
+	2: upgradeV2,
+}
+
+// upgradeV1 fills in target_side.
+func upgradeV1(bl *models.BattleLog) {
+	for i := range bl.Entries {
+		e := &bl.Entries[i]
+		hits := 0
+		for j := range e.Actions {
+			a := &e.Actions[j]
+			if a.Type != "attack" {
+				continue
+			}
+			side := hitSide(e.TurnSide, hits)
+			hits++
+			a.TargetSide = &side
+		}
+	}
+}
+
+// upgradeV2 records the rules every battle was played by before they could
+// change.
+func upgradeV2(bl *models.BattleLog) {
+	bl.Rules = &models.BattleRules{
+		MaxRounds:       2000,
+		FirstMover:      "defender",
+		Tiebreak:        "total_hp",
+		RoundDurationMs: 800,
+	}
+}
+
+// hitSide is the side a round's n-th attack (from 0) lands on, for logs from
+// before target_side: the first hit lands on the side not moving, a second
+// one is thorns hitting back.
+func hitSide(turnSide string, n int) string {
+	if n%2 == 1 {
+		return turnSide
+	}
+	if turnSide == "defender" {
+		return "attacker"
+	}
+	return "defender"
+}
+
+// upgrade brings a decoded log up to the current version.
+func upgrade(bl *models.BattleLog) error {
+	if bl.Version == 0 {
+		bl.Version = 1
+	}
+	if bl.Version > models.BattleLogVersion {
+		return fmt.Errorf("battle log version %d is newer than this server's %d", bl.Version, models.BattleLogVersion)
+	}
+	for bl.Version < models.BattleLogVersion {
+		step, ok := upgrades[bl.Version]
+		if !ok {
+			return fmt.Errorf("no upgrade for battle log version %d", bl.Version)
+		}
+		step(bl)
+		bl.Version++
+	}
+	return nil
+}
+
+type header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// decodeStored reads a stored log as it was written, without upgrading it.
+func decodeStored(raw []byte) (models.BattleLog, error) {
+	var head header
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return models.BattleLog{}, err
+	}
+
+	switch head.Format {
+	case "", FormatFull:
+		var bl models.BattleLog
+		err := json.Unmarshal(raw, &bl)
+		return bl, err
+	case FormatCompact:
+		var c Compact
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return models.BattleLog{}, err
+		}
+		return Expand(c), nil
+	}
+	return models.BattleLog{}, fmt.Errorf("unknown battle log format %q", head.Format)
+}
+
+// Decode reads a stored battle log in either format and upgrades it to the
+// current version.
+func Decode(raw []byte) (models.BattleLog, error) {
+	bl, err := decodeStored(raw)
+	if err != nil {
+		return models.BattleLog{}, err
+	}
+	if err := upgrade(&bl); err != nil {
+		return models.BattleLog{}, err
+	}
+	return bl, nil
+}
+
+// DecodeCompact reads a stored battle log as the compact format at the
+// current version, converting older or full logs.
+func DecodeCompact(raw []byte) (Compact, error) {
+	var head header
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return Compact{}, err
+	}
+	if head.Format != FormatCompact {
+		bl, err := Decode(raw)
+		if err != nil {
+			return Compact{}, err
+		}
+		return Compress(bl, nil, nil), nil
+	}
+
+	var c Compact
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return Compact{}, err
+	}
+	if c.Version == models.BattleLogVersion {
+		return c, nil
+	}
+	bl := Expand(c)
+	if err := upgrade(&bl); err != nil {
+		return Compact{}, err
+	}
+	return Compress(bl, c.AttackerDeck, c.DefenderDeck), nil
+}
+
+// Rewrite turns a stored log of any format and version into the compact
+// format at the current version, for migrating stored logs. It makes sure
+// the result reads back as the same log.
+func Rewrite(raw []byte) ([]byte, error) {
+	want, err := Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	c, err := DecodeCompact(raw)
+	if err != nil {
+		return nil, err
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	got, err := Decode(out)
+	if err != nil {
+		return nil, err
+	}
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	if !bytes.Equal(wantJSON, gotJSON) {
+		return nil, errors.New("rewritten log does not read back the same")
+	}
+	return out, nil
+}
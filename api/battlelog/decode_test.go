@@ -0,0 +1,170 @@
+package battlelog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"imperium/engine"
+	"imperium/models"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func hit(attackerID, defenderID int64, damage int16, targetSide string) models.BattleLogAction {
+	a := models.BattleLogAction{
+		Type:       "attack",
+		AttackerID: ptr(attackerID),
+		DefenderID: ptr(defenderID),
+		Damage:     ptr(damage),
+	}
+	if targetSide != "" {
+		a.TargetSide = ptr(targetSide)
+	}
+	return a
+}
+
+// fixtureLog is a two-round battle as version 1 stored it: the defender hits
+// first, then the attacker hits a thorns card and takes the thorns back.
+// targetSides fills in target_side for versions that have it.
+func fixtureLog(version int, targetSides bool, rules *models.BattleRules) models.BattleLog {
+	side := func(s string) string {
+		if targetSides {
+			return s
+		}
+		return ""
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	attacker := []models.BattleCard{card(1, 10, 3)}
+	defender := []models.BattleCard{card(2, 10, 2, "thorns:1")}
+	return models.BattleLog{
+		Version: version,
+		Rules:   rules,
+		Entries: []models.BattleLogEntry{
+			{
+				Round:        1,
+				TurnSide:     "defender",
+				Timestamp:    start,
+				DurationMs:   800,
+				Actions:      []models.BattleLogAction{hit(2, 1, 2, side("attacker"))},
+				AttackerDeck: []models.BattleCard{{ID: 1, CardID: "card", Name: "Card", CurrentHP: 8, MaxHP: 10, Attack: 3, Rarity: "common", Effects: []string{}}},
+				DefenderDeck: defender,
+			},
+			{
+				Round:      2,
+				TurnSide:   "attacker",
+				Timestamp:  start.Add(800 * time.Millisecond),
+				DurationMs: 800,
+				Actions: []models.BattleLogAction{
+					hit(1, 2, 3, side("defender")),
+					hit(2, 1, 1, side("attacker")),
+				},
+				AttackerDeck: []models.BattleCard{{ID: 1, CardID: "card", Name: "Card", CurrentHP: 7, MaxHP: 10, Attack: 3, Rarity: "common", Effects: []string{}}},
+				DefenderDeck: []models.BattleCard{{ID: 2, CardID: "card", Name: "Card", CurrentHP: 7, MaxHP: 10, Attack: 2, Rarity: "common", Effects: []string{"thorns:1"}}},
+			},
+		},
+		Winner:            "tie",
+		TotalRounds:       2,
+		AttackerRemaining: len(attacker),
+		DefenderRemaining: len(defender),
+	}
+}
+
+var legacyRules = &models.BattleRules{MaxRounds: 2000, FirstMover: "defender", Tiebreak: "total_hp", RoundDurationMs: 800}
+
+func TestUpgradeSteps(t *testing.T) {
+	tests := []struct {
+		from int
+		in   models.BattleLog
+		want models.BattleLog
+	}{
+		{1, fixtureLog(1, false, nil), fixtureLog(1, true, nil)},
+		{2, fixtureLog(2, true, nil), fixtureLog(2, true, legacyRules)},
+	}
+	if len(tests) != models.BattleLogVersion-1 {
+		t.Fatalf("%d upgrade steps tested, want one per version below %d", len(tests), models.BattleLogVersion)
+	}
+	for _, tt := range tests {
+		step, ok := upgrades[tt.from]
+		if !ok {
+			t.Fatalf("no upgrade for version %d", tt.from)
+		}
+		bl := tt.in
+		step(&bl)
+		if got, want := mustJSON(t, bl), mustJSON(t, tt.want); got != want {
+			t.Errorf("upgrade from %d:\n got %s\nwant %s", tt.from, got, want)
+		}
+	}
+}
+
+// upgradeV2 spells out the rules every battle was played by before rules
+// could change. Should the standard rules ever change, this test is the
+// reminder that upgradeV2 has to keep the old ones.
+func TestUpgradeV2IsStandardRules(t *testing.T) {
+	var bl models.BattleLog
+	upgradeV2(&bl)
+	if bl.Rules == nil || *bl.Rules != engine.StandardRules {
+		t.Errorf("upgradeV2 records %+v, engine.StandardRules are %+v", bl.Rules, engine.StandardRules)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	current := fixtureLog(models.BattleLogVersion, true, legacyRules)
+	unversioned := fixtureLog(0, false, nil)
+
+	compactV1 := Compress(fixtureLog(1, false, nil), nil, nil)
+	tooNew := fixtureLog(models.BattleLogVersion+1, true, legacyRules)
+
+	tests := []struct {
+		name    string
+		raw     string
+		want    *models.BattleLog
+		wantErr string
+	}{
+		{"full without version", mustJSON(t, unversioned), &current, ""},
+		{"full version 1", mustJSON(t, fixtureLog(1, false, nil)), &current, ""},
+		{"full version 2", mustJSON(t, fixtureLog(2, true, nil)), &current, ""},
+		{"full current", mustJSON(t, current), &current, ""},
+		{"compact version 1", mustJSON(t, compactV1), &current, ""},
+		{"compact current", mustJSON(t, Compress(current, nil, nil)), &current, ""},
+		{"newer than the server", mustJSON(t, tooNew), nil, "newer than this server"},
+		{"unknown format", `{"format":"zip","version":3}`, nil, "unknown battle log format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.raw))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Decode error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if got, want := mustJSON(t, got), mustJSON(t, *tt.want); got != want {
+				t.Errorf("Decode:\n got %s\nwant %s", got, want)
+			}
+
+			c, err := DecodeCompact([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("DecodeCompact: %v", err)
+			}
+			if c.Version != models.BattleLogVersion {
+				t.Errorf("DecodeCompact version = %d, want %d", c.Version, models.BattleLogVersion)
+			}
+
+			out, err := Rewrite([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("Rewrite: %v", err)
+			}
+			rewritten, err := Decode(out)
+			if err != nil {
+				t.Fatalf("Decode(Rewrite): %v", err)
+			}
+			if got, want := mustJSON(t, rewritten), mustJSON(t, *tt.want); got != want {
+				t.Errorf("Rewrite changed the log:\n got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+// Command balance plays the card catalog against itself to find cards and
+// decks that are too strong or too weak before a content patch. It builds
+// decks from the cards PvE bots draw from (handlers.LoadBotCatalog), every
+// combination when there are few enough and a random sample otherwise, and
+// fights each deck against every other one as both attacker and defender.
+//
+//	go run ./cmd/balance [-size 5] [-decks 100] [-seed 1] [-workers 8] [-format csv|json] [-out balance]
+//
+// The report covers:
+//   - cards: how often decks with each card win, and how much better or worse
+//     that is than decks without it
+//   - decks: the decks with the best win rates
+//   - matchups: degenerate battles, ones that hit the round cap with cards
+//     left on both sides
+//
+// CSV writes cards.csv, decks.csv and matchups.csv to the -out directory;
+// JSON writes a single report.json. It reads DATABASE_URL like the API does
+// and writes nothing to the database.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"imperium/config"
+	"imperium/db"
+	"imperium/engine"
+	"imperium/handlers"
+	"imperium/models"
+)
+
+type cardReport struct {
+	CardID string `json:"card_id"`
+	Name   string `json:"name"`
+	Rarity string `json:"rarity"`
+	Decks  int    `json:"decks"`
+	// Battles, Wins, Losses and Ties count the battles of decks with the card.
+	Battles int     `json:"battles"`
+	Wins    int     `json:"wins"`
+	Losses  int     `json:"losses"`
+	Ties    int     `json:"ties"`
+	WinRate float64 `json:"win_rate"`
+	// Contribution is WinRate minus the win rate of decks without the card.
+	Contribution float64 `json:"contribution"`
+}
+
+type deckReport struct {
+	Cards   []string `json:"cards"`
+	Battles int      `json:"battles"`
+	Wins    int      `json:"wins"`
+	Losses  int      `json:"losses"`
+	Ties    int      `json:"ties"`
+	WinRate float64  `json:"win_rate"`
+}
+
+type matchupReport struct {
+	Attacker          []string `json:"attacker"`
+	Defender          []string `json:"defender"`
+	Winner            string   `json:"winner"`
+	Rounds            int      `json:"rounds"`
+	AttackerRemaining int      `json:"attacker_remaining"`
+	DefenderRemaining int      `json:"defender_remaining"`
+}
+
+type report struct {
+	Decks      int             `json:"decks"`
+	DeckSize   int             `json:"deck_size"`
+	Sampled    bool            `json:"sampled"`
+	Seed       int64           `json:"seed"`
+	Battles    int             `json:"battles"`
+	AvgRounds  float64         `json:"avg_rounds"`
+	Cards      []cardReport    `json:"cards"`
+	TopDecks   []deckReport    `json:"top_decks"`
+	Degenerate []matchupReport `json:"degenerate_matchups"`
+}
+
+// result is the outcome of one battle between two decks, by index.
+type result struct {
+	attacker, defender int
+	log                models.BattleLog
+}
+
+func main() {
+	size := flag.Int("size", 5, "cards per deck (1-5)")
+	maxDecks := flag.Int("decks", 100, "decks to play; every combination is used when there are no more than this")
+	seed := flag.Int64("seed", 1, "seed for sampling decks")
+	workers := flag.Int("workers", runtime.NumCPU(), "battles to run in parallel")
+	top := flag.Int("top", 20, "dominant decks to report")
+	format := flag.String("format", "csv", "report format: csv or json")
+	out := flag.String("out", "balance", "directory to write the report to")
+	flag.Parse()
+
+	if *size < 1 || *size > 5 {
+		log.Fatalf("-size must be between 1 and 5")
+	}
+	if *maxDecks < 2 {
+		log.Fatalf("-decks must be at least 2")
+	}
+	if *format != "csv" && *format != "json" {
+		log.Fatalf("-format must be csv or json")
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	cfg := config.Load()
+	if err := db.Connect(cfg.DatabaseURL); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	catalog, err := handlers.LoadBotCatalog()
+	db.Close()
+	if err != nil {
+		log.Fatalf("load catalog: %v", err)
+	}
+	if len(catalog) < *size {
+		log.Fatalf("catalog has %d cards, fewer than -size %d", len(catalog), *size)
+	}
+
+	decks, sampled := buildDecks(len(catalog), *size, *maxDecks, rand.New(rand.NewSource(*seed)))
+	battles := len(decks) * (len(decks) - 1)
+	how := "all"
+	if sampled {
+		how = "sampled"
+	}
+	log.Printf("%d cards, %d decks of %d (%s), %d battles on %d workers",
+		len(catalog), len(decks), *size, how, battles, *workers)
+
+	// Every deck plays every other one on both sides.
+	jobs := make(chan [2]int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				att := deckCards(catalog, decks[j[0]])
+				def := deckCards(catalog, decks[j[1]])
+				results <- result{j[0], j[1], engine.RunBattle(att, def)}
+			}
+		}()
+	}
+	go func() {
+		for i := range decks {
+			for k := range decks {
+				if i != k {
+					jobs <- [2]int{i, k}
+				}
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	stats := make([]deckReport, len(decks))
+	var degenerate []matchupReport
+	totalRounds, done := 0, 0
+	for r := range results {
+		att, def := &stats[r.attacker], &stats[r.defender]
+		att.Battles++
+		def.Battles++
+		switch r.log.Winner {
+		case "attacker":
+			att.Wins++
+			def.Losses++
+		case "defender":
+			def.Wins++
+			att.Losses++
+		default:
+			att.Ties++
+			def.Ties++
+		}
+		totalRounds += r.log.TotalRounds
+		// A battle only ends with cards on both sides when it ran out of rounds.
+		if r.log.AttackerRemaining > 0 && r.log.DefenderRemaining > 0 {
+			degenerate = append(degenerate, matchupReport{
+				Attacker:          deckNames(catalog, decks[r.attacker]),
+				Defender:          deckNames(catalog, decks[r.defender]),
+				Winner:            r.log.Winner,
+				Rounds:            r.log.TotalRounds,
+				AttackerRemaining: r.log.AttackerRemaining,
+				DefenderRemaining: r.log.DefenderRemaining,
+			})
+		}
+		done++
+		if battles >= 10 && done%(battles/10) == 0 {
+			log.Printf("%d/%d battles", done, battles)
+		}
+	}
+
+	rep := report{
+		Decks:      len(decks),
+		DeckSize:   *size,
+		Sampled:    sampled,
+		Seed:       *seed,
+		Battles:    battles,
+		AvgRounds:  float64(totalRounds) / float64(battles),
+		Cards:      cardReports(catalog, decks, stats),
+		TopDecks:   topDecks(catalog, decks, stats, *top),
+		Degenerate: degenerate,
+	}
+	if rep.Degenerate == nil {
+		rep.Degenerate = []matchupReport{}
+	}
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalf("create %s: %v", *out, err)
+	}
+	if *format == "json" {
+		err = writeJSON(filepath.Join(*out, "report.json"), rep)
+	} else {
+		err = writeCSVs(*out, rep)
+	}
+	if err != nil {
+		log.Fatalf("write report: %v", err)
+	}
+	log.Printf("%d battles, %.1f rounds on average, %d hit the round cap; report in %s",
+		battles, rep.AvgRounds, len(degenerate), *out)
+}
+
+// buildDecks picks decks of size distinct cards out of n, as catalog
+// indexes. All combinations are returned when there are at most max of them;
+// otherwise max different ones are sampled.
+func buildDecks(n, size, max int, rng *rand.Rand) ([][]int, bool) {
+	if combinations(n, size, max) <= max {
+		var decks [][]int
+		deck := make([]int, size)
+		var walk func(pos, from int)
+		walk = func(pos, from int) {
+			if pos == size {
+				decks = append(decks, append([]int{}, deck...))
+				return
+			}
+			for i := from; i < n; i++ {
+				deck[pos] = i
+				walk(pos+1, i+1)
+			}
+		}
+		walk(0, 0)
+		return decks, false
+	}
+
+	seen := map[string]bool{}
+	var decks [][]int
+	for len(decks) < max {
+		deck := rng.Perm(n)[:size]
+		sort.Ints(deck)
+		key := deckKey(deck)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		decks = append(decks, deck)
+	}
+	return decks, true
+}
+
+// combinations is n choose k, or anything above limit once it passes it.
+func combinations(n, k, limit int) int {
+	c := 1
+	for i := 0; i < k; i++ {
+		c = c * (n - i) / (i + 1)
+		if c > limit {
+			return limit + 1
+		}
+	}
+	return c
+}
+
+func deckKey(deck []int) string {
+	parts := make([]string, len(deck))
+	for i, c := range deck {
+		parts[i] = strconv.Itoa(c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// deckCards builds a battle deck, numbering the cards the way stored decks
+// are.
+func deckCards(catalog []models.BattleCard, deck []int) []models.BattleCard {
+	cards := make([]models.BattleCard, len(deck))
+	for i, c := range deck {
+		cards[i] = catalog[c]
+		cards[i].ID = int64(i + 1)
+		cards[i].Effects = append([]string{}, catalog[c].Effects...)
+	}
+	return cards
+}
+
+func deckNames(catalog []models.BattleCard, deck []int) []string {
+	names := make([]string, len(deck))
+	for i, c := range deck {
+		names[i] = catalog[c].CardID
+	}
+	return names
+}
+
+func winRate(wins, battles int) float64 {
+	if battles == 0 {
+		return 0
+	}
+	return float64(wins) / float64(battles)
+}
+
+// cardReports sums deck results per card, most helpful cards first.
+func cardReports(catalog []models.BattleCard, decks [][]int, stats []deckReport) []cardReport {
+	cards := make([]cardReport, len(catalog))
+	for i, c := range catalog {
+		cards[i] = cardReport{CardID: c.CardID, Name: c.Name, Rarity: c.Rarity}
+	}
+	var totalBattles, totalWins int
+	for d, deck := range decks {
+		totalBattles += stats[d].Battles
+		totalWins += stats[d].Wins
+		for _, c := range deck {
+			cards[c].Decks++
+			cards[c].Battles += stats[d].Battles
+			cards[c].Wins += stats[d].Wins
+			cards[c].Losses += stats[d].Losses
+			cards[c].Ties += stats[d].Ties
+		}
+	}
+
+	var out []cardReport
+	for _, c := range cards {
+		if c.Decks == 0 {
+			continue
+		}
+		c.WinRate = winRate(c.Wins, c.Battles)
+		c.Contribution = c.WinRate - winRate(totalWins-c.Wins, totalBattles-c.Battles)
+		out = append(out, c)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Contribution > out[j].Contribution })
+	return out
+}
+
+// topDecks returns the n decks with the best win rates.
+func topDecks(catalog []models.BattleCard, decks [][]int, stats []deckReport, n int) []deckReport {
+	out := make([]deckReport, len(decks))
+	for d, deck := range decks {
+		out[d] = stats[d]
+		out[d].Cards = deckNames(catalog, deck)
+		out[d].WinRate = winRate(stats[d].Wins, stats[d].Battles)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].WinRate > out[j].WinRate })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func writeJSON(path string, rep report) error {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func writeCSVs(dir string, rep report) error {
+	cards := [][]string{{"card_id", "name", "rarity", "decks", "battles", "wins", "losses", "ties", "win_rate", "contribution"}}
+	for _, c := range rep.Cards {
+		cards = append(cards, []string{c.CardID, c.Name, c.Rarity, itoa(c.Decks), itoa(c.Battles),
+			itoa(c.Wins), itoa(c.Losses), itoa(c.Ties), ftoa(c.WinRate), ftoa(c.Contribution)})
+	}
+	decks := [][]string{{"cards", "battles", "wins", "losses", "ties", "win_rate"}}
+	for _, d := range rep.TopDecks {
+		decks = append(decks, []string{strings.Join(d.Cards, " "), itoa(d.Battles),
+			itoa(d.Wins), itoa(d.Losses), itoa(d.Ties), ftoa(d.WinRate)})
+	}
+	matchups := [][]string{{"attacker", "defender", "winner", "rounds", "attacker_remaining", "defender_remaining"}}
+	for _, m := range rep.Degenerate {
+		matchups = append(matchups, []string{strings.Join(m.Attacker, " "), strings.Join(m.Defender, " "),
+			m.Winner, itoa(m.Rounds), itoa(m.AttackerRemaining), itoa(m.DefenderRemaining)})
+	}
+
+	for name, records := range map[string][][]string{"cards.csv": cards, "decks.csv": decks, "matchups.csv": matchups} {
+		if err := writeCSV(filepath.Join(dir, name), records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(path string, records [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := csv.NewWriter(f).WriteAll(records); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func itoa(n int) string {
+	return strconv.Itoa(n)
+}
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
@@ -0,0 +1,101 @@
+// Command migratelogs rewrites stored battle logs into the compact format at
+// the current log version, a batch at a time: full logs from before the
+// compact format and logs written by older versions of the model. Each log is
+// checked to read back the same before it is written; logs that don't, or
+// can't be read, are left alone and reported.
+//
+//	go run ./cmd/migratelogs [-batch 500] [-dry-run]
+//
+// It reads DATABASE_URL like the API does and is safe to stop and rerun.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"imperium/battlelog"
+	"imperium/config"
+	"imperium/db"
+	"imperium/models"
+)
+
+func main() {
+	batch := flag.Int("batch", 500, "battles to migrate per batch")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing")
+	flag.Parse()
+
+	cfg := config.Load()
+	if err := db.Connect(cfg.DatabaseURL); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var migrated, skipped int
+	var before, after int64
+	// Walk the table in order so skipped battles (and everything in a dry
+	// run) aren't picked up again.
+	var afterCreated time.Time
+	afterID := "00000000-0000-0000-0000-000000000000"
+	for {
+		rows, err := db.Pool.Query(ctx,
+			`SELECT id, created_at, battle_log FROM battles
+			 WHERE battle_log IS NOT NULL
+			   AND (battle_log->>'format' IS DISTINCT FROM 'compact'
+			        OR COALESCE((battle_log->>'version')::INT, 1) <> $1)
+			   AND (created_at, id) > ($2, $3::UUID)
+			 ORDER BY created_at, id LIMIT $4`, models.BattleLogVersion, afterCreated, afterID, *batch)
+		if err != nil {
+			log.Fatalf("query battles: %v", err)
+		}
+		type row struct {
+			id      string
+			created time.Time
+			raw     []byte
+		}
+		var todo []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.created, &r.raw); err != nil {
+				log.Fatalf("scan battle: %v", err)
+			}
+			todo = append(todo, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Fatalf("read battles: %v", err)
+		}
+		if len(todo) == 0 {
+			break
+		}
+
+		for _, r := range todo {
+			afterCreated, afterID = r.created, r.id
+			rewritten, err := battlelog.Rewrite(r.raw)
+			if err != nil {
+				log.Printf("battle %s: %v, skipped", r.id, err)
+				skipped++
+				continue
+			}
+			before += int64(len(r.raw))
+			after += int64(len(rewritten))
+			migrated++
+			if *dryRun {
+				continue
+			}
+			if _, err := db.Pool.Exec(ctx, `UPDATE battles SET battle_log = $2 WHERE id = $1`, r.id, rewritten); err != nil {
+				log.Fatalf("update battle %s: %v", r.id, err)
+			}
+		}
+		log.Printf("%d battles migrated, %d skipped so far", migrated, skipped)
+	}
+
+	verb := "migrated"
+	if *dryRun {
+		verb = "would migrate"
+	}
+	log.Printf("%s %d battles to log version %d (%d -> %d bytes of JSON), skipped %d",
+		verb, migrated, models.BattleLogVersion, before, after, skipped)
+}
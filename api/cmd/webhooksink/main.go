@@ -0,0 +1,60 @@
+// Command webhooksink is a local stand-in for a webhook receiver. It checks
+// each request's signature, prints the event and answers with a chosen
+// status, so deliveries, retries and dead letters can be tried out without
+// a real receiver.
+//
+//	go run ./cmd/webhooksink -secret <secret> -addr :8099
+//
+// Register it with POST /webhooks {"url": "http://localhost:8099/", "secret": "<secret>"}.
+// -fail N answers 500 to the first N requests to exercise retries.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"imperium/webhook"
+)
+
+func main() {
+	addr := flag.String("addr", ":8099", "address to listen on")
+	secret := flag.String("secret", "", "webhook secret to verify signatures with (skipped if empty)")
+	fail := flag.Int64("fail", 0, "answer 500 to this many requests before accepting")
+	flag.Parse()
+
+	var seen atomic.Int64
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read error", http.StatusBadRequest)
+			return
+		}
+
+		if *secret != "" {
+			err := webhook.Verify(*secret, r.Header.Get(webhook.TimestampHeader),
+				r.Header.Get(webhook.SignatureHeader), body, time.Now())
+			if err != nil {
+				log.Printf("rejected delivery %s: %v", r.Header.Get(webhook.DeliveryHeader), err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		n := seen.Add(1)
+		if n <= *fail {
+			log.Printf("failing delivery %s on purpose (%d/%d)", r.Header.Get(webhook.DeliveryHeader), n, *fail)
+			http.Error(w, "failing on purpose", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("%s delivery %s: %s", r.Header.Get(webhook.EventHeader), r.Header.Get(webhook.DeliveryHeader), body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("webhook sink listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -9,6 +9,7 @@ import (
 type Config struct {
 	DatabaseURL string
 	Port        string
+	AdminToken  string
 }
 
 func Load() *Config {
@@ -22,5 +23,6 @@ func Load() *Config {
 	return &Config{
 		DatabaseURL: os.Getenv("DATABASE_URL"),
 		Port:        port,
+		AdminToken:  os.Getenv("ADMIN_TOKEN"),
 	}
 }
@@ -4,12 +4,58 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var Pool *pgxpool.Pool
 
+// Querier is implemented by both Pool and pgx.Tx so helpers can run either
+// inside or outside a transaction.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Tx is a transaction that can run callbacks once it has committed.
+type Tx struct {
+	pgx.Tx
+	afterCommit []func()
+}
+
+// Begin starts a transaction on Pool.
+func Begin(ctx context.Context) (*Tx, error) {
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx}, nil
+}
+
+// AfterCommit queues fn to run once the transaction has committed. It never
+// runs if the transaction is rolled back.
+func (tx *Tx) AfterCommit(fn func()) {
+	tx.afterCommit = append(tx.afterCommit, fn)
+}
+
+// Commit commits the transaction and then runs the AfterCommit callbacks.
+func (tx *Tx) Commit(ctx context.Context) error {
+	if err := tx.Tx.Commit(ctx); err != nil {
+		return err
+	}
+	fns := tx.afterCommit
+	tx.afterCommit = nil
+	for _, fn := range fns {
+		fn()
+	}
+	return nil
+}
+
 func Connect(databaseURL string) error {
 	var err error
 	Pool, err = pgxpool.New(context.Background(), databaseURL)
@@ -19,14 +65,58 @@ func Connect(databaseURL string) error {
 	return Pool.Ping(context.Background())
 }
 
+// Migrate applies every db/migrations/*.sql file that has not been recorded in
+// schema_migrations yet, in file name order.
 func Migrate() error {
-	sql, err := os.ReadFile("db/migrations/001_init.sql")
+	ctx := context.Background()
+
+	_, err := Pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ DEFAULT NOW()
+	)`)
 	if err != nil {
-		return fmt.Errorf("reading migration: %w", err)
+		return fmt.Errorf("creating schema_migrations: %w", err)
 	}
-	_, err = Pool.Exec(context.Background(), string(sql))
+
+	files, err := filepath.Glob("db/migrations/*.sql")
 	if err != nil {
-		return fmt.Errorf("running migration: %w", err)
+		return fmt.Errorf("listing migrations: %w", err)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		name := filepath.Base(file)
+
+		var applied bool
+		err := Pool.QueryRow(ctx,
+			`SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE name = $1)`, name).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("checking migration %s: %w", name, err)
+		}
+		if applied {
+			continue
+		}
+
+		sql, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("reading migration %s: %w", name, err)
+		}
+
+		tx, err := Pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("starting migration %s: %w", name, err)
+		}
+		if _, err := tx.Exec(ctx, string(sql)); err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("running migration %s: %w", name, err)
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (name) VALUES ($1)`, name); err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("recording migration %s: %w", name, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("committing migration %s: %w", name, err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS rating INT NOT NULL DEFAULT 1000;
+
+CREATE INDEX IF NOT EXISTS idx_users_rating ON users (rating);
+CREATE INDEX IF NOT EXISTS idx_battles_attacker_created ON battles (attacker_id, created_at DESC);
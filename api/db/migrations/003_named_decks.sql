@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS decks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id BIGINT REFERENCES users(id),
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS deck_cards (
+    deck_id UUID REFERENCES decks(id) ON DELETE CASCADE,
+    slot INT NOT NULL,
+    user_card_id UUID REFERENCES user_cards(id),
+    PRIMARY KEY (deck_id, slot)
+);
+
+-- purpose is 'attack', 'defense' or 'dungeon:<easy|medium|hard>'
+CREATE TABLE IF NOT EXISTS active_decks (
+    user_id BIGINT REFERENCES users(id),
+    purpose TEXT NOT NULL,
+    deck_id UUID REFERENCES decks(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, purpose)
+);
+
+-- Move every existing single deck into a deck named "default" used for both
+-- attack and defense.
+INSERT INTO decks (user_id, name)
+SELECT DISTINCT user_id, 'default' FROM user_deck
+ON CONFLICT (user_id, name) DO NOTHING;
+
+INSERT INTO deck_cards (deck_id, slot, user_card_id)
+SELECT d.id, ud.slot, ud.user_card_id
+FROM user_deck ud
+JOIN decks d ON d.user_id = ud.user_id AND d.name = 'default'
+ON CONFLICT (deck_id, slot) DO NOTHING;
+
+INSERT INTO active_decks (user_id, purpose, deck_id)
+SELECT d.user_id, p.purpose, d.id
+FROM decks d
+CROSS JOIN (VALUES ('attack'), ('defense')) AS p(purpose)
+WHERE d.name = 'default'
+ON CONFLICT (user_id, purpose) DO NOTHING;
+
+DROP TABLE IF EXISTS user_deck;
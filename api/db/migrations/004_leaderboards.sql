@@ -0,0 +1,36 @@
+CREATE TABLE IF NOT EXISTS seasons (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    closed_at TIMESTAMPTZ
+);
+
+-- Per-season counters behind the seasonal leaderboards, bumped as battles
+-- and dungeons happen.
+CREATE TABLE IF NOT EXISTS season_stats (
+    season_id INT REFERENCES seasons(id),
+    user_id BIGINT REFERENCES users(id),
+    pvp_battles INT NOT NULL DEFAULT 0,
+    pvp_wins INT NOT NULL DEFAULT 0,
+    pve_wins INT NOT NULL DEFAULT 0,
+    dungeon_clears INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (season_id, user_id)
+);
+
+-- Final standings of a closed season, one row per board and user.
+CREATE TABLE IF NOT EXISTS season_standings (
+    season_id INT REFERENCES seasons(id),
+    board TEXT NOT NULL,
+    user_id BIGINT REFERENCES users(id),
+    rank INT NOT NULL,
+    score BIGINT NOT NULL,
+    rewarded_at TIMESTAMPTZ,
+    PRIMARY KEY (season_id, board, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_cards_user_card ON user_cards (user_id, card_id);
+
+INSERT INTO seasons (name, starts_at, ends_at)
+SELECT 'Season 1', NOW(), NOW() + INTERVAL '30 days'
+WHERE NOT EXISTS (SELECT 1 FROM seasons);
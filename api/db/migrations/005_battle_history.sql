@@ -0,0 +1,35 @@
+-- Summary columns so battle history and stats don't need to read battle_log.
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS mode TEXT;
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS winner_side TEXT;
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS rounds INT;
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS attacker_remaining INT;
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS defender_remaining INT;
+-- FALSE until battle_card_stats has been filled in for the battle.
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS stats_indexed BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE battles SET
+    mode = CASE WHEN defender_id = -1 THEN 'pve' ELSE 'pvp' END,
+    winner_side = battle_log->>'winner',
+    rounds = (battle_log->>'total_rounds')::INT,
+    attacker_remaining = (battle_log->>'attacker_remaining')::INT,
+    defender_remaining = (battle_log->>'defender_remaining')::INT
+WHERE mode IS NULL;
+
+ALTER TABLE battles ALTER COLUMN mode SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_battles_defender_created ON battles (defender_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_battles_unindexed ON battles (created_at) WHERE NOT stats_indexed;
+
+-- Damage and kills per catalog card, per player and battle. Filled when a
+-- battle is saved; older battles are backfilled by a background job.
+CREATE TABLE IF NOT EXISTS battle_card_stats (
+    battle_id UUID REFERENCES battles(id) ON DELETE CASCADE,
+    user_id BIGINT REFERENCES users(id),
+    card_id TEXT NOT NULL,
+    copies INT NOT NULL DEFAULT 0,
+    damage_dealt INT NOT NULL DEFAULT 0,
+    kills INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (battle_id, user_id, card_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_battle_card_stats_user ON battle_card_stats (user_id);
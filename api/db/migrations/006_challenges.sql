@@ -0,0 +1,36 @@
+-- Set while a card is staked in a pending challenge so it can't be staked twice.
+ALTER TABLE user_cards ADD COLUMN IF NOT EXISTS staked_in UUID;
+
+CREATE TABLE IF NOT EXISTS challenges (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    challenger_id BIGINT REFERENCES users(id),
+    defender_id BIGINT REFERENCES users(id),
+    -- pending, completed, declined, cancelled or expired
+    status TEXT NOT NULL DEFAULT 'pending',
+    stake_coins INT NOT NULL DEFAULT 0,
+    challenger_card_id UUID REFERENCES user_cards(id),
+    defender_card_id UUID REFERENCES user_cards(id),
+    challenger_deck JSONB NOT NULL,
+    defender_deck JSONB,
+    battle_id UUID REFERENCES battles(id),
+    winner_id BIGINT,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_challenges_pending ON challenges (expires_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_challenges_challenger ON challenges (challenger_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_challenges_defender ON challenges (defender_id, created_at DESC);
+
+-- Messages for the bot to deliver to players.
+CREATE TABLE IF NOT EXISTS notifications (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT REFERENCES users(id),
+    kind TEXT NOT NULL,
+    payload JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    read_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user_id, id DESC);
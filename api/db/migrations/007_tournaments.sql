@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS tournaments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    -- single_elimination or swiss
+    format TEXT NOT NULL,
+    -- registration, running, finished or cancelled
+    status TEXT NOT NULL DEFAULT 'registration',
+    entry_fee INT NOT NULL DEFAULT 0,
+    max_players INT NOT NULL DEFAULT 32,
+    swiss_rounds INT NOT NULL DEFAULT 0,
+    round_interval_minutes INT NOT NULL DEFAULT 10,
+    current_round INT NOT NULL DEFAULT 0,
+    prize_pool INT NOT NULL DEFAULT 0,
+    registration_closes_at TIMESTAMPTZ NOT NULL,
+    next_round_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS tournament_entries (
+    tournament_id UUID REFERENCES tournaments(id) ON DELETE CASCADE,
+    user_id BIGINT REFERENCES users(id),
+    -- BattleCard stats snapshotted at registration
+    deck JSONB NOT NULL,
+    seed INT,
+    score INT NOT NULL DEFAULT 0,
+    eliminated BOOLEAN NOT NULL DEFAULT FALSE,
+    final_rank INT,
+    prize INT NOT NULL DEFAULT 0,
+    registered_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (tournament_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS tournament_matches (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tournament_id UUID REFERENCES tournaments(id) ON DELETE CASCADE,
+    round INT NOT NULL,
+    position INT NOT NULL,
+    player_a BIGINT REFERENCES users(id),
+    -- NULL for a bye
+    player_b BIGINT REFERENCES users(id),
+    winner_id BIGINT,
+    battle_id UUID REFERENCES battles(id),
+    resolved_at TIMESTAMPTZ,
+    UNIQUE (tournament_id, round, position)
+);
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS guilds (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    member_cap INT NOT NULL DEFAULT 30,
+    treasury INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- A user belongs to at most one guild.
+CREATE TABLE IF NOT EXISTS guild_members (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id),
+    guild_id UUID NOT NULL REFERENCES guilds(id) ON DELETE CASCADE,
+    -- leader, officer or member
+    role TEXT NOT NULL,
+    joined_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_guild_members_guild ON guild_members (guild_id);
+
+CREATE TABLE IF NOT EXISTS guild_contributions (
+    id BIGSERIAL PRIMARY KEY,
+    guild_id UUID NOT NULL REFERENCES guilds(id) ON DELETE CASCADE,
+    user_id BIGINT REFERENCES users(id),
+    amount INT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_guild_contributions_guild ON guild_contributions (guild_id, user_id);
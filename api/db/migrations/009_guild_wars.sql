@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS guild_wars (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    guild_a UUID NOT NULL REFERENCES guilds(id) ON DELETE CASCADE,
+    guild_b UUID NOT NULL REFERENCES guilds(id) ON DELETE CASCADE,
+    -- open or finished
+    status TEXT NOT NULL DEFAULT 'open',
+    score_a INT NOT NULL DEFAULT 0,
+    score_b INT NOT NULL DEFAULT 0,
+    -- NULL while open or on a draw
+    winner_guild UUID,
+    starts_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ends_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_guild_wars_open ON guild_wars (ends_at) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_guild_wars_guild_a ON guild_wars (guild_a, starts_at DESC);
+CREATE INDEX IF NOT EXISTS idx_guild_wars_guild_b ON guild_wars (guild_b, starts_at DESC);
+
+-- One member of each guild, paired when the war opens and fought when it
+-- closes. Member A's defense deck attacks member B's.
+CREATE TABLE IF NOT EXISTS guild_war_pairings (
+    war_id UUID REFERENCES guild_wars(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    member_a BIGINT NOT NULL REFERENCES users(id),
+    member_b BIGINT NOT NULL REFERENCES users(id),
+    battle_id UUID REFERENCES battles(id),
+    winner_id BIGINT,
+    score_a INT NOT NULL DEFAULT 0,
+    score_b INT NOT NULL DEFAULT 0,
+    resolved_at TIMESTAMPTZ,
+    PRIMARY KEY (war_id, position)
+);
@@ -0,0 +1,15 @@
+-- One row per pair of players, whoever sent the request.
+CREATE TABLE IF NOT EXISTS friendships (
+    requester_id BIGINT REFERENCES users(id),
+    addressee_id BIGINT REFERENCES users(id),
+    -- pending or accepted
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    accepted_at TIMESTAMPTZ,
+    PRIMARY KEY (requester_id, addressee_id),
+    CHECK (requester_id <> addressee_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_friendships_pair
+    ON friendships (LEAST(requester_id, addressee_id), GREATEST(requester_id, addressee_id));
+CREATE INDEX IF NOT EXISTS idx_friendships_addressee ON friendships (addressee_id);
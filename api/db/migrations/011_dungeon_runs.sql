@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS dungeon_runs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id BIGINT REFERENCES users(id),
+    dungeon TEXT NOT NULL,
+    -- active, cleared, failed or abandoned
+    status TEXT NOT NULL DEFAULT 'active',
+    -- Floors cleared so far, out of floors.
+    floor INT NOT NULL DEFAULT 0,
+    floors INT NOT NULL,
+    -- The dungeon deck's user_cards, in slot order, locked in for the run.
+    -- Their current_hp carries over from floor to floor.
+    card_ids UUID[] NOT NULL,
+    coins_earned INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_dungeon_runs_active ON dungeon_runs (user_id) WHERE status = 'active';
+
+CREATE TABLE IF NOT EXISTS dungeon_run_floors (
+    run_id UUID REFERENCES dungeon_runs(id) ON DELETE CASCADE,
+    floor INT NOT NULL,
+    battle_id UUID REFERENCES battles(id),
+    cleared BOOLEAN NOT NULL,
+    loot JSONB NOT NULL DEFAULT '[]',
+    PRIMARY KEY (run_id, floor)
+);
+
+-- Cards start every run at full health.
+UPDATE user_cards uc SET current_hp = cd.base_hp
+FROM card_definitions cd
+WHERE cd.id = uc.card_id AND uc.current_hp IS NULL;
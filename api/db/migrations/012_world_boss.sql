@@ -0,0 +1,22 @@
+-- One world boss per week; its HP is shared by every player.
+CREATE TABLE IF NOT EXISTS world_boss_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    boss_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    max_hp INT NOT NULL,
+    hp_remaining INT NOT NULL,
+    starts_at TIMESTAMPTZ NOT NULL UNIQUE,
+    ends_at TIMESTAMPTZ NOT NULL,
+    defeated_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS world_boss_attacks (
+    id BIGSERIAL PRIMARY KEY,
+    event_id UUID NOT NULL REFERENCES world_boss_events(id) ON DELETE CASCADE,
+    user_id BIGINT REFERENCES users(id),
+    battle_id UUID REFERENCES battles(id),
+    damage INT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_world_boss_attacks_event_user ON world_boss_attacks (event_id, user_id, created_at);
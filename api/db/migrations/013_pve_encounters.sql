@@ -0,0 +1,4 @@
+-- Generated PvE battles keep the seed and the rest of the generator input so
+-- the encounter can be rebuilt.
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS seed BIGINT;
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS encounter JSONB;
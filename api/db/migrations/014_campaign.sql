@@ -0,0 +1,12 @@
+-- Best result per user and campaign stage. Stages themselves are defined in
+-- code (handlers/campaign.go).
+CREATE TABLE IF NOT EXISTS campaign_progress (
+    user_id BIGINT REFERENCES users(id),
+    stage_id TEXT NOT NULL,
+    stars INT NOT NULL DEFAULT 0,
+    attempts INT NOT NULL DEFAULT 0,
+    best_battle_id UUID REFERENCES battles(id),
+    first_cleared_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, stage_id)
+);
@@ -0,0 +1,17 @@
+-- Daily and weekly quests handed out to each player. Quest templates are
+-- defined in code (handlers/quests.go); a row is one template assigned to a
+-- player for one period.
+CREATE TABLE IF NOT EXISTS user_quests (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT REFERENCES users(id),
+    template_id TEXT NOT NULL,
+    period TEXT NOT NULL,
+    period_start DATE NOT NULL,
+    progress INT NOT NULL DEFAULT 0,
+    target INT NOT NULL,
+    claimed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (user_id, template_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_quests_user ON user_quests(user_id, period_start);
@@ -0,0 +1,10 @@
+-- Permanent achievements per player. The achievements themselves are defined
+-- in code (handlers/achievements.go).
+CREATE TABLE IF NOT EXISTS user_achievements (
+    user_id BIGINT REFERENCES users(id),
+    achievement_id TEXT NOT NULL,
+    unlocked_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- The battle that unlocked it, for battle achievements.
+    battle_id UUID REFERENCES battles(id),
+    PRIMARY KEY (user_id, achievement_id)
+);
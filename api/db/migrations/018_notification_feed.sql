@@ -0,0 +1,7 @@
+-- Set once the bot has messaged the player about a notification. Existing
+-- notifications are old news by now, so they count as delivered.
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMPTZ;
+UPDATE notifications SET delivered_at = created_at WHERE delivered_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_notifications_undelivered ON notifications (id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications (user_id) WHERE read_at IS NULL;
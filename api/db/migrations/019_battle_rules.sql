@@ -0,0 +1,4 @@
+-- The rules each battle was played by (round cap, first mover, tiebreak,
+-- round length). Battles from before rules could change have none; they were
+-- all played by the standard rules.
+ALTER TABLE battles ADD COLUMN IF NOT EXISTS rules JSONB;
@@ -0,0 +1,8 @@
+-- Players searching for a PvP opponent. The rating window widens with how
+-- long they have been searching (handlers/matchmaking.go); a search nobody
+-- has polled for a while starts over.
+CREATE TABLE IF NOT EXISTS pvp_queue (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id),
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    polled_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
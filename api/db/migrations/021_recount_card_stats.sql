@@ -0,0 +1,5 @@
+-- Card stats used to mix up the two sides' cards whenever their ids matched,
+-- as they do in PvP where both decks count from 1. Throw them away so the
+-- backfill (handlers/history.go) counts them again from the battle logs.
+DELETE FROM battle_card_stats;
+UPDATE battles SET stats_indexed = FALSE WHERE stats_indexed;
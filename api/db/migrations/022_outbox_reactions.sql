@@ -0,0 +1,19 @@
+-- Quests and achievements react to outbox events in the background once the
+-- write has committed (handlers/events.go). Each reactor records the events
+-- it has handled, so a retry never counts one twice. reacted_at is set once
+-- every reactor has handled the event; one that keeps failing is given up on
+-- after a few attempts.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS reacted_at TIMESTAMPTZ;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS react_attempts INT NOT NULL DEFAULT 0;
+
+-- Events so far were reacted to as they happened.
+UPDATE outbox SET reacted_at = NOW();
+
+CREATE INDEX IF NOT EXISTS idx_outbox_unreacted ON outbox (id) WHERE reacted_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS outbox_reactions (
+    outbox_id BIGINT REFERENCES outbox(id) ON DELETE CASCADE,
+    reactor TEXT NOT NULL,
+    reacted_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (outbox_id, reactor)
+);
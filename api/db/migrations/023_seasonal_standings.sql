@@ -0,0 +1,3 @@
+-- Closing a season used to snapshot every leaderboard, including ones that
+-- don't reset with the season. Their standings mean nothing.
+DELETE FROM season_standings WHERE board IN ('world_boss', 'collection');
@@ -2,16 +2,34 @@ package engine
 
 import (
 	"imperium/models"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// MaxDeckSize is the most cards a deck can hold. Summons don't go past it.
+const MaxDeckSize = 5
+
+// ClampStat converts a card stat to the int16 cards store it in, saturating
+// instead of wrapping around.
+func ClampStat(v int) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// spawnIDCounter hands out ids for spawned cards. Battles run concurrently,
+// so it is only touched atomically.
 var spawnIDCounter int64 = 10000
 
 func nextSpawnID() int64 {
-	spawnIDCounter++
-	return spawnIDCounter
+	return atomic.AddInt64(&spawnIDCounter, 1)
 }
 
 func hasEffect(card *models.BattleCard, effect string) bool {
@@ -110,141 +128,264 @@ func removeCard(deck *[]models.BattleCard, idx int) {
 	*deck = append((*deck)[:idx], (*deck)[idx+1:]...)
 }
 
+// RunBattle fights two decks until one side runs out of cards, letting the
+// engine pick every move. The decks passed in are copied and left untouched.
 func RunBattle(attackerDeck, defenderDeck []models.BattleCard) models.BattleLog {
-	log := models.BattleLog{}
-	isDefenderTurn := true
-	startTime := time.Now()
+	return RunBattleWith(attackerDeck, defenderDeck, StandardRules)
+}
 
-	for round := 1; round <= 2000; round++ {
-		if len(attackerDeck) == 0 || len(defenderDeck) == 0 {
-			break
-		}
+// RunBattleWith is RunBattle under the given rules.
+func RunBattleWith(attackerDeck, defenderDeck []models.BattleCard, rules Rules) models.BattleLog {
+	b := NewBattleWith(attackerDeck, defenderDeck, rules)
+	for !b.Done() {
+		b.Step(Move{})
+	}
+	return b.Log()
+}
 
-		var actions []models.BattleLogAction
+// Battle is a battle played one turn at a time. Each round the side to move
+// picks a Move and Step plays it; the zero Move plays the turn the way
+// RunBattle always has (front card hits the taunt card or the front card).
+type Battle struct {
+	attackerDeck   []models.BattleCard
+	defenderDeck   []models.BattleCard
+	round          int
+	isDefenderTurn bool
+	startTime      time.Time
+	rules          Rules
+	// suddenDeath is the extra damage every hit deals this round, once the
+	// battle has gone past the round cap under sudden death rules.
+	suddenDeath int16
+	// pending holds what happened at the start of the current round (rampage,
+	// effect hooks) until the turn is played and logged.
+	pending []models.BattleLogAction
+	done    bool
+	log     models.BattleLog
+}
 
-		// a. Apply rampage to all cards on both sides
-		applyRampage(attackerDeck)
-		applyRampage(defenderDeck)
+// NewBattle sets up a battle between copies of the two decks under the
+// standard rules. The defender moves first.
+func NewBattle(attackerDeck, defenderDeck []models.BattleCard) *Battle {
+	return NewBattleWith(attackerDeck, defenderDeck, StandardRules)
+}
 
-		// b. Determine active and passive sides
-		var activeDeck *[]models.BattleCard
-		var passiveDeck *[]models.BattleCard
-		var turnSide string
-		var activeSide, passiveSide string
+// NewBattleWith is NewBattle under the given rules, which are recorded in
+// the log.
+func NewBattleWith(attackerDeck, defenderDeck []models.BattleCard, rules Rules) *Battle {
+	rules = resolveRules(rules)
+	logged := rules
+	b := &Battle{
+		attackerDeck:   snapshotDeck(attackerDeck),
+		defenderDeck:   snapshotDeck(defenderDeck),
+		isDefenderTurn: defenderFirst(rules),
+		startTime:      time.Now(),
+		rules:          rules,
+		log:            models.BattleLog{Version: models.BattleLogVersion, Rules: &logged},
+	}
+	b.beginRound()
+	return b
+}
 
-		if isDefenderTurn {
-			activeDeck = &defenderDeck
-			passiveDeck = &attackerDeck
-			turnSide = "defender"
-			activeSide = "defender"
-			passiveSide = "attacker"
-		} else {
-			activeDeck = &attackerDeck
-			passiveDeck = &defenderDeck
-			turnSide = "attacker"
-			activeSide = "attacker"
-			passiveSide = "defender"
+// beginRound moves on to the next round and applies everything that happens
+// before the side to move picks its move, or ends the battle.
+func (b *Battle) beginRound() {
+	b.round++
+	if len(b.attackerDeck) == 0 || len(b.defenderDeck) == 0 {
+		b.finish()
+		return
+	}
+	if over := b.round - b.rules.MaxRounds; over > 0 {
+		if b.rules.Tiebreak != TiebreakSuddenDeath || over > b.rules.MaxRounds {
+			b.finish()
+			return
 		}
+		b.suddenDeath = int16(over)
+	}
 
-		// c. Active card = front card of active side
-		activeCard := &(*activeDeck)[0]
+	// a. Apply rampage to all cards on both sides
+	applyRampage(b.attackerDeck)
+	applyRampage(b.defenderDeck)
 
-		// d. Find target (taunt check)
-		targetIdx := findTauntTarget(*passiveDeck)
-		targetCard := &(*passiveDeck)[targetIdx]
+	// a2. Run effect hooks (boss phases and the like)
+	b.pending = nil
+	b.pending = append(b.pending, runEffectHooks(&RoundContext{Round: b.round, Side: "attacker", Deck: &b.attackerDeck, Enemy: &b.defenderDeck})...)
+	b.pending = append(b.pending, runEffectHooks(&RoundContext{Round: b.round, Side: "defender", Deck: &b.defenderDeck, Enemy: &b.attackerDeck})...)
+}
 
-		// f. Calculate damage
-		damage := activeCard.Attack
-		if hasEffect(activeCard, "no_attack") {
-			damage = 0
-		}
+// Done reports whether the battle is over.
+func (b *Battle) Done() bool {
+	return b.done
+}
 
-		// g. Apply damage
-		if damage > 0 {
-			targetCard.CurrentHP -= damage
-			actions = append(actions, models.BattleLogAction{
-				Type:       "attack",
-				AttackerID: &activeCard.ID,
-				DefenderID: &targetCard.ID,
-				Damage:     &damage,
-			})
-		}
+// Round is the round being played, starting at 1.
+func (b *Battle) Round() int {
+	return b.round
+}
 
-		// h. Check thorns on target
-		thornsDmg := getThornsDamage(targetCard)
-		if thornsDmg > 0 && damage > 0 {
-			activeCard.CurrentHP -= thornsDmg
-			actions = append(actions, models.BattleLogAction{
-				Type:       "attack",
-				AttackerID: &targetCard.ID,
-				DefenderID: &activeCard.ID,
-				Damage:     &thornsDmg,
-			})
-		}
+// TurnSide is the side to move: "attacker" or "defender".
+func (b *Battle) TurnSide() string {
+	if b.isDefenderTurn {
+		return "defender"
+	}
+	return "attacker"
+}
 
-		// i. Check if target died
-		targetDied := targetCard.CurrentHP <= 0
-		activeDied := activeCard.CurrentHP <= 0
+// Decks returns copies of both decks as they stand.
+func (b *Battle) Decks() (attackerDeck, defenderDeck []models.BattleCard) {
+	return snapshotDeck(b.attackerDeck), snapshotDeck(b.defenderDeck)
+}
 
-		if targetDied {
-			diedID := targetCard.ID
-			actions = append(actions, models.BattleLogAction{
-				Type:       "card_died",
-				DiedCardID: &diedID,
-				DiedSide:   &passiveSide,
-			})
+func (b *Battle) sides() (activeDeck, passiveDeck *[]models.BattleCard, activeSide, passiveSide string) {
+	if b.isDefenderTurn {
+		return &b.defenderDeck, &b.attackerDeck, "defender", "attacker"
+	}
+	return &b.attackerDeck, &b.defenderDeck, "attacker", "defender"
+}
 
-			spawned := processDeathrattle(passiveDeck, targetIdx)
-			if spawned != nil {
-				spawnSide := passiveSide
-				actions = append(actions, models.BattleLogAction{
-					Type:        "spawn_card",
-					Side:        &spawnSide,
-					SpawnedCard: spawned,
-				})
-			} else {
-				removeCard(passiveDeck, targetIdx)
-			}
+// Step plays the current turn with the given move and logs it. An invalid
+// move is rejected with an error and changes nothing.
+func (b *Battle) Step(m Move) (models.BattleLogEntry, error) {
+	if b.done {
+		return models.BattleLogEntry{}, ErrBattleOver
+	}
+	activeDeck, passiveDeck, activeSide, passiveSide := b.sides()
+
+	// c/d. Active card and its target, as chosen or by default
+	activeIdx, targetIdx, err := resolveMove(*activeDeck, *passiveDeck, m)
+	if err != nil {
+		return models.BattleLogEntry{}, err
+	}
+	activeCard := &(*activeDeck)[activeIdx]
+	targetCard := &(*passiveDeck)[targetIdx]
+
+	actions := b.pending
+	b.pending = nil
+
+	if m.Ability != "" {
+		used := abilities[m.Ability](&RoundContext{Round: b.round, Side: activeSide, Deck: activeDeck, Enemy: passiveDeck}, activeCard, targetCard)
+		if len(used) == 0 {
+			b.pending = actions
+			return models.BattleLogEntry{}, ErrAbilityUnavailable
 		}
+		actions = append(actions, used...)
+	} else {
+		actions = append(actions, attack(activeDeck, passiveDeck, activeIdx, targetIdx, activeSide, passiveSide, b.suddenDeath)...)
+	}
+
+	// k. Snapshot both decks after deaths/spawns
+	entry := models.BattleLogEntry{
+		Round:        b.round,
+		TurnSide:     activeSide,
+		Timestamp:    b.startTime.Add(time.Duration(b.round-1) * time.Duration(b.rules.RoundDurationMs) * time.Millisecond),
+		DurationMs:   b.rules.RoundDurationMs,
+		Actions:      actions,
+		AttackerDeck: snapshotDeck(b.attackerDeck),
+		DefenderDeck: snapshotDeck(b.defenderDeck),
+	}
+	b.log.Entries = append(b.log.Entries, entry)
+
+	// m. Toggle turn
+	b.isDefenderTurn = !b.isDefenderTurn
+	b.beginRound()
+	return entry, nil
+}
+
+// attack has the card at activeIdx hit the card at targetIdx, with thorns,
+// deaths and deathrattles. bonus is added to the damage dealt.
+func attack(activeDeck, passiveDeck *[]models.BattleCard, activeIdx, targetIdx int, activeSide, passiveSide string, bonus int16) []models.BattleLogAction {
+	var actions []models.BattleLogAction
+	activeCard := &(*activeDeck)[activeIdx]
+	targetCard := &(*passiveDeck)[targetIdx]
+
+	// f. Calculate damage
+	damage := ClampStat(int(activeCard.Attack) + int(bonus))
+	if hasEffect(activeCard, "no_attack") {
+		damage = 0
+	}
+
+	// Ids are copied rather than pointed at: the cards move when the deck
+	// shifts after a death.
+	activeID, targetID := activeCard.ID, targetCard.ID
+
+	// g. Apply damage
+	if damage > 0 {
+		targetCard.CurrentHP -= damage
+		actions = append(actions, models.BattleLogAction{
+			Type:       "attack",
+			AttackerID: &activeID,
+			DefenderID: &targetID,
+			Damage:     &damage,
+			TargetSide: &passiveSide,
+		})
+	}
+
+	// h. Check thorns on target
+	thornsDmg := getThornsDamage(targetCard)
+	if thornsDmg > 0 && damage > 0 {
+		activeCard.CurrentHP -= thornsDmg
+		actions = append(actions, models.BattleLogAction{
+			Type:       "attack",
+			AttackerID: &targetID,
+			DefenderID: &activeID,
+			Damage:     &thornsDmg,
+			TargetSide: &activeSide,
+		})
+	}
 
-		// j. Check if active card died (from thorns)
-		if activeDied {
-			diedID := activeCard.ID
+	// i. Check if target died
+	targetDied := targetCard.CurrentHP <= 0
+	activeDied := activeCard.CurrentHP <= 0
+
+	if targetDied {
+		diedID := targetCard.ID
+		actions = append(actions, models.BattleLogAction{
+			Type:       "card_died",
+			DiedCardID: &diedID,
+			DiedSide:   &passiveSide,
+		})
+
+		spawned := processDeathrattle(passiveDeck, targetIdx)
+		if spawned != nil {
+			spawnSide := passiveSide
 			actions = append(actions, models.BattleLogAction{
-				Type:       "card_died",
-				DiedCardID: &diedID,
-				DiedSide:   &activeSide,
+				Type:        "spawn_card",
+				Side:        &spawnSide,
+				SpawnedCard: spawned,
 			})
-
-			spawned := processDeathrattle(activeDeck, 0)
-			if spawned != nil {
-				spawnSide := activeSide
-				actions = append(actions, models.BattleLogAction{
-					Type:        "spawn_card",
-					Side:        &spawnSide,
-					SpawnedCard: spawned,
-				})
-			} else {
-				removeCard(activeDeck, 0)
-			}
+		} else {
+			removeCard(passiveDeck, targetIdx)
 		}
+	}
 
-		// k. Snapshot both decks after deaths/spawns
-		entry := models.BattleLogEntry{
-			Round:        round,
-			TurnSide:     turnSide,
-			Timestamp:    startTime.Add(time.Duration(round-1) * 800 * time.Millisecond),
-			DurationMs:   800,
-			Actions:      actions,
-			AttackerDeck: snapshotDeck(attackerDeck),
-			DefenderDeck: snapshotDeck(defenderDeck),
+	// j. Check if active card died (from thorns)
+	if activeDied {
+		diedID := activeCard.ID
+		actions = append(actions, models.BattleLogAction{
+			Type:       "card_died",
+			DiedCardID: &diedID,
+			DiedSide:   &activeSide,
+		})
+
+		spawned := processDeathrattle(activeDeck, activeIdx)
+		if spawned != nil {
+			spawnSide := activeSide
+			actions = append(actions, models.BattleLogAction{
+				Type:        "spawn_card",
+				Side:        &spawnSide,
+				SpawnedCard: spawned,
+			})
+		} else {
+			removeCard(activeDeck, activeIdx)
 		}
-
-		log.Entries = append(log.Entries, entry)
-
-		// m. Toggle turn
-		isDefenderTurn = !isDefenderTurn
 	}
+	return actions
+}
+
+// finish ends the battle and settles the winner.
+func (b *Battle) finish() {
+	b.done = true
+	attackerDeck, defenderDeck := b.attackerDeck, b.defenderDeck
+	log := &b.log
 
 	log.TotalRounds = len(log.Entries)
 	log.AttackerRemaining = len(attackerDeck)
@@ -255,7 +396,15 @@ func RunBattle(attackerDeck, defenderDeck []models.BattleCard) models.BattleLog
 	} else if len(defenderDeck) > 0 && len(attackerDeck) == 0 {
 		log.Winner = "defender"
 	} else if len(attackerDeck) > 0 && len(defenderDeck) > 0 {
-		// Both have cards — compare total HP
+		// Both have cards — compare cards left if the rules say so, then total HP
+		if b.rules.Tiebreak == TiebreakCardsRemaining && len(attackerDeck) != len(defenderDeck) {
+			if len(attackerDeck) > len(defenderDeck) {
+				log.Winner = "attacker"
+			} else {
+				log.Winner = "defender"
+			}
+			return
+		}
 		atkHP := totalHP(attackerDeck)
 		defHP := totalHP(defenderDeck)
 		if atkHP > defHP {
@@ -268,14 +417,17 @@ func RunBattle(attackerDeck, defenderDeck []models.BattleCard) models.BattleLog
 	} else {
 		log.Winner = "tie"
 	}
+}
 
-	return log
+// Log is the battle log so far; complete once Done.
+func (b *Battle) Log() models.BattleLog {
+	return b.log
 }
 
-func totalHP(deck []models.BattleCard) int16 {
-	var total int16
+func totalHP(deck []models.BattleCard) int {
+	total := 0
 	for _, c := range deck {
-		total += c.CurrentHP
+		total += int(c.CurrentHP)
 	}
 	return total
 }
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+
+	"imperium/models"
+)
+
+// Boss mechanics, written as effect hooks:
+//
+//	taunt_below:<pct>                 gains taunt once its HP drops below pct% of max
+//	summon:<every>:<hp>:<attack>      puts a minion in front of it every N rounds,
+//	                                  while the deck has fewer than MaxDeckSize cards
+//	enrage:<round>:<pct>              attack goes up by pct% from that round on
+//
+// Summon and enrage are also abilities: in an interactive battle the side
+// can spend its turn to summon the minion or enrage right away.
+func init() {
+	RegisterEffectHook("taunt_below", tauntBelowHook)
+	RegisterEffectHook("summon", summonHook)
+	RegisterEffectHook("enrage", enrageHook)
+	RegisterAbility("summon", summonAbility)
+	RegisterAbility("enrage", enrageAbility)
+}
+
+func tauntBelowHook(rc *RoundContext, card *models.BattleCard, param string) []models.BattleLogAction {
+	pct, err := strconv.Atoi(param)
+	if err != nil || hasEffect(card, "taunt") {
+		return nil
+	}
+	if int(card.CurrentHP)*100 >= int(card.MaxHP)*pct {
+		return nil
+	}
+	card.Effects = append(card.Effects, "taunt")
+	return []models.BattleLogAction{phaseAction(card.ID, "taunt")}
+}
+
+func summonHook(rc *RoundContext, card *models.BattleCard, param string) []models.BattleLogAction {
+	parts := strings.Split(param, ":")
+	if len(parts) != 3 {
+		return nil
+	}
+	every, err1 := strconv.Atoi(parts[0])
+	hp, err2 := strconv.Atoi(parts[1])
+	attack, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || every <= 0 || rc.Round%every != 0 {
+		return nil
+	}
+	return summonMinion(rc, hp, attack)
+}
+
+func summonAbility(rc *RoundContext, card, target *models.BattleCard) []models.BattleLogAction {
+	parts := strings.Split(effectParam(card, "summon"), ":")
+	if len(parts) != 3 {
+		return nil
+	}
+	hp, err1 := strconv.Atoi(parts[1])
+	attack, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return summonMinion(rc, hp, attack)
+}
+
+// summonMinion puts a minion in front of rc's deck, if it has room.
+func summonMinion(rc *RoundContext, hp, attack int) []models.BattleLogAction {
+	if len(*rc.Deck) >= MaxDeckSize {
+		return nil
+	}
+
+	minion := models.BattleCard{
+		ID:        nextSpawnID(),
+		CardID:    "minion",
+		Name:      "Minion",
+		CurrentHP: ClampStat(hp),
+		MaxHP:     ClampStat(hp),
+		Attack:    ClampStat(attack),
+		Rarity:    "common",
+		Effects:   []string{},
+	}
+	// Inserting shifts the deck, so card must not be used after this.
+	*rc.Deck = append([]models.BattleCard{minion}, *rc.Deck...)
+
+	side := rc.Side
+	return []models.BattleLogAction{{
+		Type:        "spawn_card",
+		Side:        &side,
+		SpawnedCard: &minion,
+	}}
+}
+
+func enrageHook(rc *RoundContext, card *models.BattleCard, param string) []models.BattleLogAction {
+	fromStr, pctStr, ok := strings.Cut(param, ":")
+	if !ok || hasEffect(card, "enraged") {
+		return nil
+	}
+	from, err1 := strconv.Atoi(fromStr)
+	pct, err2 := strconv.Atoi(pctStr)
+	if err1 != nil || err2 != nil || rc.Round < from {
+		return nil
+	}
+	return enrage(card, pct)
+}
+
+func enrageAbility(rc *RoundContext, card, target *models.BattleCard) []models.BattleLogAction {
+	_, pctStr, _ := strings.Cut(effectParam(card, "enrage"), ":")
+	pct, err := strconv.Atoi(pctStr)
+	if err != nil || hasEffect(card, "enraged") {
+		return nil
+	}
+	return enrage(card, pct)
+}
+
+// enrage raises the card's attack by pct%, once.
+func enrage(card *models.BattleCard, pct int) []models.BattleLogAction {
+	card.Attack = ClampStat(int(card.Attack) + int(card.Attack)*pct/100)
+	card.Effects = append(card.Effects, "enraged")
+	return []models.BattleLogAction{phaseAction(card.ID, "enrage")}
+}
+
+// effectParam is what follows "name:" in the card's effect of that name.
+func effectParam(card *models.BattleCard, name string) string {
+	for _, e := range card.Effects {
+		if param, ok := strings.CutPrefix(e, name+":"); ok {
+			return param
+		}
+	}
+	return ""
+}
+
+func phaseAction(cardID int64, phase string) models.BattleLogAction {
+	return models.BattleLogAction{
+		Type:   "phase",
+		CardID: &cardID,
+		Phase:  &phase,
+	}
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"strings"
+
+	"imperium/models"
+)
+
+// RoundContext is what an effect hook sees: the round about to be played,
+// the side the card is on, and both decks.
+type RoundContext struct {
+	Round int
+	Side  string
+	Deck  *[]models.BattleCard
+	Enemy *[]models.BattleCard
+}
+
+// An EffectHook gives an effect behaviour that goes beyond the built-in
+// rules. It runs at the start of every round for each card carrying the
+// effect, with param set to whatever follows "name:" in the effect string.
+// Hooks may change the card or either deck and return log actions describing
+// what they did.
+type EffectHook func(rc *RoundContext, card *models.BattleCard, param string) []models.BattleLogAction
+
+var effectHooks = map[string]EffectHook{}
+
+// RegisterEffectHook installs the hook for an effect name. It is meant to be
+// called from init functions.
+func RegisterEffectHook(effect string, hook EffectHook) {
+	effectHooks[effect] = hook
+}
+
+// runEffectHooks runs the hooks of every card on one side, front to back.
+// Cards are looked up by id each time since an earlier hook may have
+// reshuffled the deck.
+func runEffectHooks(rc *RoundContext) []models.BattleLogAction {
+	var ids []int64
+	for _, c := range *rc.Deck {
+		ids = append(ids, c.ID)
+	}
+
+	var actions []models.BattleLogAction
+	for _, id := range ids {
+		idx := cardIndex(*rc.Deck, id)
+		if idx < 0 {
+			continue
+		}
+		effects := append([]string{}, (*rc.Deck)[idx].Effects...)
+		for _, e := range effects {
+			name, param, _ := strings.Cut(e, ":")
+			hook, ok := effectHooks[name]
+			if !ok {
+				continue
+			}
+			idx = cardIndex(*rc.Deck, id)
+			if idx < 0 {
+				break
+			}
+			actions = append(actions, hook(rc, &(*rc.Deck)[idx], param)...)
+		}
+	}
+	return actions
+}
+
+func cardIndex(deck []models.BattleCard, id int64) int {
+	for i := range deck {
+		if deck[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"errors"
+
+	"imperium/models"
+)
+
+// Move is a side's choice for its turn. Zero ids leave the choice to the
+// engine: the front card attacks, and it hits the taunt card if there is one
+// or else the front card.
+type Move struct {
+	AttackerID int64 `json:"attacker_id,omitempty"`
+	TargetID   int64 `json:"target_id,omitempty"`
+	// Ability uses the attacker's ability on the target instead of attacking.
+	Ability string `json:"ability,omitempty"`
+}
+
+var (
+	ErrBattleOver         = errors.New("battle is over")
+	ErrUnknownAttacker    = errors.New("attacker is not on the side to move")
+	ErrCannotAttack       = errors.New("that card cannot attack")
+	ErrUnknownTarget      = errors.New("target is not on the other side")
+	ErrMustHitTaunt       = errors.New("a taunt card must be targeted")
+	ErrUnknownAbility     = errors.New("that card has no such ability")
+	ErrAbilityUnavailable = errors.New("that ability can't be used now")
+)
+
+// An AbilityHook is an ability a player can choose to use on their turn in
+// place of attacking. It works like an EffectHook: it may change the card,
+// the target or either deck and returns log actions describing what it did.
+// A card can use an ability when it carries an effect of the same name. An
+// ability that can't do anything right now returns no actions, and the move
+// is refused so the side can pick another.
+type AbilityHook func(rc *RoundContext, card, target *models.BattleCard) []models.BattleLogAction
+
+var abilities = map[string]AbilityHook{}
+
+// RegisterAbility installs the hook for an ability. It is meant to be called
+// from init functions.
+func RegisterAbility(name string, hook AbilityHook) {
+	abilities[name] = hook
+}
+
+// TurnOptions lists what the side to move may choose from: ids of cards that
+// can attack, ids of cards that may be targeted, and the abilities each card
+// can use.
+type TurnOptions struct {
+	Side      string             `json:"side"`
+	Attackers []int64            `json:"attackers"`
+	Targets   []int64            `json:"targets"`
+	Abilities map[int64][]string `json:"abilities,omitempty"`
+}
+
+// Options returns the moves open to the side to move.
+func (b *Battle) Options() TurnOptions {
+	activeDeck, passiveDeck, activeSide, _ := b.sides()
+	opts := TurnOptions{Side: activeSide, Attackers: []int64{}, Targets: []int64{}}
+	if b.done {
+		return opts
+	}
+
+	for i := range *activeDeck {
+		card := &(*activeDeck)[i]
+		if !hasEffect(card, "no_attack") {
+			opts.Attackers = append(opts.Attackers, card.ID)
+		}
+		for name := range abilities {
+			if hasEffect(card, name) {
+				if opts.Abilities == nil {
+					opts.Abilities = map[int64][]string{}
+				}
+				opts.Abilities[card.ID] = append(opts.Abilities[card.ID], name)
+			}
+		}
+	}
+
+	taunted := hasTaunt(*passiveDeck)
+	for i := range *passiveDeck {
+		if !taunted || hasEffect(&(*passiveDeck)[i], "taunt") {
+			opts.Targets = append(opts.Targets, (*passiveDeck)[i].ID)
+		}
+	}
+	return opts
+}
+
+// resolveMove turns a move into deck positions, filling in the engine's
+// defaults for anything left unset.
+func resolveMove(activeDeck, passiveDeck []models.BattleCard, m Move) (activeIdx, targetIdx int, err error) {
+	if m.AttackerID != 0 {
+		activeIdx = cardIndex(activeDeck, m.AttackerID)
+		if activeIdx < 0 {
+			return 0, 0, ErrUnknownAttacker
+		}
+		if m.Ability == "" && hasEffect(&activeDeck[activeIdx], "no_attack") {
+			return 0, 0, ErrCannotAttack
+		}
+	}
+
+	if m.Ability != "" {
+		if _, ok := abilities[m.Ability]; !ok || !hasEffect(&activeDeck[activeIdx], m.Ability) {
+			return 0, 0, ErrUnknownAbility
+		}
+	}
+
+	targetIdx = findTauntTarget(passiveDeck)
+	if m.TargetID != 0 {
+		targetIdx = cardIndex(passiveDeck, m.TargetID)
+		if targetIdx < 0 {
+			return 0, 0, ErrUnknownTarget
+		}
+		if hasTaunt(passiveDeck) && !hasEffect(&passiveDeck[targetIdx], "taunt") {
+			return 0, 0, ErrMustHitTaunt
+		}
+	}
+	return activeIdx, targetIdx, nil
+}
+
+func hasTaunt(deck []models.BattleCard) bool {
+	for i := range deck {
+		if hasEffect(&deck[i], "taunt") {
+			return true
+		}
+	}
+	return false
+}
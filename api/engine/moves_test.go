@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"imperium/models"
+)
+
+func TestAbilityMoves(t *testing.T) {
+	// The effects' own rounds are far off, so only the ability triggers them.
+	summoner := testCard(1, 10, 2, "summon:99:3:2")
+	rager := testCard(2, 10, 4, "enrage:99:50")
+	plain := testCard(3, 10, 1)
+
+	tests := []struct {
+		name    string
+		deck    []models.BattleCard
+		moves   []Move // the attacker's moves; the defender auto-plays in between
+		wantErr error
+		check   func(t *testing.T, b *Battle, entry models.BattleLogEntry)
+	}{
+		{
+			name:  "summon",
+			deck:  []models.BattleCard{summoner},
+			moves: []Move{{AttackerID: 1, Ability: "summon"}},
+			check: func(t *testing.T, b *Battle, entry models.BattleLogEntry) {
+				if len(entry.Actions) != 1 || entry.Actions[0].Type != "spawn_card" {
+					t.Fatalf("actions = %+v, want one spawn_card", entry.Actions)
+				}
+				if len(entry.AttackerDeck) != 2 || entry.AttackerDeck[0].CardID != "minion" {
+					t.Errorf("attacker deck = %+v, want the minion in front", entry.AttackerDeck)
+				}
+				if entry.DefenderDeck[0].CurrentHP != 10 {
+					t.Error("the defender was hit")
+				}
+			},
+		},
+		{
+			name:  "enrage",
+			deck:  []models.BattleCard{rager},
+			moves: []Move{{AttackerID: 2, Ability: "enrage"}},
+			check: func(t *testing.T, b *Battle, entry models.BattleLogEntry) {
+				if len(entry.Actions) != 1 || entry.Actions[0].Type != "phase" {
+					t.Fatalf("actions = %+v, want one phase", entry.Actions)
+				}
+				if got := entry.AttackerDeck[0].Attack; got != 6 {
+					t.Errorf("attack = %d, want 6", got)
+				}
+			},
+		},
+		{
+			name:    "enrage only once",
+			deck:    []models.BattleCard{rager},
+			moves:   []Move{{AttackerID: 2, Ability: "enrage"}, {AttackerID: 2, Ability: "enrage"}},
+			wantErr: ErrAbilityUnavailable,
+		},
+		{
+			name:    "card without the ability",
+			deck:    []models.BattleCard{plain},
+			moves:   []Move{{AttackerID: 3, Ability: "summon"}},
+			wantErr: ErrUnknownAbility,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defender := []models.BattleCard{testCard(10, 10, 1)}
+			b := NewBattleWith(tt.deck, defender, Rules{FirstMover: FirstAttacker})
+
+			var entry models.BattleLogEntry
+			var err error
+			for i, m := range tt.moves {
+				if i > 0 {
+					if _, err := b.Step(Move{}); err != nil {
+						t.Fatalf("defender's turn: %v", err)
+					}
+				}
+				if ids := b.Options().Abilities; i == 0 && tt.wantErr != ErrUnknownAbility && len(ids[m.AttackerID]) == 0 {
+					t.Errorf("options offer no ability for card %d", m.AttackerID)
+				}
+				entry, err = b.Step(m)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Step error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				// A refused move leaves the turn to be played.
+				if b.TurnSide() != "attacker" {
+					t.Errorf("turn passed to %s after a refused move", b.TurnSide())
+				}
+				return
+			}
+			tt.check(t, b, entry)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"errors"
+	"math/rand"
+
+	"imperium/models"
+)
+
+// Rules are the rules a battle is played by. Zero fields take their value
+// from StandardRules.
+type Rules = models.BattleRules
+
+// Who moves first.
+const (
+	FirstDefender = "defender"
+	FirstAttacker = "attacker"
+	FirstCoinFlip = "coin_flip"
+)
+
+// How a battle still going after the round cap is settled.
+const (
+	// TiebreakTotalHP: the side with more HP left wins.
+	TiebreakTotalHP = "total_hp"
+	// TiebreakCardsRemaining: the side with more cards left wins, then more HP.
+	TiebreakCardsRemaining = "cards_remaining"
+	// TiebreakSuddenDeath: the battle goes on for up to another MaxRounds
+	// rounds with every hit dealing 1 more damage than in the round before,
+	// then falls back to total HP.
+	TiebreakSuddenDeath = "sudden_death"
+)
+
+// StandardRules are the rules battles have always been played by.
+var StandardRules = Rules{
+	MaxRounds:       2000,
+	FirstMover:      FirstDefender,
+	Tiebreak:        TiebreakTotalHP,
+	RoundDurationMs: 800,
+}
+
+var (
+	ErrInvalidMaxRounds     = errors.New("max_rounds must be between 1 and 5000")
+	ErrInvalidFirstMover    = errors.New("first_mover must be defender, attacker or coin_flip")
+	ErrInvalidTiebreak      = errors.New("tiebreak must be total_hp, cards_remaining or sudden_death")
+	ErrInvalidRoundDuration = errors.New("round_duration_ms must be between 100 and 10000")
+)
+
+// CheckRules fills in the rules' zero fields from StandardRules and makes
+// sure the rest make sense.
+func CheckRules(r Rules) (Rules, error) {
+	r = withDefaults(r)
+	if r.MaxRounds < 1 || r.MaxRounds > 5000 {
+		return r, ErrInvalidMaxRounds
+	}
+	if r.FirstMover != FirstDefender && r.FirstMover != FirstAttacker && r.FirstMover != FirstCoinFlip {
+		return r, ErrInvalidFirstMover
+	}
+	if r.Tiebreak != TiebreakTotalHP && r.Tiebreak != TiebreakCardsRemaining && r.Tiebreak != TiebreakSuddenDeath {
+		return r, ErrInvalidTiebreak
+	}
+	if r.RoundDurationMs < 100 || r.RoundDurationMs > 10000 {
+		return r, ErrInvalidRoundDuration
+	}
+	return r, nil
+}
+
+func withDefaults(r Rules) Rules {
+	if r.MaxRounds == 0 {
+		r.MaxRounds = StandardRules.MaxRounds
+	}
+	if r.FirstMover == "" {
+		r.FirstMover = StandardRules.FirstMover
+	}
+	if r.Tiebreak == "" {
+		r.Tiebreak = StandardRules.Tiebreak
+	}
+	if r.RoundDurationMs == 0 {
+		r.RoundDurationMs = StandardRules.RoundDurationMs
+	}
+	return r
+}
+
+// resolveRules settles the rules for a battle about to start. Invalid values
+// fall back to the standard ones, and a coin flip without a seed gets a
+// random one so the flip is on record.
+func resolveRules(r Rules) Rules {
+	r = withDefaults(r)
+	if _, err := CheckRules(r); err != nil {
+		seed := r.Seed
+		r = StandardRules
+		r.Seed = seed
+	}
+	if r.FirstMover == FirstCoinFlip && r.Seed == 0 {
+		r.Seed = rand.Int63()
+	}
+	return r
+}
+
+// defenderFirst settles who moves first.
+func defenderFirst(r Rules) bool {
+	switch r.FirstMover {
+	case FirstAttacker:
+		return false
+	case FirstCoinFlip:
+		return rand.New(rand.NewSource(r.Seed)).Intn(2) == 0
+	}
+	return true
+}
+
+// FirstSide is the side that moves first in a battle played by resolved
+// rules, with any coin flip settled by their seed.
+func FirstSide(r Rules) string {
+	if defenderFirst(r) {
+		return FirstDefender
+	}
+	return FirstAttacker
+}
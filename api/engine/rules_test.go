@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"imperium/models"
+)
+
+func testCard(id int64, hp, attack int16, effects ...string) models.BattleCard {
+	if effects == nil {
+		effects = []string{}
+	}
+	return models.BattleCard{ID: id, CardID: "card", Name: "Card", CurrentHP: hp, MaxHP: hp, Attack: attack, Rarity: "common", Effects: effects}
+}
+
+func TestCheckRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      Rules
+		want    Rules
+		wantErr error
+	}{
+		{"zero is standard", Rules{}, StandardRules, nil},
+		{"fills in the rest", Rules{Tiebreak: TiebreakSuddenDeath}, Rules{MaxRounds: 2000, FirstMover: FirstDefender, Tiebreak: TiebreakSuddenDeath, RoundDurationMs: 800}, nil},
+		{"keeps the seed", Rules{FirstMover: FirstCoinFlip, Seed: 42}, Rules{MaxRounds: 2000, FirstMover: FirstCoinFlip, Tiebreak: TiebreakTotalHP, RoundDurationMs: 800, Seed: 42}, nil},
+		{"too many rounds", Rules{MaxRounds: 5001}, Rules{}, ErrInvalidMaxRounds},
+		{"negative rounds", Rules{MaxRounds: -1}, Rules{}, ErrInvalidMaxRounds},
+		{"unknown first mover", Rules{FirstMover: "both"}, Rules{}, ErrInvalidFirstMover},
+		{"unknown tiebreak", Rules{Tiebreak: "coin"}, Rules{}, ErrInvalidTiebreak},
+		{"rounds too short", Rules{RoundDurationMs: 50}, Rules{}, ErrInvalidRoundDuration},
+		{"rounds too long", Rules{RoundDurationMs: 10001}, Rules{}, ErrInvalidRoundDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CheckRules(tt.in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CheckRules error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("CheckRules = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRules(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Rules
+		want Rules
+	}{
+		{"zero is standard", Rules{}, StandardRules},
+		{"invalid falls back to standard", Rules{MaxRounds: 9999, Tiebreak: TiebreakSuddenDeath}, StandardRules},
+		{"invalid keeps the seed", Rules{Tiebreak: "coin", Seed: 5}, Rules{MaxRounds: 2000, FirstMover: FirstDefender, Tiebreak: TiebreakTotalHP, RoundDurationMs: 800, Seed: 5}},
+		{"seeded coin flip is kept", Rules{FirstMover: FirstCoinFlip, Seed: 9}, Rules{MaxRounds: 2000, FirstMover: FirstCoinFlip, Tiebreak: TiebreakTotalHP, RoundDurationMs: 800, Seed: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveRules(tt.in); got != tt.want {
+				t.Errorf("resolveRules = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unseeded coin flip gets a seed", func(t *testing.T) {
+		if got := resolveRules(Rules{FirstMover: FirstCoinFlip}); got.Seed == 0 {
+			t.Error("resolveRules left a coin flip without a seed")
+		}
+	})
+}
+
+func TestFirstSide(t *testing.T) {
+	tests := []struct {
+		rules Rules
+		want  string
+	}{
+		{StandardRules, FirstDefender},
+		{Rules{FirstMover: FirstAttacker}, FirstAttacker},
+		{Rules{FirstMover: FirstDefender}, FirstDefender},
+	}
+	for _, tt := range tests {
+		if got := FirstSide(tt.rules); got != tt.want {
+			t.Errorf("FirstSide(%+v) = %s, want %s", tt.rules, got, tt.want)
+		}
+	}
+
+	// A coin flip lands both ways over a few seeds, and the battle agrees
+	// with FirstSide every time.
+	seen := map[string]bool{}
+	for seed := int64(1); seed <= 20; seed++ {
+		rules := resolveRules(Rules{FirstMover: FirstCoinFlip, Seed: seed})
+		want := FirstSide(rules)
+		seen[want] = true
+		b := NewBattleWith([]models.BattleCard{testCard(1, 5, 1)}, []models.BattleCard{testCard(2, 5, 1)}, rules)
+		if got := b.TurnSide(); got != want {
+			t.Errorf("seed %d: battle starts with %s, FirstSide says %s", seed, got, want)
+		}
+	}
+	if !seen[FirstAttacker] || !seen[FirstDefender] {
+		t.Errorf("coin flip over 20 seeds only ever gave %v", seen)
+	}
+}
+
+func TestTiebreaks(t *testing.T) {
+	tests := []struct {
+		name     string
+		attacker []models.BattleCard
+		defender []models.BattleCard
+		rules    Rules
+		// winner and rounds are checked, as are the cards left on each side.
+		winner                     string
+		rounds                     int
+		attackerLeft, defenderLeft int
+	}{
+		{
+			name:     "total hp",
+			attacker: []models.BattleCard{testCard(1, 30, 1, "no_attack")},
+			defender: []models.BattleCard{testCard(2, 20, 1, "no_attack")},
+			rules:    Rules{MaxRounds: 4, Tiebreak: TiebreakTotalHP},
+			winner:   "attacker", rounds: 4, attackerLeft: 1, defenderLeft: 1,
+		},
+		{
+			name:     "total hp tie",
+			attacker: []models.BattleCard{testCard(1, 20, 1, "no_attack")},
+			defender: []models.BattleCard{testCard(2, 20, 1, "no_attack")},
+			rules:    Rules{MaxRounds: 4, Tiebreak: TiebreakTotalHP},
+			winner:   "tie", rounds: 4, attackerLeft: 1, defenderLeft: 1,
+		},
+		{
+			name:     "total hp past int16",
+			attacker: []models.BattleCard{testCard(1, 30000, 1, "no_attack"), testCard(2, 30000, 1, "no_attack")},
+			defender: []models.BattleCard{testCard(3, 30000, 1, "no_attack")},
+			rules:    Rules{MaxRounds: 4, Tiebreak: TiebreakTotalHP},
+			winner:   "attacker", rounds: 4, attackerLeft: 2, defenderLeft: 1,
+		},
+		{
+			name:     "cards remaining beats hp",
+			attacker: []models.BattleCard{testCard(1, 5, 1, "no_attack"), testCard(2, 5, 1, "no_attack")},
+			defender: []models.BattleCard{testCard(3, 50, 1, "no_attack")},
+			rules:    Rules{MaxRounds: 4, Tiebreak: TiebreakCardsRemaining},
+			winner:   "attacker", rounds: 4, attackerLeft: 2, defenderLeft: 1,
+		},
+		{
+			name:     "cards remaining level falls back to hp",
+			attacker: []models.BattleCard{testCard(1, 5, 1, "no_attack")},
+			defender: []models.BattleCard{testCard(2, 50, 1, "no_attack")},
+			rules:    Rules{MaxRounds: 4, Tiebreak: TiebreakCardsRemaining},
+			winner:   "defender", rounds: 4, attackerLeft: 1, defenderLeft: 1,
+		},
+		{
+			// Rounds 6 to 9 hit for 1 to 4. The defender moves in odd
+			// rounds, so its hits of 2 and 4 finish the attacker.
+			name:     "sudden death ends in a death",
+			attacker: []models.BattleCard{testCard(1, 3, 0)},
+			defender: []models.BattleCard{testCard(2, 100, 0)},
+			rules:    Rules{MaxRounds: 5, Tiebreak: TiebreakSuddenDeath},
+			winner:   "defender", rounds: 9, attackerLeft: 0, defenderLeft: 1,
+		},
+		{
+			// Rounds 6 to 10 hit for 1 to 5. The defender takes the
+			// attacker's 1+3+5 and deals 2+4, then total HP decides.
+			name:     "sudden death falls back to hp",
+			attacker: []models.BattleCard{testCard(1, 100, 0)},
+			defender: []models.BattleCard{testCard(2, 100, 0)},
+			rules:    Rules{MaxRounds: 5, Tiebreak: TiebreakSuddenDeath},
+			winner:   "attacker", rounds: 10, attackerLeft: 1, defenderLeft: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bl := RunBattleWith(tt.attacker, tt.defender, tt.rules)
+			if bl.Winner != tt.winner || bl.TotalRounds != tt.rounds ||
+				bl.AttackerRemaining != tt.attackerLeft || bl.DefenderRemaining != tt.defenderLeft {
+				t.Errorf("got winner %s after %d rounds with %d/%d cards left, want %s after %d with %d/%d",
+					bl.Winner, bl.TotalRounds, bl.AttackerRemaining, bl.DefenderRemaining,
+					tt.winner, tt.rounds, tt.attackerLeft, tt.defenderLeft)
+			}
+		})
+	}
+}
+
+func TestAttackSaturates(t *testing.T) {
+	active := []models.BattleCard{testCard(1, 10, math.MaxInt16)}
+	passive := []models.BattleCard{testCard(2, 10, 1)}
+	actions := attack(&active, &passive, 0, 0, "attacker", "defender", 5000)
+	if len(actions) == 0 || actions[0].Damage == nil {
+		t.Fatal("no attack logged")
+	}
+	if got := *actions[0].Damage; got != math.MaxInt16 {
+		t.Errorf("damage = %d, want %d", got, math.MaxInt16)
+	}
+	if len(passive) != 0 {
+		t.Error("target survived the hit")
+	}
+}
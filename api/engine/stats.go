@@ -0,0 +1,118 @@
+package engine
+
+import "imperium/models"
+
+// CardStat sums up how one card (by catalog id) did for one side of a battle.
+type CardStat struct {
+	CardID string
+	// Copies is how many of the card the side started with. Cards spawned
+	// mid-battle count towards damage and kills but not copies.
+	Copies      int
+	DamageDealt int
+	Kills       int
+}
+
+// CardStats attributes the damage and kills in a battle log to the catalog
+// cards that dealt them, per side ("attacker" / "defender"). The starting
+// decks are optional; without them the first round's snapshot stands in for
+// them, so a card that died in the first round is missed.
+// Attacks and deaths are matched to cards by side and id, so the log must
+// carry target_side (version 2 on).
+func CardStats(attackerDeck, defenderDeck []models.BattleCard, log models.BattleLog) map[string]map[string]*CardStat {
+	// Both decks usually number their cards from 1, so a card is only known
+	// by its side and id together.
+	type key struct {
+		side string
+		id   int64
+	}
+	cards := map[key]string{}
+	stats := map[string]map[string]*CardStat{
+		"attacker": {},
+		"defender": {},
+	}
+	stat := func(side, cardID string) *CardStat {
+		s, ok := stats[side][cardID]
+		if !ok {
+			s = &CardStat{CardID: cardID}
+			stats[side][cardID] = s
+		}
+		return s
+	}
+	credit := func(k key) (*CardStat, bool) {
+		cardID, ok := cards[k]
+		if !ok {
+			return nil, false
+		}
+		return stat(k.side, cardID), true
+	}
+
+	if attackerDeck == nil && defenderDeck == nil && len(log.Entries) > 0 {
+		attackerDeck = log.Entries[0].AttackerDeck
+		defenderDeck = log.Entries[0].DefenderDeck
+	}
+
+	for _, c := range attackerDeck {
+		cards[key{"attacker", c.ID}] = c.CardID
+		stat("attacker", c.CardID).Copies++
+	}
+	for _, c := range defenderDeck {
+		cards[key{"defender", c.ID}] = c.CardID
+		stat("defender", c.CardID).Copies++
+	}
+	for _, e := range log.Entries {
+		for _, c := range e.AttackerDeck {
+			if _, ok := cards[key{"attacker", c.ID}]; !ok {
+				cards[key{"attacker", c.ID}] = c.CardID
+			}
+		}
+		for _, c := range e.DefenderDeck {
+			if _, ok := cards[key{"defender", c.ID}]; !ok {
+				cards[key{"defender", c.ID}] = c.CardID
+			}
+		}
+	}
+
+	for _, e := range log.Entries {
+		// lastHit remembers who last damaged each card this round so deaths
+		// can be credited.
+		lastHit := map[key]key{}
+		for _, a := range e.Actions {
+			switch a.Type {
+			case "attack":
+				if a.AttackerID == nil || a.DefenderID == nil || a.Damage == nil || a.TargetSide == nil {
+					continue
+				}
+				target := key{*a.TargetSide, *a.DefenderID}
+				hitter := key{otherSide(*a.TargetSide), *a.AttackerID}
+				lastHit[target] = hitter
+				if s, ok := credit(hitter); ok {
+					s.DamageDealt += int(*a.Damage)
+				}
+			case "card_died":
+				if a.DiedCardID == nil || a.DiedSide == nil {
+					continue
+				}
+				killer, ok := lastHit[key{*a.DiedSide, *a.DiedCardID}]
+				if !ok {
+					continue
+				}
+				if s, ok := credit(killer); ok {
+					s.Kills++
+				}
+			case "spawn_card":
+				if a.SpawnedCard != nil && a.Side != nil {
+					cards[key{*a.Side, a.SpawnedCard.ID}] = a.SpawnedCard.CardID
+				}
+			}
+		}
+	}
+
+	return stats
+}
+
+func otherSide(side string) string {
+	if side == "attacker" {
+		return "defender"
+	}
+	return "attacker"
+}
@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"testing"
+
+	"imperium/models"
+)
+
+func TestCardStatsSharedIDs(t *testing.T) {
+	// PvP decks both number their cards from 1.
+	knife := testCard(1, 10, 6)
+	knife.CardID = "knife"
+	club := testCard(2, 10, 1)
+	club.CardID = "club"
+	wall := testCard(1, 6, 1)
+	wall.CardID = "wall"
+	post := testCard(2, 6, 1)
+	post.CardID = "post"
+	attacker := []models.BattleCard{knife, club}
+	defender := []models.BattleCard{wall, post}
+
+	bl := RunBattleWith(attacker, defender, Rules{FirstMover: FirstAttacker})
+	stats := CardStats(attacker, defender, bl)
+
+	// Recount from the log, telling the sides apart by target_side.
+	wantDamage := map[string]int{}
+	for _, e := range bl.Entries {
+		for _, a := range e.Actions {
+			if a.Type != "attack" {
+				continue
+			}
+			side := otherSide(*a.TargetSide)
+			deck := attacker
+			if side == "defender" {
+				deck = defender
+			}
+			for _, c := range deck {
+				if c.ID == *a.AttackerID {
+					wantDamage[side+"/"+c.CardID] += int(*a.Damage)
+				}
+			}
+		}
+	}
+	if len(wantDamage) == 0 {
+		t.Fatal("no damage dealt")
+	}
+	for side, cards := range stats {
+		for cardID, s := range cards {
+			if want := wantDamage[side+"/"+cardID]; s.DamageDealt != want {
+				t.Errorf("%s %s dealt %d damage, want %d", side, cardID, s.DamageDealt, want)
+			}
+			if s.Copies != 1 {
+				t.Errorf("%s %s has %d copies, want 1", side, cardID, s.Copies)
+			}
+		}
+	}
+
+	// The attacker's knife moves first and kills the wall in one hit.
+	if got := stats["attacker"]["knife"].Kills; got < 1 {
+		t.Errorf("knife has %d kills, want at least 1", got)
+	}
+	if got := stats["defender"]["wall"].Kills; got != 0 {
+		t.Errorf("wall has %d kills, want 0", got)
+	}
+}
@@ -0,0 +1,89 @@
+// Package events is an in-process bus for domain events ("case opened",
+// "battle finished", ...). Code that makes something happen publishes an
+// event once it is committed; best-effort side effects (notifications, ...)
+// subscribe at startup. Anything that must not miss an event reacts to the
+// outbox instead (handlers/events.go), as the bus forgets queued events on
+// restart.
+//
+// Delivery is asynchronous. Every subscriber has its own queue and goroutine,
+// so a slow or failing subscriber never holds up the publisher or the other
+// subscribers. Events are delivered to a subscriber in the order they were
+// published; a subscriber whose queue is full misses the event, which is
+// logged.
+package events
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Event is something that happened in the game.
+type Event interface {
+	EventName() string
+}
+
+// queueSize is how many events a subscriber may fall behind by.
+const queueSize = 1024
+
+type subscriber struct {
+	name   string
+	handle func(Event) error
+	queue  chan Event
+}
+
+var (
+	mu          sync.RWMutex
+	subscribers []*subscriber
+)
+
+// Subscribe registers fn to be called with every published event of type T.
+// name identifies the subscriber in logs. Errors and panics from fn are
+// logged and otherwise ignored.
+func Subscribe[T Event](name string, fn func(T) error) {
+	s := &subscriber{
+		name: name,
+		handle: func(e Event) error {
+			if te, ok := e.(T); ok {
+				return fn(te)
+			}
+			return nil
+		},
+		queue: make(chan Event, queueSize),
+	}
+	go s.run()
+
+	mu.Lock()
+	subscribers = append(subscribers, s)
+	mu.Unlock()
+}
+
+// Publish hands an event to every subscriber without waiting for them.
+func Publish(e Event) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, s := range subscribers {
+		select {
+		case s.queue <- e:
+		default:
+			log.Printf("events: %s queue full, dropped %s", s.name, e.EventName())
+		}
+	}
+}
+
+func (s *subscriber) run() {
+	for e := range s.queue {
+		if err := s.deliver(e); err != nil {
+			log.Printf("events: %s handling %s: %v", s.name, e.EventName(), err)
+		}
+	}
+}
+
+func (s *subscriber) deliver(e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handle(e)
+}
@@ -0,0 +1,69 @@
+package events
+
+import "imperium/models"
+
+// CaseOpened is published when a player opens a loot case.
+type CaseOpened struct {
+	UserID int64 `json:"user_id"`
+}
+
+func (CaseOpened) EventName() string { return "case_opened" }
+
+// CardGranted is published whenever a player is given a card, whatever the
+// source (cases, dungeon chests, rewards, ...).
+type CardGranted struct {
+	UserID  int64  `json:"user_id"`
+	CardID  string `json:"card_id"`
+	Rarity  string `json:"rarity"`
+	Quality int    `json:"quality"`
+}
+
+func (CardGranted) EventName() string { return "card_granted" }
+
+// ItemGranted is published whenever a player is given items or coins.
+type ItemGranted struct {
+	UserID   int64  `json:"user_id"`
+	ItemType string `json:"item_type"`
+	Quantity int    `json:"quantity"`
+}
+
+func (ItemGranted) EventName() string { return "item_granted" }
+
+// BattleFinished is published for every saved battle. AttackerID and
+// DefenderID are negative for bots. The decks and log are only passed to
+// in-process subscribers; they are left out of the outbox.
+type BattleFinished struct {
+	BattleID     string              `json:"battle_id"`
+	Mode         string              `json:"mode"`
+	AttackerID   int64               `json:"attacker_id"`
+	DefenderID   int64               `json:"defender_id"`
+	WinnerID     *int64              `json:"winner_id"`
+	Winner       string              `json:"winner"`
+	Rounds       int                 `json:"rounds"`
+	AttackerDeck []models.BattleCard `json:"-"`
+	DefenderDeck []models.BattleCard `json:"-"`
+	Log          models.BattleLog    `json:"-"`
+}
+
+func (BattleFinished) EventName() string { return "battle_finished" }
+
+// DungeonRunStarted is published when a player spends a key on a run.
+type DungeonRunStarted struct {
+	UserID  int64  `json:"user_id"`
+	RunID   string `json:"run_id"`
+	Dungeon string `json:"dungeon"`
+}
+
+func (DungeonRunStarted) EventName() string { return "dungeon_run_started" }
+
+// DungeonFloorCleared is published for every dungeon floor won. RunCleared
+// is set on the last floor.
+type DungeonFloorCleared struct {
+	UserID     int64  `json:"user_id"`
+	RunID      string `json:"run_id"`
+	Dungeon    string `json:"dungeon"`
+	Floor      int    `json:"floor"`
+	RunCleared bool   `json:"run_cleared"`
+}
+
+func (DungeonFloorCleared) EventName() string { return "dungeon_floor_cleared" }
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imperium/db"
+	"imperium/events"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// achievementDef is a permanent achievement. It is either a collection
+// achievement, unlocked by what a player owns, or a battle achievement,
+// unlocked by winning a battle that matches a condition.
+type achievementDef struct {
+	ID          string
+	Name        string
+	Description string
+	Reward      *models.Reward
+
+	// CollectionSQL selects when the player ($1) met the goal, or NULL if
+	// they haven't.
+	CollectionSQL string
+	// BattleSQL is a condition on a won battle b, from the winner's side.
+	BattleSQL string
+}
+
+// collectibleCards are the cards that can actually be owned: fuel and cards
+// that only ever appear as spawns are left out.
+const collectibleCards = `NOT cd.is_fuel AND cd.id NOT IN (SELECT spawns FROM card_definitions WHERE spawns IS NOT NULL)`
+
+var achievements = []achievementDef{
+	{
+		ID: "first_legendary", Name: "Living Legend", Description: "Own a legendary card",
+		Reward: &models.Reward{Coins: 50},
+		CollectionSQL: `SELECT MIN(uc.created_at) FROM user_cards uc
+			JOIN card_definitions cd ON cd.id = uc.card_id
+			WHERE uc.user_id = $1 AND cd.rarity = 'legendary'`,
+	},
+	{
+		ID: "all_commons", Name: "Street Collector", Description: "Collect every common card",
+		Reward: &models.Reward{Item: "silver_key"},
+		CollectionSQL: `SELECT CASE WHEN COUNT(*) = COUNT(first) THEN MAX(first) END FROM (
+			SELECT (SELECT MIN(created_at) FROM user_cards WHERE user_id = $1 AND card_id = cd.id) AS first
+			FROM card_definitions cd WHERE cd.rarity = 'common' AND ` + collectibleCards + `) c`,
+	},
+	{
+		ID: "marathon", Name: "Marathon", Description: "Win a battle lasting 100 rounds or more",
+		Reward:    &models.Reward{Coins: 30},
+		BattleSQL: `b.rounds >= 100`,
+	},
+	{
+		ID: "last_one_standing", Name: "Last One Standing", Description: "Win a battle with a single card left",
+		BattleSQL: `CASE b.winner_side WHEN 'attacker' THEN b.attacker_remaining ELSE b.defender_remaining END = 1`,
+	},
+}
+
+// achievementBattles are the battles achievements are counted from; friendly
+// battles earn nothing.
+const achievementBattles = `b.winner_id > 0 AND b.mode <> 'friendly'`
+
+// achievementUnlocked pays out a newly unlocked achievement's reward and
+// tells the player about it.
+func achievementUnlocked(q db.Querier, userID int64, a achievementDef) error {
+	if a.Reward != nil {
+		if _, err := giveReward(q, userID, *a.Reward); err != nil {
+			return err
+		}
+	}
+	return notify(q, userID, "achievement_unlocked", map[string]interface{}{
+		"achievement_id": a.ID,
+		"name":           a.Name,
+	})
+}
+
+// reactAchievements checks for new achievements as cards are handed out and
+// battles are won. Each check runs in its own transaction so an unlock and
+// its reward go together.
+func reactAchievements() {
+	react("achievements:collection", func(tx *db.Tx, e events.CardGranted) error {
+		return checkCollectionAchievements(tx, e.UserID)
+	})
+	react("achievements:battle", func(tx *db.Tx, e events.BattleFinished) error {
+		if e.WinnerID == nil {
+			return nil
+		}
+		return checkBattleAchievements(tx, e.BattleID)
+	})
+}
+
+// checkCollectionAchievements unlocks the collection achievements a player
+// now qualifies for.
+func checkCollectionAchievements(q db.Querier, userID int64) error {
+	for _, a := range achievements {
+		if a.CollectionSQL == "" {
+			continue
+		}
+		tag, err := q.Exec(context.Background(),
+			`INSERT INTO user_achievements (user_id, achievement_id, unlocked_at)
+			 SELECT $1, $2, t.at FROM (`+a.CollectionSQL+`) AS t(at) WHERE t.at IS NOT NULL
+			 ON CONFLICT (user_id, achievement_id) DO NOTHING`,
+			userID, a.ID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() > 0 {
+			if err := achievementUnlocked(q, userID, a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkBattleAchievements unlocks the battle achievements a saved battle
+// earns its winner.
+func checkBattleAchievements(q db.Querier, battleID string) error {
+	for _, a := range achievements {
+		if a.BattleSQL == "" {
+			continue
+		}
+		var userID int64
+		err := q.QueryRow(context.Background(),
+			`INSERT INTO user_achievements (user_id, achievement_id, unlocked_at, battle_id)
+			 SELECT b.winner_id, $2, b.created_at, b.id FROM battles b
+			 WHERE b.id = $1 AND `+achievementBattles+` AND (`+a.BattleSQL+`)
+			 ON CONFLICT (user_id, achievement_id) DO NOTHING
+			 RETURNING user_id`,
+			battleID, a.ID).Scan(&userID)
+		if err == nil {
+			err = achievementUnlocked(q, userID, a)
+		}
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUserAchievements lists every achievement, with when the player unlocked
+// the ones they have.
+func GetUserAchievements(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT achievement_id, unlocked_at, battle_id::TEXT FROM user_achievements WHERE user_id = $1`, userID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type unlock struct {
+		at       time.Time
+		battleID *string
+	}
+	unlocked := map[string]unlock{}
+	for rows.Next() {
+		var id string
+		var u unlock
+		if err := rows.Scan(&id, &u.at, &u.battleID); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		unlocked[id] = u
+	}
+
+	list := make([]models.Achievement, 0, len(achievements))
+	for _, a := range achievements {
+		ach := models.Achievement{
+			ID:          a.ID,
+			Name:        a.Name,
+			Description: a.Description,
+			Reward:      a.Reward,
+		}
+		if u, ok := unlocked[a.ID]; ok {
+			ach.Unlocked = true
+			ach.UnlockedAt = &u.at
+			ach.BattleID = u.battleID
+		}
+		list = append(list, ach)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"unlocked":     len(unlocked),
+		"total":        len(achievements),
+		"achievements": list,
+	})
+}
+
+// BackfillAchievements unlocks achievements for existing players from what
+// they own and from the battles already on record, dated to when each was
+// first earned. Rewards are paid as for live unlocks. It is safe to run again.
+func BackfillAchievements(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT id FROM users`)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	var userIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	var before int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM user_achievements`).Scan(&before); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, userID := range userIDs {
+		if err := checkCollectionAchievements(tx, userID); err != nil {
+			http.Error(w, `{"error":"collection achievements error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, a := range achievements {
+		if a.BattleSQL == "" {
+			continue
+		}
+		// Each player's earliest qualifying win unlocks it.
+		rows, err := tx.Query(ctx,
+			`INSERT INTO user_achievements (user_id, achievement_id, unlocked_at, battle_id)
+			 SELECT DISTINCT ON (b.winner_id) b.winner_id, $1, b.created_at, b.id FROM battles b
+			 WHERE `+achievementBattles+` AND (`+a.BattleSQL+`)
+			 ORDER BY b.winner_id, b.created_at
+			 ON CONFLICT (user_id, achievement_id) DO NOTHING
+			 RETURNING user_id`, a.ID)
+		if err != nil {
+			http.Error(w, `{"error":"battle achievements error"}`, http.StatusInternalServerError)
+			return
+		}
+		var winners []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+				return
+			}
+			winners = append(winners, id)
+		}
+		rows.Close()
+		for _, userID := range winners {
+			if err := achievementUnlocked(tx, userID, a); err != nil {
+				http.Error(w, `{"error":"reward error"}`, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	var after int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM user_achievements`).Scan(&after); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"users":    len(userIDs),
+		"unlocked": after - before,
+	})
+}
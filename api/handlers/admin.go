@@ -0,0 +1,19 @@
+package handlers
+
+import "net/http"
+
+// AdminToken guards admin-only endpoints. It is set from config at startup;
+// when empty, admin endpoints are disabled.
+var AdminToken string
+
+// AdminOnly rejects requests that don't carry the admin token in the
+// X-Admin-Token header.
+func AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AdminToken == "" || r.Header.Get("X-Admin-Token") != AdminToken {
+			http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
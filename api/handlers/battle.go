@@ -3,18 +3,29 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"log"
+	"math/rand"
 	"net/http"
 
+	"imperium/battlelog"
 	"imperium/db"
 	"imperium/engine"
+	"imperium/events"
 	"imperium/models"
 
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 )
 
 type PvERequest struct {
 	UserID  int64  `json:"user_id"`
 	Dungeon string `json:"dungeon"`
+	// Seed picks the generated encounter; a random one is used when unset.
+	// ReplayBattleID refights the encounter of one of the player's earlier
+	// PvE battles. Either makes the battle practice: it isn't stored and pays
+	// nothing, so players can't shop for easy encounters.
+	Seed           *int64 `json:"seed"`
+	ReplayBattleID string `json:"replay_battle_id"`
 }
 
 type PvPRequest struct {
@@ -22,6 +33,11 @@ type PvPRequest struct {
 	DefenderID int64 `json:"defender_id"`
 }
 
+// pveOpponentID is stored as defender_id for battles against bots.
+const pveOpponentID int64 = -1
+
+// botDecks are the fixed minions on dungeon run floors. Standalone PvE
+// battles generate their opponents instead (see pve_generator.go).
 var botDecks = map[string][]string{
 	"easy":   {"thug", "thug", "goon", "enforcer", "cobblestone"},
 	"medium": {"enforcer", "hitman", "spider-man", "capo", "don"},
@@ -35,13 +51,38 @@ func BattlePvE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	botDeck, ok := botDecks[req.Dungeon]
-	if !ok {
+	// A replay takes the dungeon and seed from the earlier encounter. The
+	// budget is worked out again from the deck the player has now.
+	seed := rand.Int63()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	if req.ReplayBattleID != "" {
+		var encRaw json.RawMessage
+		err := db.Pool.QueryRow(context.Background(),
+			`SELECT encounter FROM battles
+			 WHERE id = $1 AND attacker_id = $2 AND mode = 'pve' AND encounter IS NOT NULL`,
+			req.ReplayBattleID, req.UserID).Scan(&encRaw)
+		if err != nil {
+			http.Error(w, `{"error":"no generated encounter for that battle"}`, http.StatusNotFound)
+			return
+		}
+		var old models.Encounter
+		if err := json.Unmarshal(encRaw, &old); err != nil {
+			http.Error(w, `{"error":"bad encounter"}`, http.StatusInternalServerError)
+			return
+		}
+		req.Dungeon = old.Dungeon
+		seed = old.Seed
+	}
+	practice := req.Seed != nil || req.ReplayBattleID != ""
+
+	if _, ok := pveBudgetPct[req.Dungeon]; !ok {
 		http.Error(w, `{"error":"invalid dungeon"}`, http.StatusBadRequest)
 		return
 	}
 
-	attackerDeck, err := loadUserDeck(req.UserID)
+	attackerDeck, err := loadActiveDeck(req.UserID, "dungeon:"+req.Dungeon)
 	if err != nil {
 		http.Error(w, `{"error":"load deck error: `+err.Error()+`"}`, http.StatusInternalServerError)
 		return
@@ -51,35 +92,62 @@ func BattlePvE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defenderDeck, err := buildBotDeck(botDeck)
+	enc := pveEncounter(req.Dungeon, attackerDeck, seed)
+
+	catalog, err := LoadBotCatalog()
 	if err != nil {
-		http.Error(w, `{"error":"build bot deck error: `+err.Error()+`"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error":"load catalog error"}`, http.StatusInternalServerError)
 		return
 	}
+	defenderDeck := generateBotDeck(enc, catalog)
 
-	battleLog := engine.RunBattle(attackerDeck, defenderDeck)
+	battleLog := engine.RunBattleWith(attackerDeck, defenderDeck, battleRules("pve"))
 
-	var winnerID *int64
-	if battleLog.Winner == "attacker" {
-		winnerID = &req.UserID
+	if practice {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"practice":   true,
+			"winner":     battleLog.Winner,
+			"rounds":     battleLog.TotalRounds,
+			"encounter":  enc,
+			"battle_log": battleLog,
+		})
+		return
 	}
 
-	var pveID int64 = -1
-	var battleID string
-	logJSON, _ := json.Marshal(battleLog)
-	err = db.Pool.QueryRow(context.Background(),
-		`INSERT INTO battles (attacker_id, defender_id, winner_id, battle_log)
-		 VALUES ($1, $2, $3, $4) RETURNING id`,
-		req.UserID, pveID, winnerID, logJSON).Scan(&battleID)
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	battleID, winnerID, err := saveBattle(tx, "pve", req.UserID, pveOpponentID, attackerDeck, defenderDeck, battleLog)
 	if err != nil {
 		http.Error(w, `{"error":"save battle error: `+err.Error()+`"}`, http.StatusInternalServerError)
 		return
 	}
+	if err := setBattleEncounter(tx, battleID, enc); err != nil {
+		http.Error(w, `{"error":"save encounter error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if winnerID != nil {
+		if err := bumpSeasonStat(tx, req.UserID, "pve_wins"); err != nil {
+			http.Error(w, `{"error":"stats update error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"battle_id":  battleID,
 		"winner":     battleLog.Winner,
 		"rounds":     battleLog.TotalRounds,
+		"encounter":  enc,
 		"battle_log": battleLog,
 	})
 }
@@ -91,58 +159,97 @@ func BattlePvP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.AttackerID == req.DefenderID {
-		http.Error(w, `{"error":"cannot fight yourself"}`, http.StatusBadRequest)
+	result, err := runPvP(req.AttackerID, req.DefenderID)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	attackerDeck, err := loadUserDeck(req.AttackerID)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// runPvP fights the attacker's deck against the defender's deck, stores the
+// battle and applies the rating change. It backs both the direct PvP endpoint
+// and matchmaking.
+func runPvP(attackerID, defenderID int64) (map[string]interface{}, error) {
+	if attackerID == defenderID {
+		return nil, &apiError{http.StatusBadRequest, "cannot fight yourself"}
+	}
+
+	attackerDeck, defenderDeck, err := loadPvPDecks(attackerID, defenderID)
 	if err != nil {
-		http.Error(w, `{"error":"load attacker deck: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	battleLog := engine.RunBattleWith(attackerDeck, defenderDeck, battleRules("pvp"))
+	return recordPvP(attackerID, defenderID, attackerDeck, defenderDeck, battleLog)
+}
+
+// loadPvPDecks loads the attacker's attack deck and the defender's defense
+// deck, refusing empty ones.
+func loadPvPDecks(attackerID, defenderID int64) ([]models.BattleCard, []models.BattleCard, error) {
+	attackerDeck, err := loadActiveDeck(attackerID, "attack")
+	if err != nil {
+		return nil, nil, &apiError{http.StatusInternalServerError, "load attacker deck: " + err.Error()}
 	}
 	if len(attackerDeck) == 0 {
-		http.Error(w, `{"error":"attacker deck is empty"}`, http.StatusBadRequest)
-		return
+		return nil, nil, &apiError{http.StatusBadRequest, "attacker deck is empty"}
 	}
 
-	defenderDeck, err := loadUserDeck(req.DefenderID)
+	defenderDeck, err := loadActiveDeck(defenderID, "defense")
 	if err != nil {
-		http.Error(w, `{"error":"load defender deck: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
+		return nil, nil, &apiError{http.StatusInternalServerError, "load defender deck: " + err.Error()}
 	}
 	if len(defenderDeck) == 0 {
-		http.Error(w, `{"error":"defender deck is empty"}`, http.StatusBadRequest)
-		return
+		return nil, nil, &apiError{http.StatusBadRequest, "defender deck is empty"}
 	}
+	return attackerDeck, defenderDeck, nil
+}
 
-	battleLog := engine.RunBattle(attackerDeck, defenderDeck)
+// recordPvP stores a fought PvP battle and applies the rating change and
+// season stats.
+func recordPvP(attackerID, defenderID int64, attackerDeck, defenderDeck []models.BattleCard, battleLog models.BattleLog) (map[string]interface{}, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "tx error"}
+	}
+	defer tx.Rollback(context.Background())
 
-	var winnerID *int64
-	switch battleLog.Winner {
-	case "attacker":
-		winnerID = &req.AttackerID
-	case "defender":
-		winnerID = &req.DefenderID
+	battleID, winnerID, err := saveBattle(tx, "pvp", attackerID, defenderID, attackerDeck, defenderDeck, battleLog)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "save battle error"}
 	}
 
-	var battleID string
-	logJSON, _ := json.Marshal(battleLog)
-	err = db.Pool.QueryRow(context.Background(),
-		`INSERT INTO battles (attacker_id, defender_id, winner_id, battle_log)
-		 VALUES ($1, $2, $3, $4) RETURNING id`,
-		req.AttackerID, req.DefenderID, winnerID, logJSON).Scan(&battleID)
+	attackerRating, defenderRating, err := applyRatingChange(tx, attackerID, defenderID, battleLog.Winner)
 	if err != nil {
-		http.Error(w, `{"error":"save battle error"}`, http.StatusInternalServerError)
-		return
+		return nil, &apiError{http.StatusInternalServerError, "rating update error"}
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"battle_id":  battleID,
-		"winner":     battleLog.Winner,
-		"rounds":     battleLog.TotalRounds,
-		"battle_log": battleLog,
-	})
+	for _, userID := range []int64{attackerID, defenderID} {
+		if err := bumpSeasonStat(tx, userID, "pvp_battles"); err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "stats update error"}
+		}
+	}
+	if winnerID != nil {
+		if err := bumpSeasonStat(tx, *winnerID, "pvp_wins"); err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "stats update error"}
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "commit error"}
+	}
+
+	return map[string]interface{}{
+		"battle_id":       battleID,
+		"attacker_id":     attackerID,
+		"defender_id":     defenderID,
+		"winner":          battleLog.Winner,
+		"rounds":          battleLog.TotalRounds,
+		"attacker_rating": attackerRating,
+		"defender_rating": defenderRating,
+		"battle_log":      battleLog,
+	}, nil
 }
 
 func GetBattle(w http.ResponseWriter, r *http.Request) {
@@ -151,31 +258,166 @@ func GetBattle(w http.ResponseWriter, r *http.Request) {
 	var battle models.Battle
 	var logRaw json.RawMessage
 	err := db.Pool.QueryRow(context.Background(),
-		`SELECT id, attacker_id, defender_id, winner_id, battle_log, created_at
+		`SELECT id, attacker_id, defender_id, winner_id, battle_log, encounter, created_at
 		 FROM battles WHERE id = $1`, battleID).Scan(
-		&battle.ID, &battle.AttackerID, &battle.DefenderID, &battle.WinnerID, &logRaw, &battle.CreatedAt)
+		&battle.ID, &battle.AttackerID, &battle.DefenderID, &battle.WinnerID, &logRaw, &battle.Encounter, &battle.CreatedAt)
 	if err != nil {
 		http.Error(w, `{"error":"battle not found"}`, http.StatusNotFound)
 		return
 	}
 
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = battlelog.FormatFull
+	}
+	if format != battlelog.FormatFull && format != battlelog.FormatCompact {
+		http.Error(w, `{"error":"format must be full or compact"}`, http.StatusBadRequest)
+		return
+	}
+
+	if logRaw != nil && format == battlelog.FormatCompact {
+		compact, err := battlelog.DecodeCompact(logRaw)
+		if err != nil {
+			log.Printf("battle %s: read log: %v", battleID, err)
+			http.Error(w, `{"error":"battle log could not be read"}`, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			models.Battle
+			BattleLog *battlelog.Compact `json:"battle_log"`
+		}{battle, &compact})
+		return
+	}
+
 	if logRaw != nil {
-		var bl models.BattleLog
-		json.Unmarshal(logRaw, &bl)
+		bl, err := battlelog.Decode(logRaw)
+		if err != nil {
+			log.Printf("battle %s: read log: %v", battleID, err)
+			http.Error(w, `{"error":"battle log could not be read"}`, http.StatusInternalServerError)
+			return
+		}
 		battle.BattleLog = &bl
 	}
 
 	writeJSON(w, http.StatusOK, battle)
 }
 
-func loadUserDeck(userID int64) ([]models.BattleCard, error) {
+// modeRules are the battle rules of modes that don't play by the standard
+// ones. Friendly battles are only sparring, so the first move goes to a coin
+// flip and long stalemates are settled by sudden death.
+var modeRules = map[string]engine.Rules{
+	"friendly": {FirstMover: engine.FirstCoinFlip, Tiebreak: engine.TiebreakSuddenDeath},
+}
+
+// battleRules returns the rules battles of a mode are played by.
+func battleRules(mode string) engine.Rules {
+	if rules, ok := modeRules[mode]; ok {
+		return rules
+	}
+	return engine.StandardRules
+}
+
+// saveBattle stores a finished battle, with its log in the compact format,
+// together with its summary columns and per-card stats. The decks are the
+// ones the battle started with. Only real players (positive ids) can be
+// winners or get card stats.
+func saveBattle(q db.Querier, mode string, attackerID, defenderID int64, attackerDeck, defenderDeck []models.BattleCard, battleLog models.BattleLog) (string, *int64, error) {
+	var winnerID *int64
+	switch battleLog.Winner {
+	case "attacker":
+		winnerID = &attackerID
+	case "defender":
+		if defenderID > 0 {
+			winnerID = &defenderID
+		}
+	}
+
+	var battleID string
+	logJSON, _ := json.Marshal(battlelog.Compress(battleLog, attackerDeck, defenderDeck))
+	rulesJSON, _ := json.Marshal(battleLog.Rules)
+	err := q.QueryRow(context.Background(),
+		`INSERT INTO battles (attacker_id, defender_id, winner_id, battle_log, rules,
+		                      mode, winner_side, rounds, attacker_remaining, defender_remaining, stats_indexed)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, TRUE) RETURNING id`,
+		attackerID, defenderID, winnerID, logJSON, rulesJSON,
+		mode, battleLog.Winner, battleLog.TotalRounds, battleLog.AttackerRemaining, battleLog.DefenderRemaining).Scan(&battleID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stats := engine.CardStats(attackerDeck, defenderDeck, battleLog)
+	if err := saveCardStats(q, battleID, attackerID, defenderID, stats); err != nil {
+		return "", nil, err
+	}
+
+	err = emit(q, events.BattleFinished{
+		BattleID:     battleID,
+		Mode:         mode,
+		AttackerID:   attackerID,
+		DefenderID:   defenderID,
+		WinnerID:     winnerID,
+		Winner:       battleLog.Winner,
+		Rounds:       battleLog.TotalRounds,
+		AttackerDeck: attackerDeck,
+		DefenderDeck: defenderDeck,
+		Log:          battleLog,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return battleID, winnerID, nil
+}
+
+// setBattleEncounter records the generator input behind a PvE battle.
+func setBattleEncounter(q db.Querier, battleID string, enc models.Encounter) error {
+	encJSON, _ := json.Marshal(enc)
+	_, err := q.Exec(context.Background(),
+		`UPDATE battles SET seed = $2, encounter = $3 WHERE id = $1`, battleID, enc.Seed, encJSON)
+	return err
+}
+
+func saveCardStats(q db.Querier, battleID string, attackerID, defenderID int64, stats map[string]map[string]*engine.CardStat) error {
+	owners := map[string]int64{"attacker": attackerID, "defender": defenderID}
+	for side, cards := range stats {
+		userID := owners[side]
+		if userID <= 0 {
+			continue
+		}
+		for _, cs := range cards {
+			_, err := q.Exec(context.Background(),
+				`INSERT INTO battle_card_stats (battle_id, user_id, card_id, copies, damage_dealt, kills)
+				 VALUES ($1, $2, $3, $4, $5, $6)
+				 ON CONFLICT (battle_id, user_id, card_id) DO NOTHING`,
+				battleID, userID, cs.CardID, cs.Copies, cs.DamageDealt, cs.Kills)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadActiveDeck loads the deck a user has set for purpose (see activeDeckID).
+// A user without any deck gets an empty deck.
+func loadActiveDeck(userID int64, purpose string) ([]models.BattleCard, error) {
+	deckID, err := activeDeckID(userID, purpose)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadDeck(deckID)
+}
+
+func loadDeck(deckID string) ([]models.BattleCard, error) {
 	rows, err := db.Pool.Query(context.Background(),
 		`SELECT uc.id, uc.card_id, cd.name, cd.base_hp, cd.base_damage, cd.rarity, cd.effects, cd.spawns
-		 FROM user_deck ud
-		 JOIN user_cards uc ON uc.id = ud.user_card_id
+		 FROM deck_cards dc
+		 JOIN user_cards uc ON uc.id = dc.user_card_id
 		 JOIN card_definitions cd ON cd.id = uc.card_id
-		 WHERE ud.user_id = $1
-		 ORDER BY ud.slot`, userID)
+		 WHERE dc.deck_id = $1
+		 ORDER BY dc.slot`, deckID)
 	if err != nil {
 		return nil, err
 	}
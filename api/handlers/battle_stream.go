@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"imperium/battlelog"
+	"imperium/db"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// battleStream is a battle being played back to spectators. Everyone
+// watching the same battle shares one timeline: entry i goes out at
+// start + offsets[i], so friends see the same round at the same time.
+type battleStream struct {
+	log     models.BattleLog
+	start   time.Time
+	offsets []time.Duration
+	end     time.Time
+	viewers int
+}
+
+// battleStreamGrace is how long a stream outlives its last viewer, so a
+// viewer who drops and reconnects resumes on the same timeline.
+const battleStreamGrace = 30 * time.Second
+
+var (
+	battleStreamsMu sync.Mutex
+	battleStreams   = map[string]*battleStream{}
+)
+
+// newBattleStream lays the log out on a timeline. A battle still "in
+// progress" (created less than its total duration ago) plays from when it
+// was fought; older battles play from now, entry from going out first.
+func newBattleStream(bl models.BattleLog, createdAt time.Time, from int) *battleStream {
+	s := &battleStream{log: bl, offsets: make([]time.Duration, len(bl.Entries))}
+	var total time.Duration
+	for i, e := range bl.Entries {
+		s.offsets[i] = total
+		total += time.Duration(e.DurationMs) * time.Millisecond
+	}
+	s.start = createdAt
+	if time.Now().After(createdAt.Add(total)) {
+		s.start = time.Now()
+		if from < len(s.offsets) {
+			s.start = s.start.Add(-s.offsets[from])
+		}
+	}
+	s.end = s.start.Add(total)
+	return s
+}
+
+// joinBattleStream returns the shared stream for a battle, loading it when
+// nobody is watching yet; from is the first entry the viewer wants. Call
+// leaveBattleStream when done.
+func joinBattleStream(battleID string, from int) (*battleStream, error) {
+	battleStreamsMu.Lock()
+	if s, ok := battleStreams[battleID]; ok {
+		s.viewers++
+		battleStreamsMu.Unlock()
+		return s, nil
+	}
+	battleStreamsMu.Unlock()
+
+	var logRaw json.RawMessage
+	var createdAt time.Time
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT battle_log, created_at FROM battles WHERE id = $1`, battleID).Scan(&logRaw, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	bl, err := battlelog.Decode(logRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	battleStreamsMu.Lock()
+	defer battleStreamsMu.Unlock()
+	// Someone else may have loaded it in the meantime.
+	s, ok := battleStreams[battleID]
+	if !ok {
+		s = newBattleStream(bl, createdAt, from)
+		battleStreams[battleID] = s
+	}
+	s.viewers++
+	return s, nil
+}
+
+func leaveBattleStream(battleID string) {
+	battleStreamsMu.Lock()
+	defer battleStreamsMu.Unlock()
+	if s, ok := battleStreams[battleID]; ok {
+		s.viewers--
+		if s.viewers <= 0 {
+			time.AfterFunc(battleStreamGrace, func() {
+				battleStreamsMu.Lock()
+				defer battleStreamsMu.Unlock()
+				if battleStreams[battleID] == s && s.viewers <= 0 {
+					delete(battleStreams, battleID)
+				}
+			})
+		}
+	}
+}
+
+// writeSSE writes one Server-Sent Event. id is left out when negative.
+func writeSSE(w http.ResponseWriter, id int, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id >= 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+// sleepUntil waits until t, returning false if the request is cancelled first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// StreamBattle plays a battle's log as Server-Sent Events, one "entry" event
+// per log entry paced by its duration, then an "end" event with the result.
+// Entry events carry their index as the event id, so a client reconnecting
+// with Last-Event-ID (or ?last_event_id=) picks up after it. Entries the
+// shared timeline has already passed are sent straight away; a stream
+// nobody has watched for a while restarts paced from the resume point.
+func StreamBattle(w http.ResponseWriter, r *http.Request) {
+	battleID := mux.Vars(r)["id"]
+
+	next := 0
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		id, err := strconv.Atoi(lastID)
+		if err != nil || id < 0 {
+			http.Error(w, `{"error":"invalid last event id"}`, http.StatusBadRequest)
+			return
+		}
+		next = id + 1
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error":"streaming not supported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	s, err := joinBattleStream(battleID, next)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, `{"error":"battle not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("battle %s: read log: %v", battleID, err)
+		http.Error(w, `{"error":"battle log could not be read"}`, http.StatusInternalServerError)
+		return
+	}
+	defer leaveBattleStream(battleID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ctx := r.Context()
+	err = writeSSE(w, -1, "start", map[string]interface{}{
+		"battle_id":    battleID,
+		"total_rounds": s.log.TotalRounds,
+		"entries":      len(s.log.Entries),
+		"rules":        s.log.Rules,
+		"started_at":   s.start,
+	})
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	for i := next; i < len(s.log.Entries); i++ {
+		if !sleepUntil(ctx, s.start.Add(s.offsets[i])) {
+			return
+		}
+		if err := writeSSE(w, i, "entry", s.log.Entries[i]); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+
+	if !sleepUntil(ctx, s.end) {
+		return
+	}
+	writeSSE(w, -1, "end", map[string]interface{}{
+		"winner":             s.log.Winner,
+		"total_rounds":       s.log.TotalRounds,
+		"attacker_remaining": s.log.AttackerRemaining,
+		"defender_remaining": s.log.DefenderRemaining,
+	})
+	flusher.Flush()
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// bossCardID is the battle card id bosses use, so their damage taken can be
+// found in the log.
+const bossCardID int64 = 900
+
+// worldBossDailyAttacks is how many times a player may hit the world boss
+// per UTC day.
+const worldBossDailyAttacks = 3
+
+// bossDef describes a boss. Its phases are engine effect hooks (see
+// engine/boss.go) listed in Effects.
+type bossDef struct {
+	ID      string
+	Name    string
+	HP      int
+	Attack  int
+	Effects []string
+}
+
+// card builds the boss's battle card with its stats scaled to pct percent.
+// Stats are capped at what a card can hold.
+func (b bossDef) card(pct int) models.BattleCard {
+	hp := bossHP(b.HP * pct / 100)
+	return models.BattleCard{
+		ID:        bossCardID,
+		CardID:    b.ID,
+		Name:      b.Name,
+		CurrentHP: hp,
+		MaxHP:     hp,
+		Attack:    engine.ClampStat(b.Attack * pct / 100),
+		Rarity:    "boss",
+		Effects:   append([]string{}, b.Effects...),
+	}
+}
+
+// bossHP keeps a boss's HP between 1 and the most a card can hold. A world
+// boss with more shared HP left than that fights at the cap.
+func bossHP(hp int) int16 {
+	return engine.ClampStat(max(hp, 1))
+}
+
+// dungeonBosses guard the last floor of each dungeon run.
+var dungeonBosses = map[string]bossDef{
+	"easy": {
+		ID: "boss-street-king", Name: "Street King", HP: 14, Attack: 3,
+		Effects: []string{"taunt_below:50", "summon:5:2:1", "enrage:20:50"},
+	},
+	"medium": {
+		ID: "boss-consigliere", Name: "Consigliere", HP: 24, Attack: 5,
+		Effects: []string{"taunt_below:50", "summon:4:3:2", "enrage:20:50"},
+	},
+	"hard": {
+		ID: "boss-capo-dei-capi", Name: "Capo dei Capi", HP: 36, Attack: 7,
+		Effects: []string{"taunt_below:50", "summon:3:4:3", "enrage:20:100"},
+	},
+}
+
+// worldBosses rotate week by week. Their HP is shared by every player for
+// the week.
+var worldBosses = []bossDef{
+	{
+		ID: "world-iron-colossus", Name: "Iron Colossus", HP: 20000, Attack: 6,
+		Effects: []string{"summon:3:4:2", "enrage:20:100"},
+	},
+	{
+		ID: "world-syndicate", Name: "The Syndicate", HP: 16000, Attack: 8,
+		Effects: []string{"taunt_below:50", "summon:2:3:2", "enrage:20:50"},
+	},
+	{
+		ID: "world-kingpin", Name: "Kingpin", HP: 24000, Attack: 5,
+		Effects: []string{"summon:4:6:3", "enrage:15:100"},
+	},
+}
+
+type WorldBossAttackRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+const worldBossColumns = `id, boss_id, name, max_hp, hp_remaining, starts_at, ends_at, defeated_at`
+
+func scanWorldBoss(row pgx.Row, e *models.WorldBossEvent) error {
+	return row.Scan(&e.ID, &e.BossID, &e.Name, &e.MaxHP, &e.HPRemaining, &e.StartsAt, &e.EndsAt, &e.DefeatedAt)
+}
+
+// currentWorldBoss returns this week's world boss event.
+func currentWorldBoss(q db.Querier, forUpdate bool) (*models.WorldBossEvent, error) {
+	sql := `SELECT ` + worldBossColumns + ` FROM world_boss_events
+		WHERE starts_at <= NOW() AND ends_at > NOW()
+		ORDER BY starts_at DESC LIMIT 1`
+	if forUpdate {
+		sql += ` FOR UPDATE`
+	}
+	var e models.WorldBossEvent
+	if err := scanWorldBoss(q.QueryRow(context.Background(), sql), &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetWorldBoss returns this week's world boss. With ?user_id= it also says
+// how much that player has dealt and how many attacks they have left today.
+func GetWorldBoss(w http.ResponseWriter, r *http.Request) {
+	e, err := currentWorldBoss(db.Pool, false)
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"no world boss this week"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if def, ok := worldBossDef(e.BossID); ok {
+		e.Attack = def.Attack
+		e.Effects = def.Effects
+	}
+
+	resp := map[string]interface{}{"boss": e}
+
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.ParseInt(userIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+			return
+		}
+		var damage, today int
+		err = db.Pool.QueryRow(context.Background(),
+			`SELECT COALESCE(SUM(damage), 0),
+			        COUNT(*) FILTER (WHERE created_at >= date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')
+			 FROM world_boss_attacks WHERE event_id = $1 AND user_id = $2`, e.ID, userID).Scan(&damage, &today)
+		if err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+		resp["damage_dealt"] = damage
+		resp["attacks_left"] = max(worldBossDailyAttacks-today, 0)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AttackWorldBoss sends the player's attack deck against the world boss. The
+// boss starts the fight at its shared remaining HP, and whatever damage it
+// takes comes off that pool and onto the player's tally.
+func AttackWorldBoss(w http.ResponseWriter, r *http.Request) {
+	var req WorldBossAttackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	deck, err := loadActiveDeck(req.UserID, "attack")
+	if err != nil {
+		http.Error(w, `{"error":"load deck error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(deck) == 0 {
+		http.Error(w, `{"error":"deck is empty, set your deck first"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	e, err := currentWorldBoss(tx, true)
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"no world boss this week"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if e.HPRemaining <= 0 {
+		http.Error(w, `{"error":"the world boss has already been defeated"}`, http.StatusConflict)
+		return
+	}
+	def, ok := worldBossDef(e.BossID)
+	if !ok {
+		http.Error(w, `{"error":"unknown world boss"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var today int
+	err = tx.QueryRow(ctx,
+		`SELECT COUNT(*) FROM world_boss_attacks
+		 WHERE event_id = $1 AND user_id = $2
+		   AND created_at >= date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'`, e.ID, req.UserID).Scan(&today)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if today >= worldBossDailyAttacks {
+		http.Error(w, `{"error":"no attacks left today"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	boss := def.card(100)
+	boss.MaxHP = bossHP(e.MaxHP)
+	boss.CurrentHP = min(bossHP(e.HPRemaining), boss.MaxHP)
+	enemy := []models.BattleCard{boss}
+
+	battleLog := engine.RunBattleWith(deck, enemy, battleRules("world_boss"))
+	damage := min(bossDamageTaken(battleLog), e.HPRemaining)
+
+	battleID, _, err := saveBattle(tx, "world_boss", req.UserID, pveOpponentID, deck, enemy, battleLog)
+	if err != nil {
+		http.Error(w, `{"error":"save battle error"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO world_boss_attacks (event_id, user_id, battle_id, damage) VALUES ($1, $2, $3, $4)`,
+		e.ID, req.UserID, battleID, damage)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	err = tx.QueryRow(ctx,
+		`UPDATE world_boss_events SET hp_remaining = hp_remaining - $2,
+		        defeated_at = CASE WHEN hp_remaining - $2 <= 0 THEN NOW() END
+		 WHERE id = $1 RETURNING hp_remaining`, e.ID, damage).Scan(&e.HPRemaining)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"battle_id":    battleID,
+		"damage":       damage,
+		"hp_remaining": e.HPRemaining,
+		"defeated":     e.HPRemaining <= 0,
+		"rounds":       battleLog.TotalRounds,
+		"battle_log":   battleLog,
+	})
+}
+
+// bossDamageTaken adds up the damage dealt to the boss card in a battle.
+func bossDamageTaken(battleLog models.BattleLog) int {
+	total := 0
+	for _, entry := range battleLog.Entries {
+		for _, a := range entry.Actions {
+			if a.Type == "attack" && a.DefenderID != nil && *a.DefenderID == bossCardID && a.Damage != nil {
+				total += int(*a.Damage)
+			}
+		}
+	}
+	return total
+}
+
+func worldBossDef(id string) (bossDef, bool) {
+	for _, b := range worldBosses {
+		if b.ID == id {
+			return b, true
+		}
+	}
+	return bossDef{}, false
+}
+
+// openWorldBoss is the background job that puts up a new world boss each
+// week, running from Monday 00:00 UTC to the next Monday.
+func openWorldBoss() error {
+	_, err := currentWorldBoss(db.Pool, false)
+	if err != pgx.ErrNoRows {
+		return err
+	}
+
+	now := time.Now().UTC()
+	daysSinceMonday := (int(now.Weekday()) + 6) % 7
+	start := time.Date(now.Year(), now.Month(), now.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+	_, week := start.ISOWeek()
+	boss := worldBosses[week%len(worldBosses)]
+
+	_, err = db.Pool.Exec(context.Background(),
+		`INSERT INTO world_boss_events (boss_id, name, max_hp, hp_remaining, starts_at, ends_at)
+		 VALUES ($1, $2, $3, $3, $4, $5)
+		 ON CONFLICT (starts_at) DO NOTHING`,
+		boss.ID, boss.Name, boss.HP, start, start.AddDate(0, 0, 7))
+	return err
+}
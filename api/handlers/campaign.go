@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+)
+
+// campaign is the story campaign, chapter by chapter. Stages within a chapter
+// unlock one after the other; a chapter unlocks once the player has earned
+// StarsToUnlock stars over the whole campaign.
+var campaign = []models.CampaignChapter{
+	{
+		Number: 1, Name: "Streets", StarsToUnlock: 0,
+		Stages: []models.CampaignStage{
+			{
+				ID: "1-1", Name: "Corner Boys",
+				Enemy:      []string{"thug", "thug"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 10}, {Kind: "no_losses"}},
+				Reward:     models.Reward{Coins: 10},
+			},
+			{
+				ID: "1-2", Name: "Back Alley",
+				Enemy:      []string{"goon", "thug", "venom"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 14}, {Kind: "no_losses"}},
+				Reward:     models.Reward{Coins: 15},
+			},
+			{
+				ID: "1-3", Name: "The Collector",
+				Enemy:      []string{"thug", "goon", "enforcer"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 16}, {Kind: "min_remaining", Value: 3}},
+				Reward:     models.Reward{Item: "bronze_key"},
+			},
+		},
+	},
+	{
+		Number: 2, Name: "Family Business", StarsToUnlock: 6,
+		Stages: []models.CampaignStage{
+			{
+				ID: "2-1", Name: "Protection Racket",
+				Enemy:      []string{"enforcer", "hitman", "goon"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 18}, {Kind: "no_losses"}},
+				Reward:     models.Reward{Coins: 25},
+			},
+			{
+				ID: "2-2", Name: "The Docks",
+				Enemy:      []string{"hitman", "spider-man", "enforcer", "thug"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 20}, {Kind: "min_remaining", Value: 3}},
+				Reward:     models.Reward{Item: "silver_key"},
+			},
+			{
+				ID: "2-3", Name: "Sit-down with the Capo",
+				Enemy:      []string{"enforcer", "hitman", "capo", "spider-man"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 22}, {Kind: "no_losses"}},
+				Reward:     models.Reward{CardID: "capo"},
+			},
+		},
+	},
+	{
+		Number: 3, Name: "Commission", StarsToUnlock: 14,
+		Stages: []models.CampaignStage{
+			{
+				ID: "3-1", Name: "Rival Family",
+				Enemy:      []string{"capo", "don", "hitman", "spider-man"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 24}, {Kind: "min_remaining", Value: 2}},
+				Reward:     models.Reward{Coins: 50},
+			},
+			{
+				ID: "3-2", Name: "The Mastermind",
+				Enemy:      []string{"mastermind", "berserker", "capo", "enforcer"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 26}, {Kind: "no_losses"}},
+				Reward:     models.Reward{Item: "gold_key"},
+			},
+			{
+				ID: "3-3", Name: "The Godfather",
+				Enemy:      []string{"don", "mastermind", "berserker", "godfather"},
+				Conditions: []models.CampaignCondition{{Kind: "max_rounds", Value: 30}, {Kind: "min_remaining", Value: 3}},
+				Reward:     models.Reward{CardID: "godfather"},
+			},
+		},
+	},
+}
+
+type CampaignBattleRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// campaignStars scores a campaign battle: one star for winning and one more
+// per condition met, for up to three.
+func campaignStars(stage models.CampaignStage, battleLog models.BattleLog) int {
+	if battleLog.Winner != "attacker" {
+		return 0
+	}
+
+	lost := 0
+	for _, entry := range battleLog.Entries {
+		for _, a := range entry.Actions {
+			if a.Type == "card_died" && a.DiedSide != nil && *a.DiedSide == "attacker" {
+				lost++
+			}
+		}
+	}
+
+	stars := 1
+	for _, c := range stage.Conditions {
+		switch c.Kind {
+		case "max_rounds":
+			if battleLog.TotalRounds <= c.Value {
+				stars++
+			}
+		case "no_losses":
+			if lost == 0 {
+				stars++
+			}
+		case "min_remaining":
+			if battleLog.AttackerRemaining >= c.Value {
+				stars++
+			}
+		}
+	}
+	return min(stars, 3)
+}
+
+// campaignProgress returns the campaign with a player's stars filled in and
+// chapters and stages marked unlocked where they are.
+func campaignProgress(q db.Querier, userID int64) ([]models.CampaignChapter, int, error) {
+	rows, err := q.Query(context.Background(),
+		`SELECT stage_id, stars, attempts FROM campaign_progress WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	type progress struct{ stars, attempts int }
+	byStage := map[string]progress{}
+	total := 0
+	for rows.Next() {
+		var id string
+		var p progress
+		if err := rows.Scan(&id, &p.stars, &p.attempts); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		byStage[id] = p
+		total += p.stars
+	}
+	rows.Close()
+
+	chapters := make([]models.CampaignChapter, len(campaign))
+	for i, ch := range campaign {
+		ch.Stages = append([]models.CampaignStage{}, ch.Stages...)
+		ch.Unlocked = total >= ch.StarsToUnlock
+		prevCleared := true
+		for j := range ch.Stages {
+			st := &ch.Stages[j]
+			p := byStage[st.ID]
+			st.Stars = p.stars
+			st.Attempts = p.attempts
+			st.Unlocked = ch.Unlocked && prevCleared
+			prevCleared = p.stars > 0
+			ch.Stars += p.stars
+		}
+		chapters[i] = ch
+	}
+	return chapters, total, nil
+}
+
+func findCampaignStage(chapters []models.CampaignChapter, stageID string) *models.CampaignStage {
+	for i := range chapters {
+		for j := range chapters[i].Stages {
+			if chapters[i].Stages[j].ID == stageID {
+				return &chapters[i].Stages[j]
+			}
+		}
+	}
+	return nil
+}
+
+// GetCampaign returns every chapter and stage with the player's progress
+// (?user_id=).
+func GetCampaign(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+
+	chapters, total, err := campaignProgress(db.Pool, userID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_stars": total,
+		"chapters":    chapters,
+	})
+}
+
+func GetCampaignStage(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+
+	chapters, _, err := campaignProgress(db.Pool, userID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	stage := findCampaignStage(chapters, mux.Vars(r)["id"])
+	if stage == nil {
+		http.Error(w, `{"error":"stage not found"}`, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stage)
+}
+
+// BattleCampaignStage fights a stage with the player's attack deck. The best
+// star count is kept, and the stage reward is paid on the first win.
+func BattleCampaignStage(w http.ResponseWriter, r *http.Request) {
+	var req CampaignBattleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	chapters, _, err := campaignProgress(db.Pool, req.UserID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	stage := findCampaignStage(chapters, mux.Vars(r)["id"])
+	if stage == nil {
+		http.Error(w, `{"error":"stage not found"}`, http.StatusNotFound)
+		return
+	}
+	if !stage.Unlocked {
+		http.Error(w, `{"error":"stage is locked"}`, http.StatusForbidden)
+		return
+	}
+
+	attackerDeck, err := loadActiveDeck(req.UserID, "attack")
+	if err != nil {
+		http.Error(w, `{"error":"load deck error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(attackerDeck) == 0 {
+		http.Error(w, `{"error":"deck is empty, set your deck first"}`, http.StatusBadRequest)
+		return
+	}
+	enemy, err := buildBotDeck(stage.Enemy)
+	if err != nil {
+		http.Error(w, `{"error":"build enemy deck error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	battleLog := engine.RunBattleWith(attackerDeck, enemy, battleRules("campaign"))
+	stars := campaignStars(*stage, battleLog)
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	battleID, _, err := saveBattle(tx, "campaign", req.UserID, pveOpponentID, attackerDeck, enemy, battleLog)
+	if err != nil {
+		http.Error(w, `{"error":"save battle error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// first_cleared_at is only set by the first winning attempt, which is
+	// how the reward is paid exactly once.
+	var firstClear bool
+	err = tx.QueryRow(ctx,
+		`INSERT INTO campaign_progress (user_id, stage_id, stars, attempts, best_battle_id, first_cleared_at)
+		 VALUES ($1, $2, $3, 1, CASE WHEN $3 > 0 THEN $4::UUID END, CASE WHEN $3 > 0 THEN NOW() END)
+		 ON CONFLICT (user_id, stage_id) DO UPDATE SET
+		     attempts = campaign_progress.attempts + 1,
+		     best_battle_id = CASE WHEN $3 > campaign_progress.stars THEN $4::UUID ELSE campaign_progress.best_battle_id END,
+		     stars = GREATEST(campaign_progress.stars, $3),
+		     first_cleared_at = COALESCE(campaign_progress.first_cleared_at, CASE WHEN $3 > 0 THEN NOW() END),
+		     updated_at = NOW()
+		 RETURNING $3 > 0 AND first_cleared_at = NOW()`,
+		req.UserID, stage.ID, stars, battleID).Scan(&firstClear)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var rewards []LootResult
+	if firstClear {
+		rewards, err = giveReward(tx, req.UserID, stage.Reward)
+		if err != nil {
+			http.Error(w, `{"error":"give reward error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"battle_id":   battleID,
+		"winner":      battleLog.Winner,
+		"rounds":      battleLog.TotalRounds,
+		"stars":       stars,
+		"best_stars":  max(stars, stage.Stars),
+		"first_clear": firstClear,
+		"rewards":     rewards,
+		"battle_log":  battleLog,
+	})
+}
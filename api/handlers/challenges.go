@@ -0,0 +1,511 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultChallengeTTL = 24 * time.Hour
+	maxChallengeTTL     = 72 * time.Hour
+)
+
+type CreateChallengeRequest struct {
+	ChallengerID     int64  `json:"challenger_id"`
+	DefenderID       int64  `json:"defender_id"`
+	StakeCoins       int    `json:"stake_coins"`
+	StakeCardID      string `json:"stake_card_id"`
+	ExpiresInMinutes int    `json:"expires_in_minutes"`
+}
+
+type ChallengeActionRequest struct {
+	UserID      int64  `json:"user_id"`
+	StakeCardID string `json:"stake_card_id"`
+}
+
+const challengeColumns = `id, challenger_id, defender_id, status, stake_coins, challenger_card_id, defender_card_id,
+	battle_id, winner_id, expires_at, created_at, resolved_at`
+
+func scanChallenge(row pgx.Row, c *models.Challenge) error {
+	return row.Scan(&c.ID, &c.ChallengerID, &c.DefenderID, &c.Status, &c.StakeCoins, &c.ChallengerCardID,
+		&c.DefenderCardID, &c.BattleID, &c.WinnerID, &c.ExpiresAt, &c.CreatedAt, &c.ResolvedAt)
+}
+
+// CreateChallenge challenges another player. The challenger's attack deck is
+// locked in now and any stake is held until the challenge is resolved.
+func CreateChallenge(w http.ResponseWriter, r *http.Request) {
+	var req CreateChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.ChallengerID == req.DefenderID {
+		http.Error(w, `{"error":"cannot challenge yourself"}`, http.StatusBadRequest)
+		return
+	}
+	if req.StakeCoins < 0 {
+		http.Error(w, `{"error":"stake must not be negative"}`, http.StatusBadRequest)
+		return
+	}
+	if req.StakeCoins > 0 && req.StakeCardID != "" {
+		http.Error(w, `{"error":"stake either coins or a card"}`, http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultChallengeTTL
+	if req.ExpiresInMinutes > 0 {
+		ttl = time.Duration(req.ExpiresInMinutes) * time.Minute
+	}
+	if ttl > maxChallengeTTL {
+		http.Error(w, `{"error":"challenges expire within 72 hours at most"}`, http.StatusBadRequest)
+		return
+	}
+
+	var defenderExists bool
+	db.Pool.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)`, req.DefenderID).Scan(&defenderExists)
+	if !defenderExists {
+		http.Error(w, `{"error":"defender not found"}`, http.StatusNotFound)
+		return
+	}
+
+	deck, err := loadActiveDeck(req.ChallengerID, "attack")
+	if err != nil {
+		http.Error(w, `{"error":"load deck error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(deck) == 0 {
+		http.Error(w, `{"error":"challenger deck is empty"}`, http.StatusBadRequest)
+		return
+	}
+	deckJSON, _ := json.Marshal(deck)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var stakeCard *string
+	if req.StakeCardID != "" {
+		stakeCard = &req.StakeCardID
+	}
+
+	var c models.Challenge
+	err = scanChallenge(tx.QueryRow(context.Background(),
+		`INSERT INTO challenges (challenger_id, defender_id, stake_coins, challenger_card_id, challenger_deck, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING `+challengeColumns,
+		req.ChallengerID, req.DefenderID, req.StakeCoins, stakeCard, deckJSON, time.Now().Add(ttl)), &c)
+	if err != nil {
+		http.Error(w, `{"error":"create challenge error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if req.StakeCoins > 0 {
+		if err := takeItem(tx, req.ChallengerID, currencyItem, req.StakeCoins); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if stakeCard != nil {
+		if err := stakeUserCard(tx, req.ChallengerID, *stakeCard, c.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	err = notify(tx, req.DefenderID, "challenge_received", map[string]interface{}{
+		"challenge_id":  c.ID,
+		"challenger_id": req.ChallengerID,
+		"stake_coins":   req.StakeCoins,
+		"stake_card":    stakeCard != nil,
+		"expires_at":    c.ExpiresAt,
+	})
+	if err != nil {
+		http.Error(w, `{"error":"notify error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+func GetChallenge(w http.ResponseWriter, r *http.Request) {
+	var c models.Challenge
+	err := scanChallenge(db.Pool.QueryRow(context.Background(),
+		`SELECT `+challengeColumns+` FROM challenges WHERE id = $1`, mux.Vars(r)["id"]), &c)
+	if err != nil {
+		http.Error(w, `{"error":"challenge not found"}`, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+// GetUserChallenges lists challenges a player sent or received, optionally
+// filtered by ?status=.
+func GetUserChallenges(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	limit, offset := pageParams(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+challengeColumns+` FROM challenges
+		 WHERE (challenger_id = $1 OR defender_id = $1) AND ($2 = '' OR status = $2)
+		 ORDER BY created_at DESC LIMIT $3 OFFSET $4`, userID, status, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	challenges := []models.Challenge{}
+	for rows.Next() {
+		var c models.Challenge
+		if err := scanChallenge(rows, &c); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		challenges = append(challenges, c)
+	}
+
+	writeJSON(w, http.StatusOK, challenges)
+}
+
+// AcceptChallenge locks in the defender's defense deck and stake, runs the
+// battle and pays out the stakes to the winner.
+func AcceptChallenge(w http.ResponseWriter, r *http.Request) {
+	var req ChallengeActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	c, challengerDeck, err := lockPendingChallenge(tx, mux.Vars(r)["id"], req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if c.DefenderID != req.UserID {
+		http.Error(w, `{"error":"only the challenged player can accept"}`, http.StatusForbidden)
+		return
+	}
+
+	defenderDeck, err := loadActiveDeck(c.DefenderID, "defense")
+	if err != nil {
+		http.Error(w, `{"error":"load deck error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(defenderDeck) == 0 {
+		http.Error(w, `{"error":"defender deck is empty"}`, http.StatusBadRequest)
+		return
+	}
+
+	if c.StakeCoins > 0 {
+		if err := takeItem(tx, c.DefenderID, currencyItem, c.StakeCoins); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if c.ChallengerCardID != nil {
+		if req.StakeCardID == "" {
+			http.Error(w, `{"error":"this challenge requires staking a card"}`, http.StatusBadRequest)
+			return
+		}
+		if err := stakeUserCard(tx, c.DefenderID, req.StakeCardID, c.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+		c.DefenderCardID = &req.StakeCardID
+	}
+
+	battleLog := engine.RunBattleWith(challengerDeck, defenderDeck, battleRules("challenge"))
+
+	battleID, winnerID, err := saveBattle(tx, "challenge", c.ChallengerID, c.DefenderID, challengerDeck, defenderDeck, battleLog)
+	if err != nil {
+		http.Error(w, `{"error":"save battle error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := settleChallengeStakes(tx, c, winnerID); err != nil {
+		http.Error(w, `{"error":"settle stakes error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	defenderDeckJSON, _ := json.Marshal(defenderDeck)
+	_, err = tx.Exec(ctx,
+		`UPDATE challenges SET status = 'completed', defender_card_id = $2, defender_deck = $3,
+		        battle_id = $4, winner_id = $5, resolved_at = NOW()
+		 WHERE id = $1`, c.ID, c.DefenderCardID, defenderDeckJSON, battleID, winnerID)
+	if err != nil {
+		http.Error(w, `{"error":"update challenge error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, userID := range []int64{c.ChallengerID, c.DefenderID} {
+		err := notify(tx, userID, "challenge_completed", map[string]interface{}{
+			"challenge_id": c.ID,
+			"battle_id":    battleID,
+			"winner_id":    winnerID,
+		})
+		if err != nil {
+			http.Error(w, `{"error":"notify error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"challenge_id": c.ID,
+		"battle_id":    battleID,
+		"winner":       battleLog.Winner,
+		"winner_id":    winnerID,
+		"rounds":       battleLog.TotalRounds,
+		"battle_log":   battleLog,
+	})
+}
+
+// DeclineChallenge lets the challenged player turn a challenge down.
+func DeclineChallenge(w http.ResponseWriter, r *http.Request) {
+	closeChallenge(w, r, "declined")
+}
+
+// CancelChallenge lets the challenger withdraw a challenge.
+func CancelChallenge(w http.ResponseWriter, r *http.Request) {
+	closeChallenge(w, r, "cancelled")
+}
+
+func closeChallenge(w http.ResponseWriter, r *http.Request, status string) {
+	var req ChallengeActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	c, _, err := lockPendingChallenge(tx, mux.Vars(r)["id"], req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Declining is for the defender, cancelling for the challenger; the
+	// other side is the one told about it.
+	actor, other := c.DefenderID, c.ChallengerID
+	if status == "cancelled" {
+		actor, other = c.ChallengerID, c.DefenderID
+	}
+	if req.UserID != actor {
+		http.Error(w, `{"error":"not allowed"}`, http.StatusForbidden)
+		return
+	}
+
+	if err := refundChallenge(tx, c, status); err != nil {
+		http.Error(w, `{"error":"refund error"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := notify(tx, other, "challenge_"+status, map[string]interface{}{"challenge_id": c.ID}); err != nil {
+		http.Error(w, `{"error":"notify error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// lockPendingChallenge loads a pending challenge the user takes part in and
+// locks its row for the rest of the transaction. Challenges past their
+// deadline are treated as already expired.
+func lockPendingChallenge(tx pgx.Tx, challengeID string, userID int64) (*models.Challenge, []models.BattleCard, error) {
+	var c models.Challenge
+	var deckRaw json.RawMessage
+	err := tx.QueryRow(context.Background(),
+		`SELECT `+challengeColumns+`, challenger_deck FROM challenges WHERE id = $1 FOR UPDATE`, challengeID).Scan(
+		&c.ID, &c.ChallengerID, &c.DefenderID, &c.Status, &c.StakeCoins, &c.ChallengerCardID,
+		&c.DefenderCardID, &c.BattleID, &c.WinnerID, &c.ExpiresAt, &c.CreatedAt, &c.ResolvedAt, &deckRaw)
+	if err != nil {
+		return nil, nil, &apiError{http.StatusNotFound, "challenge not found"}
+	}
+	if userID != c.ChallengerID && userID != c.DefenderID {
+		return nil, nil, &apiError{http.StatusForbidden, "not your challenge"}
+	}
+	if c.Status != "pending" || time.Now().After(c.ExpiresAt) {
+		return nil, nil, &apiError{http.StatusConflict, "challenge is no longer pending"}
+	}
+
+	var deck []models.BattleCard
+	if err := json.Unmarshal(deckRaw, &deck); err != nil {
+		return nil, nil, err
+	}
+	return &c, deck, nil
+}
+
+// stakeUserCard marks a card as held by a challenge. The card must belong to
+// the user and not already be staked.
+func stakeUserCard(q db.Querier, userID int64, userCardID, challengeID string) error {
+	tag, err := q.Exec(context.Background(),
+		`UPDATE user_cards SET staked_in = $3 WHERE id = $1 AND user_id = $2 AND staked_in IS NULL`,
+		userCardID, userID, challengeID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &apiError{http.StatusBadRequest, "card not found in inventory or already staked"}
+	}
+	return nil
+}
+
+// settleChallengeStakes pays both stakes to the winner, or hands them back on
+// a tie. A won card leaves the loser's decks.
+func settleChallengeStakes(q db.Querier, c *models.Challenge, winnerID *int64) error {
+	if winnerID == nil {
+		return releaseStakes(q, c, c.ChallengerID, c.DefenderID)
+	}
+
+	if c.StakeCoins > 0 {
+		if err := giveItem(q, *winnerID, currencyItem, 2*c.StakeCoins); err != nil {
+			return err
+		}
+	}
+	for _, cardID := range []*string{c.ChallengerCardID, c.DefenderCardID} {
+		if cardID == nil {
+			continue
+		}
+		_, err := q.Exec(context.Background(),
+			`DELETE FROM deck_cards WHERE user_card_id = $1
+			 AND deck_id IN (SELECT id FROM decks WHERE user_id <> $2)`, *cardID, *winnerID)
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(context.Background(),
+			`UPDATE user_cards SET user_id = $2, staked_in = NULL WHERE id = $1`, *cardID, *winnerID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refundChallenge closes a pending challenge with the given status and returns
+// whatever the challenger staked. The defender never stakes before accepting.
+func refundChallenge(q db.Querier, c *models.Challenge, status string) error {
+	if err := releaseStakes(q, c, c.ChallengerID, 0); err != nil {
+		return err
+	}
+	_, err := q.Exec(context.Background(),
+		`UPDATE challenges SET status = $2, resolved_at = NOW() WHERE id = $1`, c.ID, status)
+	return err
+}
+
+// releaseStakes returns coins to the given players (0 to skip one) and
+// unstakes every card held by the challenge.
+func releaseStakes(q db.Querier, c *models.Challenge, userIDs ...int64) error {
+	if c.StakeCoins > 0 {
+		for _, userID := range userIDs {
+			if userID == 0 {
+				continue
+			}
+			if err := giveItem(q, userID, currencyItem, c.StakeCoins); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := q.Exec(context.Background(),
+		`UPDATE user_cards SET staked_in = NULL WHERE staked_in = $1`, c.ID)
+	return err
+}
+
+// expireChallenges is the background job that closes pending challenges past
+// their deadline, refunds the challenger and lets them know.
+func expireChallenges() error {
+	ctx := context.Background()
+	rows, err := db.Pool.Query(ctx,
+		`SELECT id FROM challenges WHERE status = 'pending' AND expires_at <= NOW() LIMIT 500`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		var c models.Challenge
+		err = scanChallenge(tx.QueryRow(ctx,
+			`SELECT `+challengeColumns+` FROM challenges WHERE id = $1 AND status = 'pending' FOR UPDATE`, id), &c)
+		if err == pgx.ErrNoRows {
+			tx.Rollback(ctx)
+			continue
+		}
+		if err == nil {
+			err = refundChallenge(tx, &c, "expired")
+		}
+		if err == nil {
+			err = notify(tx, c.ChallengerID, "challenge_expired", map[string]interface{}{
+				"challenge_id": c.ID,
+				"defender_id":  c.DefenderID,
+			})
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+	return nil
+}
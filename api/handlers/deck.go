@@ -5,14 +5,27 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"imperium/db"
 	"imperium/models"
 
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 )
 
-func GetDeck(w http.ResponseWriter, r *http.Request) {
+const defaultDeckName = "default"
+
+// deckPurposes lists every purpose a deck can be made active for.
+var deckPurposes = map[string]bool{
+	"attack":         true,
+	"defense":        true,
+	"dungeon:easy":   true,
+	"dungeon:medium": true,
+	"dungeon:hard":   true,
+}
+
+func GetDecks(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
@@ -20,33 +33,78 @@ func GetDeck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rows, err := db.Pool.Query(context.Background(),
-		`SELECT ud.user_id, ud.slot, ud.user_card_id,
-		        uc.id, uc.user_id, uc.card_id, uc.quality, uc.current_hp, uc.current_durability, uc.created_at,
-		        cd.id, cd.name, cd.base_hp, cd.base_damage, cd.base_durability, cd.rarity, cd.effects, cd.is_fuel, cd.spawns
-		 FROM user_deck ud
-		 JOIN user_cards uc ON uc.id = ud.user_card_id
-		 JOIN card_definitions cd ON cd.id = uc.card_id
-		 WHERE ud.user_id = $1
-		 ORDER BY ud.slot`, userID)
+		`SELECT d.id, d.user_id, d.name, d.created_at,
+		        (SELECT COUNT(*) FROM deck_cards dc WHERE dc.deck_id = d.id),
+		        COALESCE((SELECT array_agg(ad.purpose ORDER BY ad.purpose) FROM active_decks ad WHERE ad.deck_id = d.id), '{}')
+		 FROM decks d
+		 WHERE d.user_id = $1
+		 ORDER BY d.created_at`, userID)
 	if err != nil {
 		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
+	decks := []models.Deck{}
+	for rows.Next() {
+		var d models.Deck
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &d.CreatedAt, &d.CardCount, &d.ActiveFor); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		decks = append(decks, d)
+	}
+
+	writeJSON(w, http.StatusOK, decks)
+}
+
+// GetDeck returns the deck named by the "name" query parameter, or the
+// user's active attack deck when no name is given.
+func GetDeck(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
 	type DeckEntry struct {
 		Slot int             `json:"slot"`
 		Card models.UserCard `json:"card"`
 	}
-
 	deck := []DeckEntry{}
+
+	deckID, err := resolveDeckID(userID, r.URL.Query().Get("name"))
+	if err == pgx.ErrNoRows {
+		writeJSON(w, http.StatusOK, deck)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT dc.slot,
+		        uc.id, uc.user_id, uc.card_id, uc.quality, uc.current_hp, uc.current_durability, uc.created_at,
+		        cd.id, cd.name, cd.base_hp, cd.base_damage, cd.base_durability, cd.rarity, cd.effects, cd.is_fuel, cd.spawns
+		 FROM deck_cards dc
+		 JOIN user_cards uc ON uc.id = dc.user_card_id
+		 JOIN card_definitions cd ON cd.id = uc.card_id
+		 WHERE dc.deck_id = $1
+		 ORDER BY dc.slot`, deckID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
 	for rows.Next() {
-		var ds models.DeckSlot
+		var slot int
 		var uc models.UserCard
 		var cd models.CardDefinition
 		var effectsRaw json.RawMessage
 		var spawns *string
-		err := rows.Scan(&ds.UserID, &ds.Slot, &ds.UserCardID,
+		err := rows.Scan(&slot,
 			&uc.ID, &uc.UserID, &uc.CardID, &uc.Quality, &uc.CurrentHP, &uc.CurrentDurability, &uc.CreatedAt,
 			&cd.ID, &cd.Name, &cd.BaseHP, &cd.BaseDamage, &cd.BaseDurability, &cd.Rarity, &effectsRaw, &cd.IsFuel, &spawns)
 		if err != nil {
@@ -56,19 +114,23 @@ func GetDeck(w http.ResponseWriter, r *http.Request) {
 		cd.ParseEffects(effectsRaw)
 		cd.Spawns = spawns
 		uc.Definition = &cd
-		deck = append(deck, DeckEntry{Slot: ds.Slot, Card: uc})
+		deck = append(deck, DeckEntry{Slot: slot, Card: uc})
 	}
 
 	writeJSON(w, http.StatusOK, deck)
 }
 
 type SetDeckRequest struct {
+	Name  string `json:"name"`
 	Slots []struct {
 		Slot       int    `json:"slot"`
 		UserCardID string `json:"user_card_id"`
 	} `json:"slots"`
 }
 
+// SetDeck replaces the cards of a named deck, creating it if needed. Without
+// a name the active attack deck is updated. A user's first deck becomes both
+// their attack and defense deck.
 func SetDeck(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
@@ -81,20 +143,44 @@ func SetDeck(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
 		return
 	}
+	if req.Name == "" {
+		req.Name = r.URL.Query().Get("name")
+	}
 
 	if len(req.Slots) > 5 {
 		http.Error(w, `{"error":"max 5 deck slots"}`, http.StatusBadRequest)
 		return
 	}
 
-	tx, err := db.Pool.Begin(context.Background())
+	if req.Name == "" {
+		req.Name = defaultDeckName
+		var activeName string
+		err := db.Pool.QueryRow(context.Background(),
+			`SELECT d.name FROM active_decks ad JOIN decks d ON d.id = ad.deck_id
+			 WHERE ad.user_id = $1 AND ad.purpose = 'attack'`, userID).Scan(&activeName)
+		if err == nil {
+			req.Name = activeName
+		}
+	}
+
+	tx, err := db.Begin(context.Background())
 	if err != nil {
 		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
 		return
 	}
 	defer tx.Rollback(context.Background())
 
-	_, err = tx.Exec(context.Background(), `DELETE FROM user_deck WHERE user_id = $1`, userID)
+	var deckID string
+	err = tx.QueryRow(context.Background(),
+		`INSERT INTO decks (user_id, name) VALUES ($1, $2)
+		 ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
+		 RETURNING id`, userID, req.Name).Scan(&deckID)
+	if err != nil {
+		http.Error(w, `{"error":"create deck error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(context.Background(), `DELETE FROM deck_cards WHERE deck_id = $1`, deckID)
 	if err != nil {
 		http.Error(w, `{"error":"clear deck error"}`, http.StatusInternalServerError)
 		return
@@ -115,18 +201,159 @@ func SetDeck(w http.ResponseWriter, r *http.Request) {
 		}
 
 		_, err = tx.Exec(context.Background(),
-			`INSERT INTO user_deck (user_id, slot, user_card_id) VALUES ($1, $2, $3)`,
-			userID, s.Slot, s.UserCardID)
+			`INSERT INTO deck_cards (deck_id, slot, user_card_id) VALUES ($1, $2, $3)`,
+			deckID, s.Slot, s.UserCardID)
 		if err != nil {
 			http.Error(w, `{"error":"insert deck error"}`, http.StatusInternalServerError)
 			return
 		}
 	}
 
+	_, err = tx.Exec(context.Background(),
+		`INSERT INTO active_decks (user_id, purpose, deck_id)
+		 SELECT $1, p.purpose, $2 FROM (VALUES ('attack'), ('defense')) AS p(purpose)
+		 ON CONFLICT (user_id, purpose) DO NOTHING`, userID, deckID)
+	if err != nil {
+		http.Error(w, `{"error":"activate deck error"}`, http.StatusInternalServerError)
+		return
+	}
+
 	if err := tx.Commit(context.Background()); err != nil {
 		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
 		return
 	}
 
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "name": req.Name})
+}
+
+type SetActiveDeckRequest struct {
+	Name    string `json:"name"`
+	Purpose string `json:"purpose"`
+}
+
+// SetActiveDeck makes a named deck the one used for a purpose. An empty name
+// clears a dungeon preset so that dungeon falls back to the attack deck.
+func SetActiveDeck(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req SetActiveDeckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Purpose == "" {
+		req.Purpose = "attack"
+	}
+	if !deckPurposes[req.Purpose] {
+		http.Error(w, `{"error":"purpose must be attack, defense or dungeon:easy|medium|hard"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		if !strings.HasPrefix(req.Purpose, "dungeon:") {
+			http.Error(w, `{"error":"deck name required"}`, http.StatusBadRequest)
+			return
+		}
+		_, err := db.Pool.Exec(context.Background(),
+			`DELETE FROM active_decks WHERE user_id = $1 AND purpose = $2`, userID, req.Purpose)
+		if err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+
+	var deckID string
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT id FROM decks WHERE user_id = $1 AND name = $2`, userID, req.Name).Scan(&deckID)
+	if err != nil {
+		http.Error(w, `{"error":"deck not found"}`, http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Pool.Exec(context.Background(),
+		`INSERT INTO active_decks (user_id, purpose, deck_id) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id, purpose) DO UPDATE SET deck_id = EXCLUDED.deck_id`,
+		userID, req.Purpose, deckID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
+
+// DeleteDeck removes a named deck. The active attack and defense decks cannot
+// be deleted; dungeon presets pointing at it are cleared.
+func DeleteDeck(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var inUse bool
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT EXISTS(SELECT 1 FROM active_decks ad JOIN decks d ON d.id = ad.deck_id
+		 WHERE d.user_id = $1 AND d.name = $2 AND ad.purpose IN ('attack', 'defense'))`,
+		userID, vars["name"]).Scan(&inUse)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if inUse {
+		http.Error(w, `{"error":"deck is active for attack or defense"}`, http.StatusConflict)
+		return
+	}
+
+	tag, err := db.Pool.Exec(context.Background(),
+		`DELETE FROM decks WHERE user_id = $1 AND name = $2`, userID, vars["name"])
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, `{"error":"deck not found"}`, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// resolveDeckID looks a deck up by name, or returns the active attack deck
+// when name is empty.
+func resolveDeckID(userID int64, name string) (string, error) {
+	var deckID string
+	var err error
+	if name != "" {
+		err = db.Pool.QueryRow(context.Background(),
+			`SELECT id FROM decks WHERE user_id = $1 AND name = $2`, userID, name).Scan(&deckID)
+	} else {
+		err = db.Pool.QueryRow(context.Background(),
+			`SELECT deck_id FROM active_decks WHERE user_id = $1 AND purpose = 'attack'`, userID).Scan(&deckID)
+	}
+	return deckID, err
+}
+
+// activeDeckID returns the deck a user has set for purpose. Defense decks and
+// dungeon presets fall back to the attack deck when they are not set.
+func activeDeckID(userID int64, purpose string) (string, error) {
+	purposes := []string{purpose}
+	if purpose != "attack" {
+		purposes = append(purposes, "attack")
+	}
+
+	var deckID string
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT deck_id FROM active_decks
+		 WHERE user_id = $1 AND purpose = ANY($2)
+		 ORDER BY array_position($2, purpose)
+		 LIMIT 1`, userID, purposes).Scan(&deckID)
+	return deckID, err
+}
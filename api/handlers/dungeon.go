@@ -0,0 +1,594 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/events"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// dungeonKeys is the key a run of each dungeon consumes.
+var dungeonKeys = map[string]string{
+	"easy":   "bronze_key",
+	"medium": "silver_key",
+	"hard":   "gold_key",
+}
+
+// dungeonFloors is how many floors a run has. The last one is the boss floor.
+var dungeonFloors = map[string]int{
+	"easy":   3,
+	"medium": 4,
+	"hard":   5,
+}
+
+// floorCoins is the currency a cleared floor pays, times the floor number.
+var floorCoins = map[string]int{
+	"easy":   5,
+	"medium": 10,
+	"hard":   20,
+}
+
+// dungeonFloorScaling is how much stronger, in percent, each floor's
+// encounter is than the one before.
+const dungeonFloorScaling = 20
+
+type DungeonRequest struct {
+	UserID  int64  `json:"user_id"`
+	Dungeon string `json:"dungeon"`
+}
+
+type DungeonRunActionRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+const dungeonRunColumns = `id, user_id, dungeon, status, floor, floors, coins_earned, created_at, finished_at`
+
+func scanDungeonRun(row pgx.Row, run *models.DungeonRun) error {
+	return row.Scan(&run.ID, &run.UserID, &run.Dungeon, &run.Status, &run.Floor, &run.Floors,
+		&run.CoinsEarned, &run.CreatedAt, &run.FinishedAt)
+}
+
+// StartDungeonRun consumes the dungeon's key and starts a run with the
+// player's dungeon deck, healed to full.
+func StartDungeonRun(w http.ResponseWriter, r *http.Request) {
+	var req DungeonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	run, err := startDungeonRun(req.UserID, req.Dungeon)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// EnterDungeon is the old one-call dungeon: it starts a run and fights every
+// floor straight away, answering with all the loot like the dungeon used to.
+//
+// Deprecated: use the /dungeon/runs endpoints, which let players stop between
+// floors.
+func EnterDungeon(w http.ResponseWriter, r *http.Request) {
+	var req DungeonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	run, err := startDungeonRun(req.UserID, req.Dungeon)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	results := []LootResult{}
+	for run.Status == "active" {
+		floor, err := playDungeonFloor(run.ID, req.UserID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		results = append(results, floor.loot...)
+		run = floor.run
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results, "run": run})
+}
+
+// startDungeonRun does the work of StartDungeonRun.
+func startDungeonRun(userID int64, dungeon string) (*models.DungeonRun, error) {
+	key, ok := dungeonKeys[dungeon]
+	if !ok {
+		return nil, &apiError{http.StatusBadRequest, "invalid dungeon: easy, medium, hard"}
+	}
+
+	deckID, err := activeDeckID(userID, "dungeon:"+dungeon)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+	cardIDs := []string{}
+	if err == nil {
+		rows, err := db.Pool.Query(context.Background(),
+			`SELECT user_card_id FROM deck_cards WHERE deck_id = $1 ORDER BY slot`, deckID)
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "db error"}
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, &apiError{http.StatusInternalServerError, "scan error"}
+			}
+			cardIDs = append(cardIDs, id)
+		}
+		rows.Close()
+	}
+	if len(cardIDs) == 0 {
+		return nil, &apiError{http.StatusBadRequest, "deck is empty, set your deck first"}
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "tx error"}
+	}
+	defer tx.Rollback(ctx)
+
+	var active bool
+	err = tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM dungeon_runs WHERE user_id = $1 AND status = 'active')`, userID).Scan(&active)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+	if active {
+		return nil, &apiError{http.StatusConflict, "finish or abandon your current dungeon run first"}
+	}
+
+	if err := takeItem(tx, userID, key, 1); err != nil {
+		return nil, err
+	}
+
+	var runID string
+	err = tx.QueryRow(ctx,
+		`INSERT INTO dungeon_runs (user_id, dungeon, floors, card_ids) VALUES ($1, $2, $3, $4) RETURNING id`,
+		userID, dungeon, dungeonFloors[dungeon], cardIDs).Scan(&runID)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+	if err := healRunCards(tx, runID); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+	if err := emit(tx, events.DungeonRunStarted{UserID: userID, RunID: runID, Dungeon: dungeon}); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "event error"}
+	}
+
+	run, err := loadDungeonRun(tx, runID)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "commit error"}
+	}
+	return run, nil
+}
+
+// GetDungeonRun returns a run with its deck's health and the floors fought
+// so far.
+func GetDungeonRun(w http.ResponseWriter, r *http.Request) {
+	run, err := loadDungeonRun(db.Pool, mux.Vars(r)["id"])
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"dungeon run not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, run)
+}
+
+// GetUserDungeonRuns lists a player's runs, newest first. ?status=active
+// finds the run in progress.
+func GetUserDungeonRuns(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	limit, offset := pageParams(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+dungeonRunColumns+` FROM dungeon_runs
+		 WHERE user_id = $1 AND ($2 = '' OR status = $2)
+		 ORDER BY created_at DESC LIMIT $3 OFFSET $4`, userID, status, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	runs := []models.DungeonRun{}
+	for rows.Next() {
+		var run models.DungeonRun
+		if err := scanDungeonRun(rows, &run); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, run)
+	}
+
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// ContinueDungeonRun fights the next floor with the cards still standing.
+// Each cleared floor pays coins; clearing the boss floor also opens the boss
+// chest. Losing a floor ends the run. Cards are healed whenever a run ends.
+func ContinueDungeonRun(w http.ResponseWriter, r *http.Request) {
+	var req DungeonRunActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	floor, err := playDungeonFloor(mux.Vars(r)["id"], req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"run":        floor.run,
+		"battle_id":  floor.battleID,
+		"winner":     floor.battleLog.Winner,
+		"rounds":     floor.battleLog.TotalRounds,
+		"loot":       floor.loot,
+		"battle_log": floor.battleLog,
+	})
+}
+
+// dungeonFloorResult is one floor fought by playDungeonFloor.
+type dungeonFloorResult struct {
+	run       *models.DungeonRun
+	battleID  *string
+	battleLog models.BattleLog
+	loot      []LootResult
+}
+
+// playDungeonFloor does the work of ContinueDungeonRun.
+func playDungeonFloor(runID string, userID int64) (*dungeonFloorResult, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "tx error"}
+	}
+	defer tx.Rollback(ctx)
+
+	run, err := lockActiveDungeonRun(tx, runID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	deck, userCardIDs, err := loadRunDeck(tx, run.ID)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "load deck error"}
+	}
+
+	floor := run.Floor + 1
+	var battleLog models.BattleLog
+	var battleID *string
+	if len(deck) > 0 {
+		enemy, err := dungeonEncounter(run.Dungeon, floor, run.Floors)
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "build encounter error"}
+		}
+
+		battleLog = engine.RunBattleWith(deck, enemy, battleRules("dungeon"))
+		id, _, err := saveBattle(tx, "dungeon", run.UserID, pveOpponentID, deck, enemy, battleLog)
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "save battle error"}
+		}
+		battleID = &id
+
+		if err := saveRunHP(tx, deck, userCardIDs, battleLog); err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "hp update error"}
+		}
+	}
+
+	cleared := battleLog.Winner == "attacker"
+	loot := []LootResult{}
+	status := "active"
+	coins := 0
+	if cleared {
+		coins = floorCoins[run.Dungeon] * floor
+		if err := giveItem(tx, run.UserID, currencyItem, coins); err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "give coins error"}
+		}
+		loot = append(loot, LootResult{Type: "item", ItemID: currencyItem, Amount: coins})
+
+		if floor == run.Floors {
+			status = "cleared"
+			chest, err := rollDungeonLoot(tx, run.UserID, run.Dungeon)
+			if err != nil {
+				return nil, &apiError{http.StatusInternalServerError, "give loot error"}
+			}
+			loot = append(loot, chest...)
+			if err := bumpSeasonStat(tx, run.UserID, "dungeon_clears"); err != nil {
+				return nil, &apiError{http.StatusInternalServerError, "stats update error"}
+			}
+		}
+		err = emit(tx, events.DungeonFloorCleared{
+			UserID:     run.UserID,
+			RunID:      run.ID,
+			Dungeon:    run.Dungeon,
+			Floor:      floor,
+			RunCleared: status == "cleared",
+		})
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "event error"}
+		}
+	} else {
+		status = "failed"
+		floor = run.Floor
+	}
+
+	lootJSON, _ := json.Marshal(loot)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO dungeon_run_floors (run_id, floor, battle_id, cleared, loot) VALUES ($1, $2, $3, $4, $5)`,
+		run.ID, run.Floor+1, battleID, cleared, lootJSON)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+
+	if err := finishDungeonFloor(tx, run.ID, status, floor, coins); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+
+	result, err := loadDungeonRun(tx, run.ID)
+	if err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "db error"}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "commit error"}
+	}
+
+	return &dungeonFloorResult{run: result, battleID: battleID, battleLog: battleLog, loot: loot}, nil
+}
+
+// AbandonDungeonRun gives up on a run. Loot from cleared floors is kept; the
+// key is not refunded.
+func AbandonDungeonRun(w http.ResponseWriter, r *http.Request) {
+	var req DungeonRunActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	run, err := lockActiveDungeonRun(tx, mux.Vars(r)["id"], req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := finishDungeonFloor(tx, run.ID, "abandoned", run.Floor, 0); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := loadDungeonRun(tx, run.ID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func lockActiveDungeonRun(tx pgx.Tx, runID string, userID int64) (*models.DungeonRun, error) {
+	var run models.DungeonRun
+	err := scanDungeonRun(tx.QueryRow(context.Background(),
+		`SELECT `+dungeonRunColumns+` FROM dungeon_runs WHERE id = $1 AND user_id = $2 FOR UPDATE`, runID, userID), &run)
+	if err == pgx.ErrNoRows {
+		return nil, &apiError{http.StatusNotFound, "dungeon run not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if run.Status != "active" {
+		return nil, &apiError{http.StatusConflict, "dungeon run is already " + run.Status}
+	}
+	return &run, nil
+}
+
+// finishDungeonFloor records the run's progress. Once the run is no longer
+// active its cards are healed.
+func finishDungeonFloor(tx pgx.Tx, runID, status string, floor, coins int) error {
+	_, err := tx.Exec(context.Background(),
+		`UPDATE dungeon_runs SET status = $2, floor = $3, coins_earned = coins_earned + $4,
+		        finished_at = CASE WHEN $2 = 'active' THEN NULL ELSE NOW() END
+		 WHERE id = $1`, runID, status, floor, coins)
+	if err != nil {
+		return err
+	}
+	if status == "active" {
+		return nil
+	}
+	return healRunCards(tx, runID)
+}
+
+func healRunCards(q db.Querier, runID string) error {
+	_, err := q.Exec(context.Background(),
+		`UPDATE user_cards uc SET current_hp = cd.base_hp
+		 FROM card_definitions cd, dungeon_runs r
+		 WHERE r.id = $1 AND uc.id = ANY(r.card_ids) AND cd.id = uc.card_id`, runID)
+	return err
+}
+
+// loadRunDeck builds the battle deck for a run's next floor from the cards
+// still alive, at the health they finished the last floor with. It also
+// returns the user_cards id behind each battle card id.
+func loadRunDeck(q db.Querier, runID string) ([]models.BattleCard, map[int64]string, error) {
+	rows, err := q.Query(context.Background(),
+		`SELECT uc.id, uc.card_id, cd.name, uc.current_hp, cd.base_hp, cd.base_damage, cd.rarity, cd.effects, cd.spawns
+		 FROM dungeon_runs r
+		 JOIN user_cards uc ON uc.id = ANY(r.card_ids) AND uc.user_id = r.user_id
+		 JOIN card_definitions cd ON cd.id = uc.card_id
+		 WHERE r.id = $1 AND uc.current_hp > 0
+		 ORDER BY array_position(r.card_ids, uc.id)`, runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var deck []models.BattleCard
+	userCardIDs := map[int64]string{}
+	for rows.Next() {
+		var userCardID, cardID, name, rarity string
+		var currentHP, baseHP, baseDamage int
+		var effectsRaw json.RawMessage
+		var spawns *string
+
+		err := rows.Scan(&userCardID, &cardID, &name, &currentHP, &baseHP, &baseDamage, &rarity, &effectsRaw, &spawns)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var effects []string
+		json.Unmarshal(effectsRaw, &effects)
+		if spawns != nil {
+			effects = append(effects, "spawns:"+*spawns)
+		}
+
+		id := int64(len(deck) + 1)
+		userCardIDs[id] = userCardID
+		deck = append(deck, models.BattleCard{
+			ID:        id,
+			CardID:    cardID,
+			Name:      name,
+			CurrentHP: int16(min(currentHP, baseHP)),
+			MaxHP:     int16(baseHP),
+			Attack:    int16(baseDamage),
+			Rarity:    rarity,
+			Effects:   effects,
+		})
+	}
+	return deck, userCardIDs, rows.Err()
+}
+
+// saveRunHP writes back the health each card ended the battle with. Cards
+// that died are left at 0 and sit out the rest of the run. Health gained
+// in battle (rampage) doesn't carry over.
+func saveRunHP(tx pgx.Tx, deck []models.BattleCard, userCardIDs map[int64]string, battleLog models.BattleLog) error {
+	final := deck
+	if n := len(battleLog.Entries); n > 0 {
+		final = battleLog.Entries[n-1].AttackerDeck
+	}
+	hp := map[int64]int16{}
+	for _, c := range final {
+		hp[c.ID] = c.CurrentHP
+	}
+
+	for _, c := range deck {
+		left := min(max(hp[c.ID], 0), c.MaxHP)
+		_, err := tx.Exec(context.Background(),
+			`UPDATE user_cards SET current_hp = $2 WHERE id = $1`, userCardIDs[c.ID], left)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dungeonEncounter builds the bot deck for a floor. Every floor is
+// dungeonFloorScaling percent stronger than the last, and on the final floor
+// the dungeon's boss (see bosses.go) takes the last place in the line.
+func dungeonEncounter(dungeon string, floor, floors int) ([]models.BattleCard, error) {
+	deck, err := buildBotDeck(botDecks[dungeon])
+	if err != nil {
+		return nil, err
+	}
+
+	pct := 100 + dungeonFloorScaling*(floor-1)
+	for i := range deck {
+		deck[i].MaxHP = engine.ClampStat(int(deck[i].MaxHP) * pct / 100)
+		deck[i].CurrentHP = deck[i].MaxHP
+		deck[i].Attack = engine.ClampStat(int(deck[i].Attack) * pct / 100)
+	}
+	if floor == floors {
+		deck = append(deck[:min(len(deck), engine.MaxDeckSize-1)], dungeonBosses[dungeon].card(pct))
+	}
+	return deck, nil
+}
+
+func loadDungeonRun(q db.Querier, runID string) (*models.DungeonRun, error) {
+	ctx := context.Background()
+
+	var run models.DungeonRun
+	err := scanDungeonRun(q.QueryRow(ctx,
+		`SELECT `+dungeonRunColumns+` FROM dungeon_runs WHERE id = $1`, runID), &run)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(ctx,
+		`SELECT uc.id, uc.card_id, cd.name, COALESCE(uc.current_hp, cd.base_hp), cd.base_hp
+		 FROM dungeon_runs r
+		 JOIN user_cards uc ON uc.id = ANY(r.card_ids) AND uc.user_id = r.user_id
+		 JOIN card_definitions cd ON cd.id = uc.card_id
+		 WHERE r.id = $1
+		 ORDER BY array_position(r.card_ids, uc.id)`, runID)
+	if err != nil {
+		return nil, err
+	}
+	run.Deck = []models.DungeonRunCard{}
+	for rows.Next() {
+		var c models.DungeonRunCard
+		if err := rows.Scan(&c.UserCardID, &c.CardID, &c.Name, &c.CurrentHP, &c.MaxHP); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		run.Deck = append(run.Deck, c)
+	}
+	rows.Close()
+
+	rows, err = q.Query(ctx,
+		`SELECT floor, battle_id, cleared, loot FROM dungeon_run_floors WHERE run_id = $1 ORDER BY floor`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	run.History = []models.DungeonRunFloor{}
+	for rows.Next() {
+		var f models.DungeonRunFloor
+		if err := rows.Scan(&f.Floor, &f.BattleID, &f.Cleared, &f.Loot); err != nil {
+			return nil, err
+		}
+		run.History = append(run.History, f)
+	}
+	return &run, rows.Err()
+}
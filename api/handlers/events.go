@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"imperium/db"
+	"imperium/events"
+)
+
+// emit records an event about a write made through q. The event is written
+// to the outbox alongside the write, for webhooks and reactors, and published
+// on the bus. Inside a transaction publishing waits for the commit, so
+// nothing reacts to changes that get rolled back.
+func emit(q db.Querier, e events.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(context.Background(),
+		`INSERT INTO outbox (event, payload) VALUES ($1, $2)`, e.EventName(), payload)
+	if err != nil {
+		return err
+	}
+
+	published := func() {
+		events.Publish(e)
+		wakeReactors()
+	}
+	if tx, ok := q.(*db.Tx); ok {
+		tx.AfterCommit(published)
+		return nil
+	}
+	published()
+	return nil
+}
+
+// maxReactAttempts is how many times an event's reactors are run before a
+// reactor that keeps failing is given up on.
+const maxReactAttempts = 5
+
+// reactor is game state kept up to date from outbox events (quest progress,
+// achievements). Reactors run in the background once the write is
+// committed, so they can't hold it up or fail it, and unlike bus subscribers
+// they never miss an event: one that fails is retried on the next run. Each
+// reactor handles an event at most once.
+type reactor struct {
+	name   string
+	event  string
+	handle func(tx *db.Tx, payload []byte) error
+}
+
+var reactors []reactor
+
+// react registers fn to be run for every outbox event of type T. Events are
+// decoded from their outbox payload, so fields left out of it are unset.
+func react[T events.Event](name string, fn func(tx *db.Tx, e T) error) {
+	var zero T
+	reactors = append(reactors, reactor{
+		name:  name,
+		event: zero.EventName(),
+		handle: func(tx *db.Tx, payload []byte) error {
+			var e T
+			if err := json.Unmarshal(payload, &e); err != nil {
+				return err
+			}
+			return fn(tx, e)
+		},
+	})
+}
+
+var reactorWake = make(chan struct{}, 1)
+
+func wakeReactors() {
+	select {
+	case reactorWake <- struct{}{}:
+	default:
+	}
+}
+
+// runReactors is the background job that reacts to new outbox events, every
+// few seconds and whenever one is emitted.
+func runReactors() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := reactToOutbox(); err != nil {
+			log.Printf("job react to events: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-reactorWake:
+		}
+	}
+}
+
+// reactToOutbox runs the reactors on the events they haven't handled yet,
+// oldest first. Failures are logged and left for the next run.
+func reactToOutbox() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, event, payload FROM outbox
+		 WHERE reacted_at IS NULL AND react_attempts < $1 ORDER BY id LIMIT 500`, maxReactAttempts)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id      int64
+		event   string
+		payload []byte
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.event, &p.payload); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range todo {
+		failed := false
+		for _, r := range reactors {
+			if r.event != p.event {
+				continue
+			}
+			if err := runReactor(r, p.id, p.payload); err != nil {
+				log.Printf("events: %s handling %s %d: %v", r.name, p.event, p.id, err)
+				failed = true
+			}
+		}
+		query := `UPDATE outbox SET reacted_at = NOW() WHERE id = $1`
+		if failed {
+			query = `UPDATE outbox SET react_attempts = react_attempts + 1 WHERE id = $1`
+		}
+		if _, err := db.Pool.Exec(context.Background(), query, p.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runReactor has one reactor handle one event, in its own transaction,
+// unless it already has.
+func runReactor(r reactor, outboxID int64, payload []byte) error {
+	return inTx(func(tx *db.Tx) error {
+		tag, err := tx.Exec(context.Background(),
+			`INSERT INTO outbox_reactions (outbox_id, reactor) VALUES ($1, $2)
+			 ON CONFLICT (outbox_id, reactor) DO NOTHING`, outboxID, r.name)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		return r.handle(tx, payload)
+	})
+}
+
+// RegisterSubscribers hooks the game's features up to game events. Call it
+// once at startup.
+func RegisterSubscribers() {
+	reactQuests()
+	reactAchievements()
+	subscribeNotifications()
+}
+
+// inTx runs fn in a transaction, committing if it succeeds.
+func inTx(fn func(tx *db.Tx) error) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+)
+
+type FriendRequest struct {
+	FriendID int64 `json:"friend_id"`
+}
+
+// GetFriends lists a player's friends and pending requests in both
+// directions.
+func GetFriends(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT u.id, COALESCE(u.username, ''), u.rating, f.status,
+		        CASE WHEN f.status = 'accepted' THEN ''
+		             WHEN f.requester_id = $1 THEN 'outgoing' ELSE 'incoming' END,
+		        f.created_at, f.accepted_at
+		 FROM friendships f
+		 JOIN users u ON u.id = CASE WHEN f.requester_id = $1 THEN f.addressee_id ELSE f.requester_id END
+		 WHERE f.requester_id = $1 OR f.addressee_id = $1
+		 ORDER BY f.status, u.username`, userID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	friends := []models.Friend{}
+	for rows.Next() {
+		var f models.Friend
+		if err := rows.Scan(&f.UserID, &f.Username, &f.Rating, &f.Status, &f.Direction, &f.CreatedAt, &f.AcceptedAt); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		friends = append(friends, f)
+	}
+
+	writeJSON(w, http.StatusOK, friends)
+}
+
+// SendFriendRequest asks another player to be friends. If they already asked
+// first, the two become friends straight away.
+func SendFriendRequest(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req FriendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.FriendID == userID {
+		http.Error(w, `{"error":"cannot befriend yourself"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE friendships SET status = 'accepted', accepted_at = NOW()
+		 WHERE requester_id = $2 AND addressee_id = $1 AND status = 'pending'`, userID, req.FriendID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	status, kind := "accepted", "friend_accepted"
+	if tag.RowsAffected() == 0 {
+		status, kind = "pending", "friend_request"
+		tag, err = tx.Exec(ctx,
+			`INSERT INTO friendships (requester_id, addressee_id)
+			 SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM users WHERE id = $2)
+			 ON CONFLICT DO NOTHING`, userID, req.FriendID)
+		if err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			http.Error(w, `{"error":"user not found or request already exists"}`, http.StatusConflict)
+			return
+		}
+	}
+
+	if err := notify(tx, req.FriendID, kind, map[string]interface{}{"user_id": userID}); err != nil {
+		http.Error(w, `{"error":"notify error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+func AcceptFriendRequest(w http.ResponseWriter, r *http.Request) {
+	userID, friendID, ok := friendPathIDs(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE friendships SET status = 'accepted', accepted_at = NOW()
+		 WHERE requester_id = $2 AND addressee_id = $1 AND status = 'pending'`, userID, friendID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, `{"error":"no pending request from this user"}`, http.StatusNotFound)
+		return
+	}
+
+	if err := notify(tx, friendID, "friend_accepted", map[string]interface{}{"user_id": userID}); err != nil {
+		http.Error(w, `{"error":"notify error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "accepted"})
+}
+
+// RemoveFriend unfriends a player. It also declines or cancels a pending
+// request between the two.
+func RemoveFriend(w http.ResponseWriter, r *http.Request) {
+	userID, friendID, ok := friendPathIDs(w, r)
+	if !ok {
+		return
+	}
+
+	tag, err := db.Pool.Exec(context.Background(),
+		`DELETE FROM friendships
+		 WHERE (requester_id = $1 AND addressee_id = $2) OR (requester_id = $2 AND addressee_id = $1)`,
+		userID, friendID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, `{"error":"not friends"}`, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+func friendPathIDs(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	vars := mux.Vars(r)
+	userID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	friendID, err := strconv.ParseInt(vars["friend_id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid friend id"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return userID, friendID, true
+}
+
+func areFriends(q db.Querier, a, b int64) (bool, error) {
+	var ok bool
+	err := q.QueryRow(context.Background(),
+		`SELECT EXISTS (SELECT 1 FROM friendships
+		                WHERE status = 'accepted'
+		                  AND ((requester_id = $1 AND addressee_id = $2) OR (requester_id = $2 AND addressee_id = $1)))`,
+		a, b).Scan(&ok)
+	return ok, err
+}
+
+// BattleFriendly fights a friend's defense deck with the attacker's deck like
+// a PvP battle, but nothing is at stake: ratings, season stats and rewards are
+// left alone and the battle is stored with mode "friendly".
+func BattleFriendly(w http.ResponseWriter, r *http.Request) {
+	var req PvPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	friends, err := areFriends(db.Pool, req.AttackerID, req.DefenderID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !friends {
+		http.Error(w, `{"error":"you can only spar with friends"}`, http.StatusForbidden)
+		return
+	}
+
+	attackerDeck, defenderDeck, err := loadPvPDecks(req.AttackerID, req.DefenderID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	battleLog := engine.RunBattleWith(attackerDeck, defenderDeck, battleRules("friendly"))
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	battleID, _, err := saveBattle(tx, "friendly", req.AttackerID, req.DefenderID, attackerDeck, defenderDeck, battleLog)
+	if err != nil {
+		http.Error(w, `{"error":"save battle error"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"battle_id":   battleID,
+		"attacker_id": req.AttackerID,
+		"defender_id": req.DefenderID,
+		"winner":      battleLog.Winner,
+		"rounds":      battleLog.TotalRounds,
+		"battle_log":  battleLog,
+	})
+}
@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// guildWarMinMembers is how many members a guild needs to be drawn into
+	// a war.
+	guildWarMinMembers = 3
+	// guildWarInterval is how often a guild is drawn into a new war.
+	guildWarInterval = 7 * 24 * time.Hour
+	// guildWarDuration is how long members have to tune their defense decks
+	// between a war opening and its pairings being fought.
+	guildWarDuration = 24 * time.Hour
+	// guildWarWinPoints is added to a pairing winner's remaining cards.
+	guildWarWinPoints = 10
+)
+
+const guildWarColumns = `w.id, w.guild_a, w.guild_b, ga.name, gb.name, w.status, w.score_a, w.score_b,
+	w.winner_guild, w.starts_at, w.ends_at, w.finished_at`
+
+const guildWarFrom = `guild_wars w JOIN guilds ga ON ga.id = w.guild_a JOIN guilds gb ON gb.id = w.guild_b`
+
+func scanGuildWar(row pgx.Row, war *models.GuildWar) error {
+	return row.Scan(&war.ID, &war.GuildA, &war.GuildB, &war.GuildAName, &war.GuildBName, &war.Status,
+		&war.ScoreA, &war.ScoreB, &war.WinnerGuild, &war.StartsAt, &war.EndsAt, &war.FinishedAt)
+}
+
+func GetGuildWars(w http.ResponseWriter, r *http.Request) {
+	guildID := mux.Vars(r)["id"]
+	limit, offset := pageParams(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+guildWarColumns+` FROM `+guildWarFrom+`
+		 WHERE w.guild_a = $1 OR w.guild_b = $1
+		 ORDER BY w.starts_at DESC LIMIT $2 OFFSET $3`, guildID, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	wars := []models.GuildWar{}
+	for rows.Next() {
+		var war models.GuildWar
+		if err := scanGuildWar(rows, &war); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		wars = append(wars, war)
+	}
+
+	writeJSON(w, http.StatusOK, wars)
+}
+
+// GetGuildWar returns a war with its pairings, linking each fought pairing to
+// its battle replay.
+func GetGuildWar(w http.ResponseWriter, r *http.Request) {
+	warID := mux.Vars(r)["id"]
+
+	var war models.GuildWar
+	err := scanGuildWar(db.Pool.QueryRow(context.Background(),
+		`SELECT `+guildWarColumns+` FROM `+guildWarFrom+` WHERE w.id = $1`, warID), &war)
+	if err != nil {
+		http.Error(w, `{"error":"guild war not found"}`, http.StatusNotFound)
+		return
+	}
+
+	pairings, err := loadGuildWarPairings(db.Pool, warID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range pairings {
+		if pairings[i].BattleID != nil {
+			pairings[i].ReplayURL = "/battle/" + *pairings[i].BattleID
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"war":      war,
+		"pairings": pairings,
+	})
+}
+
+func loadGuildWarPairings(q db.Querier, warID string) ([]models.GuildWarPairing, error) {
+	rows, err := q.Query(context.Background(),
+		`SELECT position, member_a, member_b, battle_id, winner_id, score_a, score_b
+		 FROM guild_war_pairings WHERE war_id = $1 ORDER BY position`, warID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pairings := []models.GuildWarPairing{}
+	for rows.Next() {
+		var p models.GuildWarPairing
+		if err := rows.Scan(&p.Position, &p.MemberA, &p.MemberB, &p.BattleID, &p.WinnerID, &p.ScoreA, &p.ScoreB); err != nil {
+			return nil, err
+		}
+		pairings = append(pairings, p)
+	}
+	return pairings, rows.Err()
+}
+
+// openGuildWars is the background job that draws guilds into wars. Eligible
+// guilds are those with enough members and no war in the last
+// guildWarInterval; they are ordered by average rating and paired with their
+// neighbour.
+func openGuildWars() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT g.id FROM guilds g
+		 JOIN guild_members gm ON gm.guild_id = g.id
+		 JOIN users u ON u.id = gm.user_id
+		 WHERE NOT EXISTS (
+		     SELECT 1 FROM guild_wars w
+		     WHERE (w.guild_a = g.id OR w.guild_b = g.id)
+		       AND (w.status = 'open' OR w.starts_at > NOW() - $2 * INTERVAL '1 second'))
+		 GROUP BY g.id
+		 HAVING COUNT(*) >= $1
+		 ORDER BY AVG(u.rating) DESC, g.id`, guildWarMinMembers, int(guildWarInterval.Seconds()))
+	if err != nil {
+		return err
+	}
+	var guildIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		guildIDs = append(guildIDs, id)
+	}
+	rows.Close()
+
+	for i := 0; i+1 < len(guildIDs); i += 2 {
+		if err := openGuildWar(guildIDs[i], guildIDs[i+1]); err != nil {
+			return fmt.Errorf("guild war %s vs %s: %w", guildIDs[i], guildIDs[i+1], err)
+		}
+	}
+	return nil
+}
+
+// openGuildWar creates a war and pairs the two rosters by rating, strongest
+// against strongest. Members beyond the smaller roster sit the war out.
+func openGuildWar(guildA, guildB string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rosterA, err := guildWarRoster(tx, guildA)
+	if err != nil {
+		return err
+	}
+	rosterB, err := guildWarRoster(tx, guildB)
+	if err != nil {
+		return err
+	}
+
+	var warID string
+	err = tx.QueryRow(ctx,
+		`INSERT INTO guild_wars (guild_a, guild_b, ends_at)
+		 VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second') RETURNING id`,
+		guildA, guildB, int(guildWarDuration.Seconds())).Scan(&warID)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(rosterA) && i < len(rosterB); i++ {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO guild_war_pairings (war_id, position, member_a, member_b) VALUES ($1, $2, $3, $4)`,
+			warID, i+1, rosterA[i], rosterB[i])
+		if err != nil {
+			return err
+		}
+		for _, p := range [][2]int64{{rosterA[i], rosterB[i]}, {rosterB[i], rosterA[i]}} {
+			err := notify(tx, p[0], "guild_war_started", map[string]interface{}{
+				"war_id":      warID,
+				"opponent_id": p[1],
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func guildWarRoster(tx pgx.Tx, guildID string) ([]int64, error) {
+	rows, err := tx.Query(context.Background(),
+		`SELECT gm.user_id FROM guild_members gm JOIN users u ON u.id = gm.user_id
+		 WHERE gm.guild_id = $1
+		 ORDER BY u.rating DESC, gm.joined_at`, guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roster []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		roster = append(roster, id)
+	}
+	return roster, rows.Err()
+}
+
+// closeGuildWars is the background job that fights the pairings of wars
+// whose window has ended and records the result.
+func closeGuildWars() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id FROM guild_wars WHERE status = 'open' AND ends_at <= NOW() ORDER BY ends_at`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := closeGuildWar(id); err != nil {
+			return fmt.Errorf("guild war %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// closeGuildWar fights every pairing with both members' current defense
+// decks. Each side of a pairing scores its remaining cards, and the winner
+// gets guildWarWinPoints on top. A member without a defense deck forfeits.
+func closeGuildWar(warID string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var war models.GuildWar
+	err = scanGuildWar(tx.QueryRow(ctx,
+		`SELECT `+guildWarColumns+` FROM `+guildWarFrom+`
+		 WHERE w.id = $1 AND w.status = 'open' FOR UPDATE OF w`, warID), &war)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pairings, err := loadGuildWarPairings(tx, warID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pairings {
+		deckA, err := loadActiveDeck(p.MemberA, "defense")
+		if err != nil {
+			return err
+		}
+		deckB, err := loadActiveDeck(p.MemberB, "defense")
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(deckA) > 0 && len(deckB) > 0:
+			battleLog := engine.RunBattleWith(deckA, deckB, battleRules("guild_war"))
+			battleID, winnerID, err := saveBattle(tx, "guild_war", p.MemberA, p.MemberB, deckA, deckB, battleLog)
+			if err != nil {
+				return err
+			}
+			p.BattleID = &battleID
+			p.WinnerID = winnerID
+			p.ScoreA = battleLog.AttackerRemaining
+			p.ScoreB = battleLog.DefenderRemaining
+		case len(deckA) > 0:
+			p.WinnerID = &p.MemberA
+		case len(deckB) > 0:
+			p.WinnerID = &p.MemberB
+		}
+		if p.WinnerID != nil && *p.WinnerID == p.MemberA {
+			p.ScoreA += guildWarWinPoints
+		} else if p.WinnerID != nil {
+			p.ScoreB += guildWarWinPoints
+		}
+
+		_, err = tx.Exec(ctx,
+			`UPDATE guild_war_pairings SET battle_id = $3, winner_id = $4, score_a = $5, score_b = $6, resolved_at = NOW()
+			 WHERE war_id = $1 AND position = $2`,
+			warID, p.Position, p.BattleID, p.WinnerID, p.ScoreA, p.ScoreB)
+		if err != nil {
+			return err
+		}
+		war.ScoreA += p.ScoreA
+		war.ScoreB += p.ScoreB
+	}
+
+	switch {
+	case war.ScoreA > war.ScoreB:
+		war.WinnerGuild = &war.GuildA
+	case war.ScoreB > war.ScoreA:
+		war.WinnerGuild = &war.GuildB
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE guild_wars SET status = 'finished', score_a = $2, score_b = $3, winner_guild = $4, finished_at = NOW()
+		 WHERE id = $1`, warID, war.ScoreA, war.ScoreB, war.WinnerGuild)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pairings {
+		for _, userID := range []int64{p.MemberA, p.MemberB} {
+			err := notify(tx, userID, "guild_war_finished", map[string]interface{}{
+				"war_id":       warID,
+				"score_a":      war.ScoreA,
+				"score_b":      war.ScoreB,
+				"winner_guild": war.WinnerGuild,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,505 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"imperium/db"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// guildRoleRank orders roles by authority.
+var guildRoleRank = map[string]int{
+	"member":  1,
+	"officer": 2,
+	"leader":  3,
+}
+
+type CreateGuildRequest struct {
+	UserID      int64  `json:"user_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type GuildMemberRequest struct {
+	UserID   int64 `json:"user_id"`
+	TargetID int64 `json:"target_id"`
+}
+
+type SetGuildRoleRequest struct {
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type ContributeRequest struct {
+	UserID int64 `json:"user_id"`
+	Amount int   `json:"amount"`
+}
+
+const guildColumns = `g.id, g.name, g.description, g.member_cap,
+	(SELECT COUNT(*) FROM guild_members gm WHERE gm.guild_id = g.id), g.treasury, g.created_at`
+
+func scanGuild(row pgx.Row, g *models.Guild) error {
+	return row.Scan(&g.ID, &g.Name, &g.Description, &g.MemberCap, &g.MemberCount, &g.Treasury, &g.CreatedAt)
+}
+
+// CreateGuild founds a guild with the caller as its leader.
+func CreateGuild(w http.ResponseWriter, r *http.Request) {
+	var req CreateGuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Name) > 32 {
+		http.Error(w, `{"error":"name must be 1-32 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var g models.Guild
+	err = tx.QueryRow(ctx,
+		`INSERT INTO guilds (name, description) VALUES ($1, $2)
+		 ON CONFLICT (name) DO NOTHING
+		 RETURNING id, name, description, member_cap, treasury, created_at`,
+		req.Name, req.Description).Scan(&g.ID, &g.Name, &g.Description, &g.MemberCap, &g.Treasury, &g.CreatedAt)
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"guild name taken"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := addGuildMember(tx, g.ID, req.UserID, "leader"); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.MemberCount = 1
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, g)
+}
+
+func GetGuilds(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+guildColumns+` FROM guilds g ORDER BY g.created_at LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	guilds := []models.Guild{}
+	for rows.Next() {
+		var g models.Guild
+		if err := scanGuild(rows, &g); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		guilds = append(guilds, g)
+	}
+
+	writeJSON(w, http.StatusOK, guilds)
+}
+
+// GetGuild returns a guild with its members and stats aggregated from the
+// battles members fought since joining.
+func GetGuild(w http.ResponseWriter, r *http.Request) {
+	guildID := mux.Vars(r)["id"]
+
+	var g models.Guild
+	err := scanGuild(db.Pool.QueryRow(context.Background(),
+		`SELECT `+guildColumns+` FROM guilds g WHERE g.id = $1`, guildID), &g)
+	if err != nil {
+		http.Error(w, `{"error":"guild not found"}`, http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT gm.user_id, COALESCE(u.username, ''), gm.role,
+		        COALESCE((SELECT SUM(amount) FROM guild_contributions gc
+		                  WHERE gc.guild_id = gm.guild_id AND gc.user_id = gm.user_id), 0),
+		        gm.joined_at
+		 FROM guild_members gm JOIN users u ON u.id = gm.user_id
+		 WHERE gm.guild_id = $1
+		 ORDER BY CASE gm.role WHEN 'leader' THEN 0 WHEN 'officer' THEN 1 ELSE 2 END, gm.joined_at`, guildID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	members := []models.GuildMember{}
+	for rows.Next() {
+		var m models.GuildMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.Contributed, &m.JoinedAt); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+
+	stats, err := guildStats(guildID)
+	if err != nil {
+		http.Error(w, `{"error":"stats error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"guild":   g,
+		"members": members,
+		"stats":   stats,
+	})
+}
+
+func guildStats(guildID string) (*models.GuildStats, error) {
+	var s models.GuildStats
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT COUNT(*),
+		        COUNT(*) FILTER (WHERE b.winner_id = gm.user_id),
+		        COUNT(*) FILTER (WHERE b.winner_side = 'tie'),
+		        COUNT(*) FILTER (WHERE b.winner_id = gm.user_id AND b.mode = 'pvp'),
+		        COUNT(*) FILTER (WHERE b.winner_id = gm.user_id AND b.mode = 'pve')
+		 FROM guild_members gm
+		 JOIN battles b ON (b.attacker_id = gm.user_id OR b.defender_id = gm.user_id) AND b.created_at >= gm.joined_at
+		 WHERE gm.guild_id = $1`, guildID).Scan(&s.Battles, &s.Wins, &s.Ties, &s.PvPWins, &s.PvEWins)
+	if err != nil {
+		return nil, err
+	}
+	s.Losses = s.Battles - s.Wins - s.Ties
+	if s.Battles > 0 {
+		s.WinRate = float64(s.Wins) / float64(s.Battles)
+	}
+
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT COALESCE(AVG(u.rating), 0),
+		        COALESCE((SELECT SUM(s.kills) FROM battle_card_stats s
+		                  JOIN battles b ON b.id = s.battle_id
+		                  JOIN guild_members m ON m.user_id = s.user_id
+		                  WHERE m.guild_id = $1 AND b.created_at >= m.joined_at), 0)
+		 FROM guild_members gm JOIN users u ON u.id = gm.user_id
+		 WHERE gm.guild_id = $1`, guildID).Scan(&s.AvgRating, &s.TotalKills)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func JoinGuild(w http.ResponseWriter, r *http.Request) {
+	var req GuildMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	guildID := mux.Vars(r)["id"]
+	var memberCap, members int
+	err = tx.QueryRow(ctx,
+		`SELECT member_cap, (SELECT COUNT(*) FROM guild_members WHERE guild_id = g.id)
+		 FROM guilds g WHERE id = $1 FOR UPDATE`, guildID).Scan(&memberCap, &members)
+	if err != nil {
+		http.Error(w, `{"error":"guild not found"}`, http.StatusNotFound)
+		return
+	}
+	if members >= memberCap {
+		http.Error(w, `{"error":"guild is full"}`, http.StatusConflict)
+		return
+	}
+
+	if err := addGuildMember(tx, guildID, req.UserID, "member"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// LeaveGuild removes the caller from their guild. A leaving leader hands over
+// to the longest-serving officer, or member if there are none; the last
+// member leaving disbands the guild.
+func LeaveGuild(w http.ResponseWriter, r *http.Request) {
+	var req GuildMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	guildID := mux.Vars(r)["id"]
+	role, err := guildRole(tx, guildID, req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM guild_members WHERE user_id = $1`, req.UserID); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	status := "left"
+	if role == "leader" {
+		tag, err := tx.Exec(ctx,
+			`UPDATE guild_members SET role = 'leader'
+			 WHERE user_id = (SELECT user_id FROM guild_members WHERE guild_id = $1
+			                  ORDER BY CASE role WHEN 'officer' THEN 0 ELSE 1 END, joined_at LIMIT 1)`, guildID)
+		if err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			if _, err := tx.Exec(ctx, `DELETE FROM guilds WHERE id = $1`, guildID); err != nil {
+				http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+				return
+			}
+			status = "disbanded"
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// KickGuildMember lets a leader or officer remove someone of lower rank.
+func KickGuildMember(w http.ResponseWriter, r *http.Request) {
+	var req GuildMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	guildID := mux.Vars(r)["id"]
+	actorRole, err := guildRole(tx, guildID, req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	targetRole, err := guildRole(tx, guildID, req.TargetID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if actorRole == "member" || guildRoleRank[targetRole] >= guildRoleRank[actorRole] {
+		http.Error(w, `{"error":"not allowed"}`, http.StatusForbidden)
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM guild_members WHERE user_id = $1`, req.TargetID); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// SetGuildRole lets the leader promote or demote a member. Making someone
+// leader hands leadership over and turns the old leader into an officer.
+func SetGuildRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, err := strconv.ParseInt(vars["user_id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req SetGuildRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if _, ok := guildRoleRank[req.Role]; !ok {
+		http.Error(w, `{"error":"role must be leader, officer or member"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	guildID := vars["id"]
+	actorRole, err := guildRole(tx, guildID, req.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := guildRole(tx, guildID, targetID); err != nil {
+		writeError(w, err)
+		return
+	}
+	if actorRole != "leader" || targetID == req.UserID {
+		http.Error(w, `{"error":"only the leader can change other members' roles"}`, http.StatusForbidden)
+		return
+	}
+
+	if req.Role == "leader" {
+		if _, err := tx.Exec(ctx, `UPDATE guild_members SET role = 'officer' WHERE user_id = $1`, req.UserID); err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE guild_members SET role = $2 WHERE user_id = $1`, targetID, req.Role); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ContributeToGuild moves coins from a member's wallet into the guild
+// treasury.
+func ContributeToGuild(w http.ResponseWriter, r *http.Request) {
+	var req ContributeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Amount <= 0 {
+		http.Error(w, `{"error":"amount must be positive"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	guildID := mux.Vars(r)["id"]
+	if _, err := guildRole(tx, guildID, req.UserID); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := takeItem(tx, req.UserID, currencyItem, req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var treasury int
+	err = tx.QueryRow(ctx,
+		`UPDATE guilds SET treasury = treasury + $2 WHERE id = $1 RETURNING treasury`, guildID, req.Amount).Scan(&treasury)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO guild_contributions (guild_id, user_id, amount) VALUES ($1, $2, $3)`, guildID, req.UserID, req.Amount)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "treasury": treasury})
+}
+
+func addGuildMember(q db.Querier, guildID string, userID int64, role string) error {
+	tag, err := q.Exec(context.Background(),
+		`INSERT INTO guild_members (user_id, guild_id, role)
+		 SELECT $1, $2, $3 WHERE EXISTS (SELECT 1 FROM users WHERE id = $1)
+		 ON CONFLICT (user_id) DO NOTHING`, userID, guildID, role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &apiError{http.StatusConflict, "user not found or already in a guild"}
+	}
+	return nil
+}
+
+// guildRole returns a user's role in the guild, locking their membership row.
+func guildRole(q db.Querier, guildID string, userID int64) (string, error) {
+	var role string
+	err := q.QueryRow(context.Background(),
+		`SELECT role FROM guild_members WHERE guild_id = $1 AND user_id = $2 FOR UPDATE`, guildID, userID).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", &apiError{http.StatusNotFound, "not a member of this guild"}
+	}
+	return role, err
+}
+
+// guildMembership returns the guild a user belongs to, or nil.
+func guildMembership(q db.Querier, userID int64) (*models.GuildMembership, error) {
+	var m models.GuildMembership
+	err := q.QueryRow(context.Background(),
+		`SELECT g.id, g.name, gm.role, gm.joined_at
+		 FROM guild_members gm JOIN guilds g ON g.id = gm.guild_id
+		 WHERE gm.user_id = $1`, userID).Scan(&m.GuildID, &m.Name, &m.Role, &m.JoinedAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
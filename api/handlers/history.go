@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imperium/battlelog"
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+)
+
+// battleFilter holds the filters shared by the history and stats endpoints.
+type battleFilter struct {
+	userID     int64
+	mode       string
+	result     string
+	opponentID int64
+	from, to   *time.Time
+}
+
+func parseBattleFilter(r *http.Request) (*battleFilter, error) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, "invalid user id"}
+	}
+	q := r.URL.Query()
+	f := &battleFilter{userID: userID, mode: q.Get("mode"), result: q.Get("result")}
+
+	switch f.result {
+	case "", "won", "lost", "tie":
+	default:
+		return nil, &apiError{http.StatusBadRequest, "result must be won, lost or tie"}
+	}
+	if v := q.Get("opponent"); v != "" {
+		if f.opponentID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, &apiError{http.StatusBadRequest, "invalid opponent"}
+		}
+	}
+	for name, dst := range map[string]**time.Time{"from": &f.from, "to": &f.to} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, &apiError{http.StatusBadRequest, name + " must be an RFC3339 time"}
+			}
+			*dst = &t
+		}
+	}
+	return f, nil
+}
+
+// where builds the WHERE clause for the filter over battles aliased as b.
+// The user's side is exposed as the SQL expression in side.
+func (f *battleFilter) where() (string, []any) {
+	args := []any{f.userID}
+	conds := []string{"(b.attacker_id = $1 OR b.defender_id = $1)"}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.mode != "" {
+		add("b.mode = $%d", f.mode)
+	}
+	switch f.result {
+	case "won":
+		conds = append(conds, "b.winner_side = "+battleSide)
+	case "lost":
+		conds = append(conds, "b.winner_side NOT IN ('tie', "+battleSide+")")
+	case "tie":
+		conds = append(conds, "b.winner_side = 'tie'")
+	}
+	if f.opponentID != 0 {
+		add("(CASE WHEN b.attacker_id = $1 THEN b.defender_id ELSE b.attacker_id END) = $%d", f.opponentID)
+	}
+	if f.from != nil {
+		add("b.created_at >= $%d", *f.from)
+	}
+	if f.to != nil {
+		add("b.created_at < $%d", *f.to)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// battleSide is the side the filtered user fought on.
+const battleSide = "(CASE WHEN b.attacker_id = $1 THEN 'attacker' ELSE 'defender' END)"
+
+// GetUserBattles lists a player's battles, newest first, with cursor
+// pagination.
+func GetUserBattles(w http.ResponseWriter, r *http.Request) {
+	f, err := parseBattleFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit, _ := pageParams(r)
+
+	where, args := f.where()
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		createdAt, id, err := decodeBattleCursor(cursor)
+		if err != nil {
+			http.Error(w, `{"error":"invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		args = append(args, createdAt, id)
+		where += fmt.Sprintf(" AND (b.created_at, b.id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT b.id, b.mode, b.attacker_id, b.defender_id, b.winner_id, `+battleSide+`,
+		        COALESCE(b.winner_side, 'tie'), COALESCE(b.rounds, 0), b.created_at
+		 FROM battles b
+		 WHERE `+where+`
+		 ORDER BY b.created_at DESC, b.id DESC
+		 LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	battles := []models.BattleSummary{}
+	for rows.Next() {
+		var b models.BattleSummary
+		var winnerSide string
+		if err := rows.Scan(&b.ID, &b.Mode, &b.AttackerID, &b.DefenderID, &b.WinnerID, &b.Side,
+			&winnerSide, &b.Rounds, &b.CreatedAt); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		switch winnerSide {
+		case "tie":
+			b.Result = "tie"
+		case b.Side:
+			b.Result = "won"
+		default:
+			b.Result = "lost"
+		}
+		if b.Side == "attacker" {
+			if b.DefenderID != nil && *b.DefenderID > 0 {
+				b.OpponentID = b.DefenderID
+			}
+		} else {
+			b.OpponentID = &b.AttackerID
+		}
+		battles = append(battles, b)
+	}
+
+	resp := map[string]interface{}{"battles": battles}
+	if len(battles) > limit {
+		last := battles[limit-1]
+		resp["battles"] = battles[:limit]
+		resp["next_cursor"] = encodeBattleCursor(last.CreatedAt, last.ID)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetUserBattleStats aggregates a player's battles matching the same filters
+// as GetUserBattles. Card stats come from battle_card_stats rather than the
+// stored logs.
+func GetUserBattleStats(w http.ResponseWriter, r *http.Request) {
+	f, err := parseBattleFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	where, args := f.where()
+
+	var total, wins, ties int
+	var avgRounds float64
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT COUNT(*),
+		        COUNT(*) FILTER (WHERE b.winner_side = `+battleSide+`),
+		        COUNT(*) FILTER (WHERE b.winner_side = 'tie'),
+		        COALESCE(AVG(b.rounds), 0)
+		 FROM battles b WHERE `+where, args...).Scan(&total, &wins, &ties, &avgRounds)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	winRate := 0.0
+	if total > 0 {
+		winRate = float64(wins) / float64(total)
+	}
+
+	type cardUsage struct {
+		CardID      string `json:"card_id"`
+		Battles     int    `json:"battles"`
+		DamageDealt int    `json:"damage_dealt"`
+		Kills       int    `json:"kills"`
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT s.card_id,
+		        COUNT(*) FILTER (WHERE s.copies > 0),
+		        SUM(s.damage_dealt), SUM(s.kills)
+		 FROM battle_card_stats s JOIN battles b ON b.id = s.battle_id
+		 WHERE s.user_id = $1 AND `+where+`
+		 GROUP BY s.card_id`, args...)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var cards []cardUsage
+	for rows.Next() {
+		var c cardUsage
+		if err := rows.Scan(&c.CardID, &c.Battles, &c.DamageDealt, &c.Kills); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		cards = append(cards, c)
+	}
+
+	mostUsed := []cardUsage{}
+	var deadliest *cardUsage
+	for i := range cards {
+		c := cards[i]
+		if c.Battles > 0 {
+			mostUsed = append(mostUsed, c)
+		}
+		if deadliest == nil || c.Kills > deadliest.Kills ||
+			(c.Kills == deadliest.Kills && c.DamageDealt > deadliest.DamageDealt) {
+			deadliest = &cards[i]
+		}
+	}
+	sort.Slice(mostUsed, func(i, j int) bool {
+		if mostUsed[i].Battles != mostUsed[j].Battles {
+			return mostUsed[i].Battles > mostUsed[j].Battles
+		}
+		return mostUsed[i].CardID < mostUsed[j].CardID
+	})
+	if len(mostUsed) > 5 {
+		mostUsed = mostUsed[:5]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":           total,
+		"wins":            wins,
+		"losses":          total - wins - ties,
+		"ties":            ties,
+		"win_rate":        winRate,
+		"avg_rounds":      avgRounds,
+		"most_used_cards": mostUsed,
+		"deadliest_card":  deadliest,
+	})
+}
+
+func encodeBattleCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeBattleCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", fmt.Errorf("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return createdAt, parts[1], nil
+}
+
+// backfillBattleStats fills battle_card_stats for battles stored before the
+// table existed, a batch at a time. Those battles have no starting decks, so
+// card stats come from the log's snapshots only. Battles whose log can't be
+// decoded are skipped.
+func backfillBattleStats() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, attacker_id, defender_id, battle_log FROM battles
+		 WHERE NOT stats_indexed ORDER BY created_at LIMIT 200`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id                     string
+		attackerID, defenderID int64
+		log                    models.BattleLog
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		var defenderID *int64
+		var logRaw json.RawMessage
+		if err := rows.Scan(&p.id, &p.attackerID, &defenderID, &logRaw); err != nil {
+			rows.Close()
+			return err
+		}
+		if defenderID != nil {
+			p.defenderID = *defenderID
+		}
+		if logRaw != nil {
+			if p.log, err = battlelog.Decode(logRaw); err != nil {
+				log.Printf("backfill battle stats: battle %s: %v", p.id, err)
+				p.log = models.BattleLog{}
+			}
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+
+	for _, p := range todo {
+		stats := engine.CardStats(nil, nil, p.log)
+		if err := saveCardStats(db.Pool, p.id, p.attackerID, p.defenderID, stats); err != nil {
+			return err
+		}
+		if _, err := db.Pool.Exec(context.Background(),
+			`UPDATE battles SET stats_indexed = TRUE WHERE id = $1`, p.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
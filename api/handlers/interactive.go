@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Interactive battles are played turn by turn over a WebSocket: each side
+// picks its moves, and a side that runs out of time (or isn't connected) has
+// the turn played for it the way RunBattle would. The server runs the
+// engine, so only valid moves are played, and the finished battle is stored
+// like any other.
+const (
+	interactiveTurnTimeout = 20 * time.Second
+	// interactiveJoinTimeout is how long a battle waits for both players to
+	// connect before starting with whoever is there. A rated battle the
+	// defender never joins is called off instead, so nobody is laddered
+	// against an empty chair.
+	interactiveJoinTimeout = 60 * time.Second
+)
+
+type InteractiveBattleRequest struct {
+	AttackerID int64 `json:"attacker_id"`
+	DefenderID int64 `json:"defender_id"`
+	// Mode is "pvp" (rated, the default) or "friendly".
+	Mode string `json:"mode"`
+}
+
+// interactiveMessage is everything sent over the socket, both ways. Clients
+// send {"type":"move", ...} with the move fields, or {"type":"auto"} to let
+// the engine play their turn.
+type interactiveMessage struct {
+	Type string `json:"type"`
+	engine.Move
+
+	Side          string                 `json:"side,omitempty"`
+	Round         int                    `json:"round,omitempty"`
+	Deadline      *time.Time             `json:"deadline,omitempty"`
+	Options       *engine.TurnOptions    `json:"options,omitempty"`
+	AttackerDeck  []models.BattleCard    `json:"attacker_deck,omitempty"`
+	DefenderDeck  []models.BattleCard    `json:"defender_deck,omitempty"`
+	Entry         *models.BattleLogEntry `json:"entry,omitempty"`
+	TimedOut      bool                   `json:"timed_out,omitempty"`
+	BattleID      string                 `json:"battle_id,omitempty"`
+	Winner        string                 `json:"winner,omitempty"`
+	Rounds        int                    `json:"rounds,omitempty"`
+	TurnTimeoutMs int64                  `json:"turn_timeout_ms,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+}
+
+// playerInput is a move (or a request to auto-play) from one side. Leaving
+// the battle counts as asking for auto-play. round is the round it was sent
+// in; inputs left over from an earlier round are dropped.
+type playerInput struct {
+	side  string
+	round int
+	move  engine.Move
+	auto  bool
+}
+
+type interactiveBattle struct {
+	id           string
+	mode         string
+	attackerID   int64
+	defenderID   int64
+	attackerDeck []models.BattleCard
+	defenderDeck []models.BattleCard
+	battle       *engine.Battle
+
+	mu     sync.Mutex
+	conns  map[string]*websocket.Conn
+	joined chan struct{}
+	inputs chan playerInput
+	done   chan struct{}
+}
+
+var (
+	interactiveBattlesMu sync.Mutex
+	interactiveBattles   = map[string]*interactiveBattle{}
+)
+
+var upgrader = websocket.Upgrader{
+	// The API is open to any origin, like the CORS headers say.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// CreateInteractiveBattle sets up an interactive battle between the
+// attacker's attack deck and the defender's defense deck. Both players then
+// connect to /battle/interactive/{id}/ws?user_id=...
+func CreateInteractiveBattle(w http.ResponseWriter, r *http.Request) {
+	var req InteractiveBattleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "pvp"
+	}
+	if req.Mode != "pvp" && req.Mode != "friendly" {
+		http.Error(w, `{"error":"mode must be pvp or friendly"}`, http.StatusBadRequest)
+		return
+	}
+	if req.AttackerID == req.DefenderID {
+		http.Error(w, `{"error":"cannot fight yourself"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "friendly" {
+		friends, err := areFriends(db.Pool, req.AttackerID, req.DefenderID)
+		if err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !friends {
+			http.Error(w, `{"error":"you can only spar with friends"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	attackerDeck, defenderDeck, err := loadPvPDecks(req.AttackerID, req.DefenderID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, `{"error":"id error"}`, http.StatusInternalServerError)
+		return
+	}
+	ib := &interactiveBattle{
+		id:           hex.EncodeToString(buf),
+		mode:         req.Mode,
+		attackerID:   req.AttackerID,
+		defenderID:   req.DefenderID,
+		attackerDeck: attackerDeck,
+		defenderDeck: defenderDeck,
+		battle:       engine.NewBattleWith(attackerDeck, defenderDeck, battleRules(req.Mode)),
+		conns:        map[string]*websocket.Conn{},
+		joined:       make(chan struct{}, 2),
+		inputs:       make(chan playerInput, 16),
+		done:         make(chan struct{}),
+	}
+
+	interactiveBattlesMu.Lock()
+	interactiveBattles[ib.id] = ib
+	interactiveBattlesMu.Unlock()
+	go ib.run()
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"session_id":      ib.id,
+		"mode":            ib.mode,
+		"attacker_id":     ib.attackerID,
+		"defender_id":     ib.defenderID,
+		"rules":           ib.battle.Log().Rules,
+		"turn_timeout_ms": interactiveTurnTimeout.Milliseconds(),
+		"join_timeout_ms": interactiveJoinTimeout.Milliseconds(),
+	})
+}
+
+// InteractiveBattleSocket connects a player to their side of an interactive
+// battle. Reconnecting replaces the side's earlier connection.
+func InteractiveBattleSocket(w http.ResponseWriter, r *http.Request) {
+	interactiveBattlesMu.Lock()
+	ib, ok := interactiveBattles[mux.Vars(r)["id"]]
+	interactiveBattlesMu.Unlock()
+	if !ok {
+		http.Error(w, `{"error":"battle not found"}`, http.StatusNotFound)
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	var side string
+	switch userID {
+	case ib.attackerID:
+		side = "attacker"
+	case ib.defenderID:
+		side = "defender"
+	default:
+		http.Error(w, `{"error":"not a player in this battle"}`, http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ib.mu.Lock()
+	if old, ok := ib.conns[side]; ok {
+		old.Close()
+	}
+	ib.conns[side] = conn
+	attackerDeck, defenderDeck := ib.battle.Decks()
+	options := ib.battle.Options()
+	writeSocket(conn, interactiveMessage{
+		Type:          "joined",
+		Side:          side,
+		Round:         ib.battle.Round(),
+		Options:       &options,
+		AttackerDeck:  attackerDeck,
+		DefenderDeck:  defenderDeck,
+		TurnTimeoutMs: interactiveTurnTimeout.Milliseconds(),
+	})
+	ib.mu.Unlock()
+
+	select {
+	case ib.joined <- struct{}{}:
+	default:
+	}
+
+	for {
+		var msg interactiveMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		input := playerInput{side: side, round: ib.round(), move: msg.Move, auto: msg.Type == "auto"}
+		if msg.Type != "move" && msg.Type != "auto" {
+			ib.send(side, interactiveMessage{Type: "error", Error: "unknown message type"})
+			continue
+		}
+		select {
+		case ib.inputs <- input:
+		case <-ib.done:
+			return
+		}
+	}
+
+	// A reconnect has already replaced this connection; the side is still
+	// there.
+	ib.mu.Lock()
+	current := ib.conns[side] == conn
+	if current {
+		delete(ib.conns, side)
+	}
+	ib.mu.Unlock()
+	if !current {
+		return
+	}
+	select {
+	case ib.inputs <- playerInput{side: side, round: ib.round(), auto: true}:
+	case <-ib.done:
+	}
+}
+
+// round is the round being played.
+func (ib *interactiveBattle) round() int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return ib.battle.Round()
+}
+
+func (ib *interactiveBattle) connected(side string) bool {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	_, ok := ib.conns[side]
+	return ok
+}
+
+// send writes a message to one side, if connected.
+func (ib *interactiveBattle) send(side string, msg interactiveMessage) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	if conn, ok := ib.conns[side]; ok {
+		writeSocket(conn, msg)
+	}
+}
+
+// broadcast writes a message to both sides.
+func (ib *interactiveBattle) broadcast(msg interactiveMessage) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	for _, conn := range ib.conns {
+		writeSocket(conn, msg)
+	}
+}
+
+// writeSocket writes one message, giving up on clients that stop reading.
+func writeSocket(conn *websocket.Conn, msg interactiveMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.WriteJSON(msg)
+}
+
+// run plays the battle to the end, then stores it.
+func (ib *interactiveBattle) run() {
+	defer func() {
+		close(ib.done)
+		interactiveBattlesMu.Lock()
+		delete(interactiveBattles, ib.id)
+		interactiveBattlesMu.Unlock()
+
+		ib.mu.Lock()
+		for _, conn := range ib.conns {
+			conn.Close()
+		}
+		ib.mu.Unlock()
+	}()
+
+	joinDeadline := time.NewTimer(interactiveJoinTimeout)
+waiting:
+	for !ib.connected("attacker") || !ib.connected("defender") {
+		select {
+		case <-ib.joined:
+		case <-joinDeadline.C:
+			break waiting
+		}
+	}
+	joinDeadline.Stop()
+
+	if ib.mode == "pvp" && !ib.connected("defender") {
+		ib.broadcast(interactiveMessage{Type: "cancelled", Error: "the defender did not join"})
+		return
+	}
+
+	for !ib.battle.Done() {
+		ib.playTurn()
+	}
+
+	battleLog := ib.battle.Log()
+	battleID, err := ib.save(battleLog)
+	if err != nil {
+		log.Printf("interactive battle %s: save: %v", ib.id, err)
+		ib.broadcast(interactiveMessage{Type: "error", Error: "save battle error"})
+		return
+	}
+	ib.broadcast(interactiveMessage{
+		Type:     "end",
+		BattleID: battleID,
+		Winner:   battleLog.Winner,
+		Rounds:   battleLog.TotalRounds,
+	})
+}
+
+// playTurn waits for the side to move and plays its move, or plays the turn
+// for it once time is up or if it isn't connected.
+func (ib *interactiveBattle) playTurn() {
+	side, round := ib.battle.TurnSide(), ib.battle.Round()
+	deadline := time.Now().Add(interactiveTurnTimeout)
+	options := ib.battle.Options()
+	ib.broadcast(interactiveMessage{
+		Type:     "turn",
+		Side:     side,
+		Round:    round,
+		Deadline: &deadline,
+		Options:  &options,
+	})
+
+	timer := time.NewTimer(interactiveTurnTimeout)
+	defer timer.Stop()
+	for {
+		if !ib.connected(side) {
+			ib.step(engine.Move{}, false)
+			return
+		}
+		select {
+		case in := <-ib.inputs:
+			if in.round != round {
+				if !in.auto {
+					ib.send(in.side, interactiveMessage{Type: "error", Error: "that turn is over"})
+				}
+				continue
+			}
+			if in.side != side {
+				if !in.auto {
+					ib.send(in.side, interactiveMessage{Type: "error", Error: "not your turn"})
+				}
+				continue
+			}
+			if in.auto {
+				ib.step(engine.Move{}, false)
+				return
+			}
+			if err := ib.step(in.move, false); err != nil {
+				ib.send(side, interactiveMessage{Type: "error", Error: err.Error()})
+				continue
+			}
+			return
+		case <-timer.C:
+			ib.step(engine.Move{}, true)
+			return
+		}
+	}
+}
+
+func (ib *interactiveBattle) step(m engine.Move, timedOut bool) error {
+	// Held so a player joining mid-battle sees a consistent state.
+	ib.mu.Lock()
+	entry, err := ib.battle.Step(m)
+	ib.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ib.broadcast(interactiveMessage{Type: "entry", Entry: &entry, TimedOut: timedOut})
+	return nil
+}
+
+// save stores the finished battle the way the auto-resolved endpoints do.
+func (ib *interactiveBattle) save(battleLog models.BattleLog) (string, error) {
+	if ib.mode == "friendly" {
+		var battleID string
+		err := inTx(func(tx *db.Tx) (err error) {
+			battleID, _, err = saveBattle(tx, "friendly", ib.attackerID, ib.defenderID, ib.attackerDeck, ib.defenderDeck, battleLog)
+			return err
+		})
+		return battleID, err
+	}
+	result, err := recordPvP(ib.attackerID, ib.defenderID, ib.attackerDeck, ib.defenderDeck, battleLog)
+	if err != nil {
+		return "", err
+	}
+	return result["battle_id"].(string), nil
+}
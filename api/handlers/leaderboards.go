@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"imperium/db"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+type leaderboard struct {
+	// scores selects (user_id, score) rows. Seasonal boards receive the
+	// season id as $1.
+	scores   string
+	seasonal bool
+}
+
+var leaderboards = map[string]leaderboard{
+	"rating": {
+		scores: `SELECT u.id AS user_id, u.rating::BIGINT AS score
+		         FROM users u JOIN season_stats ss ON ss.user_id = u.id
+		         WHERE ss.season_id = $1 AND ss.pvp_battles > 0`,
+		seasonal: true,
+	},
+	"pvp_wins": {
+		scores:   `SELECT user_id, pvp_wins::BIGINT AS score FROM season_stats WHERE season_id = $1 AND pvp_wins > 0`,
+		seasonal: true,
+	},
+	"pve_wins": {
+		scores:   `SELECT user_id, pve_wins::BIGINT AS score FROM season_stats WHERE season_id = $1 AND pve_wins > 0`,
+		seasonal: true,
+	},
+	"dungeon_clears": {
+		scores:   `SELECT user_id, dungeon_clears::BIGINT AS score FROM season_stats WHERE season_id = $1 AND dungeon_clears > 0`,
+		seasonal: true,
+	},
+	"world_boss": {
+		scores: `SELECT a.user_id, SUM(a.damage)::BIGINT AS score
+		         FROM world_boss_attacks a
+		         WHERE a.event_id = (SELECT id FROM world_boss_events WHERE starts_at <= NOW()
+		                             ORDER BY starts_at DESC LIMIT 1)
+		         GROUP BY a.user_id`,
+	},
+	"collection": {
+		scores: `SELECT uc.user_id, COUNT(DISTINCT uc.card_id) AS score
+		         FROM user_cards uc JOIN card_definitions cd ON cd.id = uc.card_id
+		         WHERE NOT cd.is_fuel
+		         GROUP BY uc.user_id`,
+	},
+}
+
+// seasonStats lists the season_stats counters bumpSeasonStat may touch.
+var seasonStats = map[string]bool{
+	"pvp_battles":    true,
+	"pvp_wins":       true,
+	"pve_wins":       true,
+	"dungeon_clears": true,
+}
+
+// rankedQuery wraps a board's scores in a CTE named "ranked" with a rank per
+// user. The returned args hold the season id when the board needs it; extra
+// placeholders must be numbered after them.
+func rankedQuery(lb leaderboard, seasonID int) (string, []any) {
+	var args []any
+	if lb.seasonal {
+		args = append(args, seasonID)
+	}
+	sql := `WITH scores AS (` + lb.scores + `),
+	ranked AS (
+		SELECT s.user_id, COALESCE(u.username, '') AS username, s.score,
+		       RANK() OVER (ORDER BY s.score DESC) AS rank
+		FROM scores s JOIN users u ON u.id = s.user_id
+	) `
+	return sql, args
+}
+
+// GetLeaderboard returns one page of a board for the current season, plus the
+// caller's own rank when user_id is given.
+func GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	board := mux.Vars(r)["board"]
+	lb, ok := leaderboards[board]
+	if !ok {
+		http.Error(w, `{"error":"unknown leaderboard"}`, http.StatusNotFound)
+		return
+	}
+
+	limit, offset := pageParams(r)
+
+	season, err := currentSeason(db.Pool)
+	if err != nil && err != pgx.ErrNoRows {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	seasonID := 0
+	if season != nil {
+		seasonID = season.ID
+	}
+
+	ranked, args := rankedQuery(lb, seasonID)
+	n := len(args)
+
+	var total int
+	err = db.Pool.QueryRow(context.Background(), ranked+`SELECT COUNT(*) FROM ranked`, args...).Scan(&total)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		ranked+fmt.Sprintf(`SELECT rank, user_id, username, score FROM ranked ORDER BY rank, user_id LIMIT $%d OFFSET $%d`, n+1, n+2),
+		append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.LeaderboardEntry{}
+	for rows.Next() {
+		var e models.LeaderboardEntry
+		if err := rows.Scan(&e.Rank, &e.UserID, &e.Username, &e.Score); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	resp := map[string]interface{}{
+		"board":   board,
+		"season":  season,
+		"total":   total,
+		"entries": entries,
+	}
+
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.ParseInt(userIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+			return
+		}
+		var me models.LeaderboardEntry
+		err = db.Pool.QueryRow(context.Background(),
+			ranked+fmt.Sprintf(`SELECT rank, user_id, username, score FROM ranked WHERE user_id = $%d`, n+1),
+			append(args, userID)...).Scan(&me.Rank, &me.UserID, &me.Username, &me.Score)
+		if err == nil {
+			resp["me"] = me
+		} else if err != pgx.ErrNoRows {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// bumpSeasonStat increments one of the current season's counters for a user.
+// It does nothing when no season is running.
+func bumpSeasonStat(q db.Querier, userID int64, stat string) error {
+	if !seasonStats[stat] {
+		return fmt.Errorf("unknown season stat %q", stat)
+	}
+	_, err := q.Exec(context.Background(),
+		`INSERT INTO season_stats (season_id, user_id, `+stat+`)
+		 SELECT id, $1, 1 FROM seasons
+		 WHERE starts_at <= NOW() AND closed_at IS NULL
+		 ORDER BY starts_at DESC LIMIT 1
+		 ON CONFLICT (season_id, user_id) DO UPDATE SET `+stat+` = season_stats.`+stat+` + 1`,
+		userID)
+	return err
+}
+
+// pageParams reads limit (default 50, max 100) and offset from the query.
+func pageParams(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -7,23 +7,24 @@ import (
 	"net/http"
 
 	"imperium/db"
+	"imperium/events"
+	"imperium/models"
 )
 
+// currencyItem is the user_items type used as the in-game currency.
+const currencyItem = "coins"
+
 type LootRequest struct {
 	UserID int64 `json:"user_id"`
 }
 
-type DungeonRequest struct {
-	UserID  int64  `json:"user_id"`
-	Dungeon string `json:"dungeon"`
-}
-
 type LootResult struct {
 	Type    string `json:"type"`
 	CardID  string `json:"card_id,omitempty"`
 	ItemID  string `json:"item_id,omitempty"`
 	Rarity  string `json:"rarity,omitempty"`
 	Quality int    `json:"quality,omitempty"`
+	Amount  int    `json:"amount,omitempty"`
 }
 
 func OpenCase(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +42,13 @@ func OpenCase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
 	results := []LootResult{}
 
 	roll := rand.Float64()
@@ -48,7 +56,7 @@ func OpenCase(w http.ResponseWriter, r *http.Request) {
 		// Common cards: venom, thug, goon
 		cards := []string{"venom", "thug", "goon"}
 		cardID := cards[rand.Intn(len(cards))]
-		result, err := giveCard(req.UserID, cardID)
+		result, err := giveCard(tx, req.UserID, cardID)
 		if err != nil {
 			http.Error(w, `{"error":"give card error: `+err.Error()+`"}`, http.StatusInternalServerError)
 			return
@@ -58,7 +66,7 @@ func OpenCase(w http.ResponseWriter, r *http.Request) {
 		// Uncommon cards: enforcer, hitman
 		cards := []string{"enforcer", "hitman"}
 		cardID := cards[rand.Intn(len(cards))]
-		result, err := giveCard(req.UserID, cardID)
+		result, err := giveCard(tx, req.UserID, cardID)
 		if err != nil {
 			http.Error(w, `{"error":"give card error: `+err.Error()+`"}`, http.StatusInternalServerError)
 			return
@@ -66,130 +74,100 @@ func OpenCase(w http.ResponseWriter, r *http.Request) {
 		results = append(results, *result)
 	} else {
 		// Bronze key
-		err := giveItem(req.UserID, "bronze_key", 1)
-		if err != nil {
+		if err := giveItem(tx, req.UserID, "bronze_key", 1); err != nil {
 			http.Error(w, `{"error":"give item error: `+err.Error()+`"}`, http.StatusInternalServerError)
 			return
 		}
 		results = append(results, LootResult{Type: "item", ItemID: "bronze_key"})
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
-}
-
-func EnterDungeon(w http.ResponseWriter, r *http.Request) {
-	var req DungeonRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+	if err := emit(tx, events.CaseOpened{UserID: req.UserID}); err != nil {
+		http.Error(w, `{"error":"event error"}`, http.StatusInternalServerError)
 		return
 	}
-
-	// Determine required key
-	var requiredKey string
-	switch req.Dungeon {
-	case "easy":
-		requiredKey = "bronze_key"
-	case "medium":
-		requiredKey = "silver_key"
-	case "hard":
-		requiredKey = "gold_key"
-	default:
-		http.Error(w, `{"error":"invalid dungeon: easy, medium, hard"}`, http.StatusBadRequest)
-		return
-	}
-
-	// Check and consume key
-	var qty int
-	err := db.Pool.QueryRow(context.Background(),
-		`SELECT COALESCE((SELECT quantity FROM user_items WHERE user_id=$1 AND item_type=$2), 0)`,
-		req.UserID, requiredKey).Scan(&qty)
-	if err != nil {
-		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
-		return
-	}
-	if qty < 1 {
-		http.Error(w, `{"error":"not enough keys: need 1 `+requiredKey+`"}`, http.StatusBadRequest)
+	if err := tx.Commit(context.Background()); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
 		return
 	}
 
-	_, err = db.Pool.Exec(context.Background(),
-		`UPDATE user_items SET quantity = quantity - 1 WHERE user_id=$1 AND item_type=$2`,
-		req.UserID, requiredKey)
-	if err != nil {
-		http.Error(w, `{"error":"consume key error"}`, http.StatusInternalServerError)
-		return
-	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
 
+// rollDungeonLoot rolls a dungeon's chest: usually a card from its drop table,
+// plus the key to the next dungeon up.
+func rollDungeonLoot(q db.Querier, userID int64, dungeon string) ([]LootResult, error) {
 	results := []LootResult{}
 
-	// Card drop based on dungeon
+	var cardID, bonusKey string
 	roll := rand.Float64()
-	switch req.Dungeon {
+	switch dungeon {
 	case "easy":
-		cards := []string{"enforcer", "hitman", "spider-man", "capo"}
 		if roll < 0.80 {
-			cardID := cards[rand.Intn(len(cards))]
-			result, err := giveCard(req.UserID, cardID)
-			if err != nil {
-				http.Error(w, `{"error":"give card error"}`, http.StatusInternalServerError)
-				return
-			}
-			results = append(results, *result)
+			cards := []string{"enforcer", "hitman", "spider-man", "capo"}
+			cardID = cards[rand.Intn(len(cards))]
 		}
-		// 100% bonus silver key
-		if err := giveItem(req.UserID, "silver_key", 1); err != nil {
-			http.Error(w, `{"error":"give item error"}`, http.StatusInternalServerError)
-			return
-		}
-		results = append(results, LootResult{Type: "item", ItemID: "silver_key"})
-
+		bonusKey = "silver_key"
 	case "medium":
-		cards := []string{"spider-man", "capo", "don", "mastermind", "berserker"}
 		if roll < 0.80 {
-			cardID := cards[rand.Intn(len(cards))]
-			result, err := giveCard(req.UserID, cardID)
-			if err != nil {
-				http.Error(w, `{"error":"give card error"}`, http.StatusInternalServerError)
-				return
-			}
-			results = append(results, *result)
+			cards := []string{"spider-man", "capo", "don", "mastermind", "berserker"}
+			cardID = cards[rand.Intn(len(cards))]
 		}
-		// 100% bonus gold key
-		if err := giveItem(req.UserID, "gold_key", 1); err != nil {
-			http.Error(w, `{"error":"give item error"}`, http.StatusInternalServerError)
-			return
-		}
-		results = append(results, LootResult{Type: "item", ItemID: "gold_key"})
-
+		bonusKey = "gold_key"
 	case "hard":
 		if roll < 0.80 {
 			cards := []string{"don", "mastermind", "godfather"}
-			cardID := cards[rand.Intn(len(cards))]
-			result, err := giveCard(req.UserID, cardID)
-			if err != nil {
-				http.Error(w, `{"error":"give card error"}`, http.StatusInternalServerError)
-				return
-			}
-			results = append(results, *result)
+			cardID = cards[rand.Intn(len(cards))]
 		} else {
 			pvpCards := []string{"pvp-assassin", "pvp-warlord", "pvp-champion"}
-			cardID := pvpCards[rand.Intn(len(pvpCards))]
-			result, err := giveCard(req.UserID, cardID)
-			if err != nil {
-				http.Error(w, `{"error":"give card error"}`, http.StatusInternalServerError)
-				return
-			}
-			results = append(results, *result)
+			cardID = pvpCards[rand.Intn(len(pvpCards))]
 		}
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+	if cardID != "" {
+		result, err := giveCard(q, userID, cardID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *result)
+	}
+	if bonusKey != "" {
+		if err := giveItem(q, userID, bonusKey, 1); err != nil {
+			return nil, err
+		}
+		results = append(results, LootResult{Type: "item", ItemID: bonusKey})
+	}
+	return results, nil
 }
 
-func giveCard(userID int64, cardID string) (*LootResult, error) {
+// giveReward pays out a fixed reward and reports what was given.
+func giveReward(q db.Querier, userID int64, reward models.Reward) ([]LootResult, error) {
+	results := []LootResult{}
+	if reward.Coins > 0 {
+		if err := giveItem(q, userID, currencyItem, reward.Coins); err != nil {
+			return nil, err
+		}
+		results = append(results, LootResult{Type: "item", ItemID: currencyItem, Amount: reward.Coins})
+	}
+	if reward.Item != "" {
+		if err := giveItem(q, userID, reward.Item, 1); err != nil {
+			return nil, err
+		}
+		results = append(results, LootResult{Type: "item", ItemID: reward.Item})
+	}
+	if reward.CardID != "" {
+		result, err := giveCard(q, userID, reward.CardID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+func giveCard(q db.Querier, userID int64, cardID string) (*LootResult, error) {
 	var rarity string
 	var baseHP, baseDur int
-	err := db.Pool.QueryRow(context.Background(),
+	err := q.QueryRow(context.Background(),
 		`SELECT rarity, base_hp, base_durability FROM card_definitions WHERE id=$1`, cardID).Scan(&rarity, &baseHP, &baseDur)
 	if err != nil {
 		return nil, err
@@ -197,12 +175,15 @@ func giveCard(userID int64, cardID string) (*LootResult, error) {
 
 	quality := 1 + rand.Intn(3) // 1-3 for most, can be higher later
 
-	_, err = db.Pool.Exec(context.Background(),
+	_, err = q.Exec(context.Background(),
 		`INSERT INTO user_cards (user_id, card_id, quality, current_hp, current_durability) VALUES ($1, $2, $3, $4, $5)`,
 		userID, cardID, quality, baseHP, baseDur)
 	if err != nil {
 		return nil, err
 	}
+	if err := emit(q, events.CardGranted{UserID: userID, CardID: cardID, Rarity: rarity, Quality: quality}); err != nil {
+		return nil, err
+	}
 
 	return &LootResult{
 		Type:    "card",
@@ -212,10 +193,29 @@ func giveCard(userID int64, cardID string) (*LootResult, error) {
 	}, nil
 }
 
-func giveItem(userID int64, itemType string, qty int) error {
-	_, err := db.Pool.Exec(context.Background(),
+func giveItem(q db.Querier, userID int64, itemType string, qty int) error {
+	_, err := q.Exec(context.Background(),
 		`INSERT INTO user_items (user_id, item_type, quantity) VALUES ($1, $2, $3)
 		 ON CONFLICT (user_id, item_type) DO UPDATE SET quantity = user_items.quantity + $3`,
 		userID, itemType, qty)
-	return err
+	if err != nil {
+		return err
+	}
+	return emit(q, events.ItemGranted{UserID: userID, ItemType: itemType, Quantity: qty})
+}
+
+// takeItem removes qty of an item, failing with a 400 apiError when the user
+// doesn't have enough.
+func takeItem(q db.Querier, userID int64, itemType string, qty int) error {
+	tag, err := q.Exec(context.Background(),
+		`UPDATE user_items SET quantity = quantity - $3
+		 WHERE user_id = $1 AND item_type = $2 AND quantity >= $3`,
+		userID, itemType, qty)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &apiError{http.StatusBadRequest, "not enough " + itemType}
+	}
+	return nil
 }
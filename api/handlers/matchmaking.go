@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"imperium/db"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type FindPvPRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+const (
+	// eloK is how many rating points a single PvP battle can move.
+	eloK = 32
+	// recentOpponentsLimit is how many of the player's latest PvP battles are
+	// checked to avoid being matched against the same opponent again.
+	recentOpponentsLimit = 5
+)
+
+// ratingWindows are how far from the player's rating an opponent may be,
+// widening the longer they have been searching. A negative window means "any
+// rating".
+var ratingWindows = []struct {
+	after  time.Duration
+	window int
+}{
+	{0, 50},
+	{10 * time.Second, 100},
+	{20 * time.Second, 200},
+	{30 * time.Second, 400},
+	{45 * time.Second, 800},
+	{60 * time.Second, -1},
+}
+
+// queueIdleTimeout is how long a search survives without the player asking
+// again; after that the next request starts a fresh search at the narrowest
+// window.
+const queueIdleTimeout = 30 * time.Second
+
+// ratingWindow is the window for a search that has run for waited.
+func ratingWindow(waited time.Duration) int {
+	window := ratingWindows[0].window
+	for _, rw := range ratingWindows {
+		if waited >= rw.after {
+			window = rw.window
+		}
+	}
+	return window
+}
+
+// FindPvP looks for an opponent near the player's rating and fights their
+// defense deck. The first call puts the player in the queue; while nobody
+// fits the current window it answers 202 with the search so far, and the
+// client calls again to widen it. Once any rating is allowed and there is
+// still nobody, it gives up with 404.
+func FindPvP(w http.ResponseWriter, r *http.Request) {
+	var req FindPvPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	var rating int
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT rating FROM users WHERE id = $1`, req.UserID).Scan(&rating)
+	if err != nil {
+		http.Error(w, `{"error":"user not found"}`, http.StatusNotFound)
+		return
+	}
+
+	var waitedSec float64
+	err = db.Pool.QueryRow(context.Background(),
+		`INSERT INTO pvp_queue (user_id) VALUES ($1)
+		 ON CONFLICT (user_id) DO UPDATE SET
+		     joined_at = CASE WHEN pvp_queue.polled_at < NOW() - make_interval(secs => $2)
+		                      THEN NOW() ELSE pvp_queue.joined_at END,
+		     polled_at = NOW()
+		 RETURNING EXTRACT(EPOCH FROM NOW() - joined_at)::FLOAT8`,
+		req.UserID, queueIdleTimeout.Seconds()).Scan(&waitedSec)
+	if err != nil {
+		http.Error(w, `{"error":"matchmaking error"}`, http.StatusInternalServerError)
+		return
+	}
+	waited := time.Duration(waitedSec * float64(time.Second))
+	window := ratingWindow(waited)
+
+	opponentID, err := findOpponent(req.UserID, rating, window)
+	if err != nil {
+		http.Error(w, `{"error":"matchmaking error"}`, http.StatusInternalServerError)
+		return
+	}
+	if opponentID == 0 && window >= 0 {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":    "searching",
+			"waited_ms": waited.Milliseconds(),
+			"window":    window,
+		})
+		return
+	}
+
+	leaveQueue(req.UserID)
+	if opponentID == 0 {
+		http.Error(w, `{"error":"no opponents available"}`, http.StatusNotFound)
+		return
+	}
+
+	result, err := runPvP(req.UserID, opponentID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// LeavePvPQueue stops the player's search.
+func LeavePvPQueue(w http.ResponseWriter, r *http.Request) {
+	var req FindPvPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if err := leaveQueue(req.UserID); err != nil {
+		http.Error(w, `{"error":"matchmaking error"}`, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "left"})
+}
+
+func leaveQueue(userID int64) error {
+	_, err := db.Pool.Exec(context.Background(), `DELETE FROM pvp_queue WHERE user_id = $1`, userID)
+	return err
+}
+
+// findOpponent looks for someone with a non-empty deck within window of the
+// player's rating. Recent opponents are skipped unless the window is already
+// "any rating" and nobody else is left. Returns 0 when there is no one to
+// fight.
+func findOpponent(userID int64, rating, window int) (int64, error) {
+	recent, err := recentOpponents(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	tries := [][]int64{recent}
+	if window < 0 {
+		tries = append(tries, []int64{})
+	}
+	for _, excluded := range tries {
+		var opponentID int64
+		err := db.Pool.QueryRow(context.Background(),
+			`SELECT u.id FROM users u
+			 WHERE u.id <> $1
+			   AND NOT (u.id = ANY($2))
+			   AND ($4 < 0 OR ABS(u.rating - $3) <= $4)
+			   AND EXISTS (SELECT 1 FROM deck_cards dc WHERE dc.deck_id = COALESCE(
+			       (SELECT deck_id FROM active_decks WHERE user_id = u.id AND purpose = 'defense'),
+			       (SELECT deck_id FROM active_decks WHERE user_id = u.id AND purpose = 'attack')))
+			 ORDER BY random()
+			 LIMIT 1`,
+			userID, excluded, rating, window).Scan(&opponentID)
+		if err == pgx.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return opponentID, nil
+	}
+	return 0, nil
+}
+
+func recentOpponents(userID int64) ([]int64, error) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT CASE WHEN attacker_id = $1 THEN defender_id ELSE attacker_id END
+		 FROM battles
+		 WHERE (attacker_id = $1 OR defender_id = $1) AND defender_id > 0
+		 ORDER BY created_at DESC
+		 LIMIT $2`, userID, recentOpponentsLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// applyRatingChange updates both players' Elo ratings after a PvP battle and
+// returns the new values.
+func applyRatingChange(tx pgx.Tx, attackerID, defenderID int64, winner string) (int, int, error) {
+	ratings := map[int64]int{}
+	rows, err := tx.Query(context.Background(),
+		`SELECT id, rating FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE`, attackerID, defenderID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var id int64
+		var rating int
+		if err := rows.Scan(&id, &rating); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ratings[id] = rating
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	attackerRating, defenderRating := ratings[attackerID], ratings[defenderID]
+
+	score := 0.5
+	switch winner {
+	case "attacker":
+		score = 1
+	case "defender":
+		score = 0
+	}
+
+	expected := 1 / (1 + math.Pow(10, float64(defenderRating-attackerRating)/400))
+	delta := int(math.Round(eloK * (score - expected)))
+
+	attackerRating += delta
+	defenderRating -= delta
+
+	_, err = tx.Exec(context.Background(), `UPDATE users SET rating = $2 WHERE id = $1`, attackerID, attackerRating)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.Exec(context.Background(), `UPDATE users SET rating = $2 WHERE id = $1`, defenderID, defenderRating)
+	if err != nil {
+		return 0, 0, err
+	}
+	return attackerRating, defenderRating, nil
+}
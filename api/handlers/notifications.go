@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"imperium/db"
+	"imperium/events"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// notificationMaxWait caps how long a long-poll request may wait for new
+// notifications.
+const notificationMaxWait = 60 * time.Second
+
+type MarkReadRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+type MarkDeliveredRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+// newNotifications is closed and replaced every time notifications are
+// added, waking up long-poll requests. It only sees notifications made by
+// this API process.
+var (
+	newNotificationsMu sync.Mutex
+	newNotifications   = make(chan struct{})
+)
+
+func notificationsChanged() <-chan struct{} {
+	newNotificationsMu.Lock()
+	defer newNotificationsMu.Unlock()
+	return newNotifications
+}
+
+func wakeNotificationWaiters() {
+	newNotificationsMu.Lock()
+	defer newNotificationsMu.Unlock()
+	close(newNotifications)
+	newNotifications = make(chan struct{})
+}
+
+// notify queues a message for the bot to deliver to a player.
+func notify(q db.Querier, userID int64, kind string, payload map[string]interface{}) error {
+	payloadJSON, _ := json.Marshal(payload)
+	_, err := q.Exec(context.Background(),
+		`INSERT INTO notifications (user_id, kind, payload) VALUES ($1, $2, $3)`,
+		userID, kind, payloadJSON)
+	if err != nil {
+		return err
+	}
+	if tx, ok := q.(*db.Tx); ok {
+		tx.AfterCommit(wakeNotificationWaiters)
+	} else {
+		wakeNotificationWaiters()
+	}
+	return nil
+}
+
+// subscribeNotifications turns game events into notifications.
+func subscribeNotifications() {
+	events.Subscribe("notifications", func(e events.BattleFinished) error {
+		if e.Mode != "pvp" || e.DefenderID <= 0 {
+			return nil
+		}
+		return notify(db.Pool, e.DefenderID, "pvp_attacked", map[string]interface{}{
+			"battle_id":   e.BattleID,
+			"attacker_id": e.AttackerID,
+			"winner":      e.Winner,
+			"rounds":      e.Rounds,
+		})
+	})
+}
+
+const notificationColumns = `id, user_id, kind, payload, created_at, read_at, delivered_at`
+
+func scanNotifications(rows pgx.Rows) ([]models.Notification, error) {
+	defer rows.Close()
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var n models.Notification
+		var payloadRaw json.RawMessage
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &payloadRaw, &n.CreatedAt, &n.ReadAt, &n.DeliveredAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(payloadRaw, &n.Payload)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// waitParam reads ?wait= (seconds, capped at notificationMaxWait).
+func waitParam(r *http.Request) time.Duration {
+	secs, err := strconv.Atoi(r.URL.Query().Get("wait"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return min(time.Duration(secs)*time.Second, notificationMaxWait)
+}
+
+// longPoll runs fetch until it returns something, the wait is up or the
+// client goes away, re-running it whenever new notifications come in.
+func longPoll(r *http.Request, wait time.Duration, fetch func() ([]models.Notification, error)) ([]models.Notification, error) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		// Taken before fetching so a notification added in between still
+		// wakes us.
+		changed := notificationsChanged()
+		list, err := fetch()
+		if err != nil || len(list) > 0 || wait <= 0 {
+			return list, err
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return list, nil
+		case <-r.Context().Done():
+			return list, nil
+		}
+	}
+}
+
+// GetNotifications returns a player's latest notifications, only unread ones
+// with ?unread=true. With ?after_id= it returns the ones after that id,
+// oldest first, and ?wait=N long-polls for up to N seconds until there are
+// some.
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	limit, _ := pageParams(r)
+
+	var afterID *int64
+	if s := r.URL.Query().Get("after_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"invalid after_id"}`, http.StatusBadRequest)
+			return
+		}
+		afterID = &id
+	}
+
+	fetch := func() ([]models.Notification, error) {
+		order := "DESC"
+		if afterID != nil {
+			order = "ASC"
+		}
+		rows, err := db.Pool.Query(context.Background(),
+			`SELECT `+notificationColumns+` FROM notifications
+			 WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL) AND ($3::BIGINT IS NULL OR id > $3)
+			 ORDER BY id `+order+` LIMIT $4`, userID, unreadOnly, afterID, limit)
+		if err != nil {
+			return nil, err
+		}
+		return scanNotifications(rows)
+	}
+
+	wait := waitParam(r)
+	if afterID == nil {
+		wait = 0
+	}
+	notifications, err := longPoll(r, wait, fetch)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, notifications)
+}
+
+// GetUnreadNotificationCount returns how many unread notifications a player
+// has, in total and per kind.
+func GetUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT kind, COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL GROUP BY kind`, userID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	total := 0
+	byKind := map[string]int{}
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		byKind[kind] = n
+		total += n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"unread":  total,
+		"by_kind": byKind,
+	})
+}
+
+// MarkNotificationsRead marks the given notifications as read, or all of the
+// player's notifications when no ids are sent.
+func MarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req MarkReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.IDs == nil {
+		req.IDs = []int64{}
+	}
+
+	tag, err := db.Pool.Exec(context.Background(),
+		`UPDATE notifications SET read_at = NOW()
+		 WHERE user_id = $1 AND read_at IS NULL AND (cardinality($2::BIGINT[]) = 0 OR id = ANY($2))`,
+		userID, req.IDs)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "marked": tag.RowsAffected()})
+}
+
+// GetNotificationFeed is the bot's queue: notifications for every player it
+// hasn't delivered yet, oldest first. ?wait=N long-polls for up to N seconds
+// when the queue is empty.
+func GetNotificationFeed(w http.ResponseWriter, r *http.Request) {
+	limit, _ := pageParams(r)
+
+	notifications, err := longPoll(r, waitParam(r), func() ([]models.Notification, error) {
+		rows, err := db.Pool.Query(context.Background(),
+			`SELECT `+notificationColumns+` FROM notifications
+			 WHERE delivered_at IS NULL ORDER BY id LIMIT $1`, limit)
+		if err != nil {
+			return nil, err
+		}
+		return scanNotifications(rows)
+	})
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, notifications)
+}
+
+// MarkNotificationsDelivered takes notifications off the bot's queue.
+func MarkNotificationsDelivered(w http.ResponseWriter, r *http.Request) {
+	var req MarkDeliveredRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		http.Error(w, `{"error":"ids are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	tag, err := db.Pool.Exec(context.Background(),
+		`UPDATE notifications SET delivered_at = NOW() WHERE id = ANY($1) AND delivered_at IS NULL`, req.IDs)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "marked": tag.RowsAffected()})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strings"
+
+	"imperium/db"
+	"imperium/models"
+)
+
+// pveBudgetPct is the generated bot deck's power as a percentage of the
+// player's deck power, per dungeon tier.
+var pveBudgetPct = map[string]int{
+	"easy":   80,
+	"medium": 100,
+	"hard":   125,
+}
+
+// pveModifierCount is how many random difficulty modifiers each tier rolls.
+var pveModifierCount = map[string]int{
+	"easy":   0,
+	"medium": 1,
+	"hard":   2,
+}
+
+const (
+	// pveDeckSize matches the player deck limit.
+	pveDeckSize = 5
+	// pveMinBudget keeps bots from being trivial for brand new decks.
+	pveMinBudget = 20
+)
+
+// pveModifier changes a generated deck after it has been built.
+type pveModifier struct {
+	Name  string
+	Apply func(deck []models.BattleCard)
+}
+
+// pveModifiers are in a fixed order so a seed always rolls the same ones.
+var pveModifiers = []pveModifier{
+	{"thorns", func(deck []models.BattleCard) {
+		for i := range deck {
+			deck[i].Effects = append(deck[i].Effects, "thorns:1")
+		}
+	}},
+	{"rampage", func(deck []models.BattleCard) {
+		for i := range deck {
+			deck[i].Effects = append(deck[i].Effects, "rampage")
+		}
+	}},
+	{"armored", func(deck []models.BattleCard) {
+		for i := range deck {
+			deck[i].MaxHP += deck[i].MaxHP / 2
+			deck[i].CurrentHP = deck[i].MaxHP
+		}
+	}},
+	{"frenzy", func(deck []models.BattleCard) {
+		for i := range deck {
+			deck[i].Attack++
+		}
+	}},
+	{"guarded", func(deck []models.BattleCard) {
+		if len(deck) > 0 {
+			deck[0].Effects = append(deck[0].Effects, "taunt")
+		}
+	}},
+}
+
+// cardPower is the rough strength of a card used for budgets: HP plus twice
+// its attack.
+func cardPower(c models.BattleCard) int {
+	attack := int(c.Attack)
+	if hasEffectString(c.Effects, "no_attack") {
+		attack = 0
+	}
+	return int(c.MaxHP) + 2*attack
+}
+
+func deckPower(deck []models.BattleCard) int {
+	total := 0
+	for _, c := range deck {
+		total += cardPower(c)
+	}
+	return total
+}
+
+func hasEffectString(effects []string, effect string) bool {
+	for _, e := range effects {
+		if e == effect || strings.HasPrefix(e, effect+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// pveEncounter builds a fresh encounter for a player's deck: the budget comes
+// from the deck's power and the tier, the modifiers are rolled from the seed.
+func pveEncounter(dungeon string, playerDeck []models.BattleCard, seed int64) models.Encounter {
+	budget := max(deckPower(playerDeck)*pveBudgetPct[dungeon]/100, pveMinBudget)
+
+	rng := rand.New(rand.NewSource(seed))
+	modifiers := []string{}
+	for _, i := range rng.Perm(len(pveModifiers))[:pveModifierCount[dungeon]] {
+		modifiers = append(modifiers, pveModifiers[i].Name)
+	}
+
+	return models.Encounter{
+		Generator: "budget-v1",
+		Dungeon:   dungeon,
+		Seed:      seed,
+		Budget:    budget,
+		Modifiers: modifiers,
+	}
+}
+
+// generateBotDeck builds the bot deck for an encounter from the card catalog.
+// The same encounter and catalog always give the same deck.
+//
+// Cards are drawn one slot at a time, preferring ones whose power is close to
+// what is left of the budget per slot. The whole deck is then scaled so its
+// power lands on the budget before the modifiers are applied.
+func generateBotDeck(enc models.Encounter, catalog []models.BattleCard) []models.BattleCard {
+	if len(catalog) == 0 {
+		return nil
+	}
+	// The modifiers were rolled from the seed first; skip past those draws
+	// so card picks don't repeat them.
+	rng := rand.New(rand.NewSource(enc.Seed))
+	rng.Perm(len(pveModifiers))
+
+	deck := make([]models.BattleCard, 0, pveDeckSize)
+	remaining := enc.Budget
+	for slot := 0; slot < pveDeckSize; slot++ {
+		target := remaining / (pveDeckSize - slot)
+
+		// Weight each card by how close it is to the target.
+		weights := make([]int, len(catalog))
+		total := 0
+		for i, c := range catalog {
+			diff := cardPower(c) - target
+			if diff < 0 {
+				diff = -diff
+			}
+			weights[i] = 100 / (1 + diff)
+			total += weights[i]
+		}
+
+		pick := 0
+		if total > 0 {
+			roll := rng.Intn(total)
+			for i, wt := range weights {
+				if roll < wt {
+					pick = i
+					break
+				}
+				roll -= wt
+			}
+		} else {
+			pick = rng.Intn(len(catalog))
+		}
+
+		card := catalog[pick]
+		card.ID = int64(100 + slot)
+		card.Effects = append([]string{}, card.Effects...)
+		deck = append(deck, card)
+		remaining -= cardPower(card)
+	}
+
+	if power := deckPower(deck); power > 0 {
+		pct := min(max(enc.Budget*100/power, 50), 300)
+		for i := range deck {
+			deck[i].MaxHP = int16(max(int(deck[i].MaxHP)*pct/100, 1))
+			deck[i].CurrentHP = deck[i].MaxHP
+			deck[i].Attack = int16(int(deck[i].Attack) * pct / 100)
+		}
+	}
+
+	for _, name := range enc.Modifiers {
+		for _, m := range pveModifiers {
+			if m.Name == name {
+				m.Apply(deck)
+			}
+		}
+	}
+	return deck
+}
+
+// LoadBotCatalog returns the cards bots may use, as battle cards at base
+// stats, in a stable order: collectible cards, without PvP rewards and cards
+// that can't attack. The balance tool plays the same catalog.
+func LoadBotCatalog() ([]models.BattleCard, error) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT cd.id, cd.name, cd.base_hp, cd.base_damage, cd.rarity, cd.effects, cd.spawns
+		 FROM card_definitions cd
+		 WHERE `+collectibleCards+` AND cd.id NOT LIKE 'pvp-%' AND NOT cd.effects ? 'no_attack'
+		 ORDER BY cd.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var catalog []models.BattleCard
+	for rows.Next() {
+		var cardID, name, rarity string
+		var baseHP, baseDamage int
+		var effectsRaw json.RawMessage
+		var spawns *string
+		if err := rows.Scan(&cardID, &name, &baseHP, &baseDamage, &rarity, &effectsRaw, &spawns); err != nil {
+			return nil, err
+		}
+
+		effects := []string{}
+		json.Unmarshal(effectsRaw, &effects)
+		if spawns != nil {
+			effects = append(effects, "spawns:"+*spawns)
+		}
+
+		catalog = append(catalog, models.BattleCard{
+			CardID:    cardID,
+			Name:      name,
+			CurrentHP: int16(baseHP),
+			MaxHP:     int16(baseHP),
+			Attack:    int16(baseDamage),
+			Rarity:    rarity,
+			Effects:   effects,
+		})
+	}
+	return catalog, rows.Err()
+}
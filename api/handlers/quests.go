@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imperium/db"
+	"imperium/events"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// questTemplate is an objective a player can be handed. Progress is counted
+// from game events (see subscribeQuests); Filter narrows an event down,
+// e.g. to one dungeon tier.
+type questTemplate struct {
+	ID     string
+	Title  string
+	Period string
+	Event  string
+	Filter string
+	Target int
+	Reward models.Reward
+}
+
+// Quest events:
+//   - case_opened: a loot case was opened
+//   - pvp_battle / pvp_win: a PvP battle was fought / won
+//   - pve_win: a PvE bot was beaten
+//   - deathrattle_kill: a card with deathrattle killed an enemy card
+//   - dungeon_floor / dungeon_cleared: a dungeon run floor / whole run was
+//     cleared (filter: dungeon tier)
+var questTemplates = []questTemplate{
+	{ID: "daily_open_cases", Title: "Open 3 cases", Period: "daily", Event: "case_opened", Target: 3,
+		Reward: models.Reward{Coins: 10}},
+	{ID: "daily_pvp_battles", Title: "Fight 3 PvP battles", Period: "daily", Event: "pvp_battle", Target: 3,
+		Reward: models.Reward{Coins: 10}},
+	{ID: "daily_pvp_wins", Title: "Win 2 PvP battles", Period: "daily", Event: "pvp_win", Target: 2,
+		Reward: models.Reward{Coins: 20}},
+	{ID: "daily_pve_wins", Title: "Beat 3 PvE bots", Period: "daily", Event: "pve_win", Target: 3,
+		Reward: models.Reward{Coins: 15}},
+	{ID: "daily_deathrattle_kills", Title: "Kill 3 cards with a deathrattle card", Period: "daily", Event: "deathrattle_kill", Target: 3,
+		Reward: models.Reward{Coins: 20}},
+	{ID: "daily_dungeon_floors", Title: "Clear 3 dungeon floors", Period: "daily", Event: "dungeon_floor", Target: 3,
+		Reward: models.Reward{Item: "bronze_key"}},
+
+	{ID: "weekly_open_cases", Title: "Open 20 cases", Period: "weekly", Event: "case_opened", Target: 20,
+		Reward: models.Reward{Coins: 50}},
+	{ID: "weekly_pvp_wins", Title: "Win 15 PvP battles", Period: "weekly", Event: "pvp_win", Target: 15,
+		Reward: models.Reward{Coins: 50, Item: "silver_key"}},
+	{ID: "weekly_deathrattle_kills", Title: "Kill 20 cards with a deathrattle card", Period: "weekly", Event: "deathrattle_kill", Target: 20,
+		Reward: models.Reward{Coins: 60}},
+	{ID: "weekly_medium_dungeon", Title: "Clear a medium dungeon", Period: "weekly", Event: "dungeon_cleared", Filter: "medium", Target: 1,
+		Reward: models.Reward{Item: "gold_key"}},
+}
+
+// questsPerPeriod is how many quests a player is handed each day / week.
+var questsPerPeriod = map[string]int{
+	"daily":  3,
+	"weekly": 2,
+}
+
+var questPeriods = []string{"daily", "weekly"}
+
+func findQuestTemplate(id string) (questTemplate, bool) {
+	for _, t := range questTemplates {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return questTemplate{}, false
+}
+
+// questPeriodStart is the UTC day (daily) or the Monday (weekly) the period
+// containing now began on.
+func questPeriodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if period == "weekly" {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+func questPeriodEnd(period string, start time.Time) time.Time {
+	if period == "weekly" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// pickQuests chooses a player's quests for one period. The choice is seeded
+// by the player and the period, so it is the same however often it's made.
+func pickQuests(userID int64, period string, start time.Time) []questTemplate {
+	var pool []questTemplate
+	for _, t := range questTemplates {
+		if t.Period == period {
+			pool = append(pool, t)
+		}
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%s", userID, period, start.Format("2006-01-02"))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	n := min(questsPerPeriod[period], len(pool))
+	picked := make([]questTemplate, 0, n)
+	for _, i := range rng.Perm(len(pool))[:n] {
+		picked = append(picked, pool[i])
+	}
+	return picked
+}
+
+// assignQuests hands a player their quests for the current day and week if
+// they don't have them yet. Quests are rotated lazily like this rather than
+// by a job, so inactive players cost nothing.
+func assignQuests(q db.Querier, userID int64, now time.Time) error {
+	for _, period := range questPeriods {
+		start := questPeriodStart(period, now)
+		ids := []string{}
+		targets := []int32{}
+		for _, t := range pickQuests(userID, period, start) {
+			ids = append(ids, t.ID)
+			targets = append(targets, int32(t.Target))
+		}
+		_, err := q.Exec(context.Background(),
+			`INSERT INTO user_quests (user_id, template_id, period, period_start, target)
+			 SELECT $1, t.id, $3, $4, t.target FROM unnest($2::TEXT[], $5::INT[]) AS t(id, target)
+			 ON CONFLICT (user_id, template_id, period_start) DO NOTHING`,
+			userID, ids, period, start, targets)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordQuestProgress counts amount towards every current, unclaimed quest
+// of the player's that listens for event. filter is matched against the
+// templates' Filter, which only applies when set.
+func recordQuestProgress(q db.Querier, userID int64, event, filter string, amount int) error {
+	if userID <= 0 || amount <= 0 {
+		return nil
+	}
+	ids := []string{}
+	for _, t := range questTemplates {
+		if t.Event == event && (t.Filter == "" || t.Filter == filter) {
+			ids = append(ids, t.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if err := assignQuests(q, userID, now); err != nil {
+		return err
+	}
+	_, err := q.Exec(context.Background(),
+		`UPDATE user_quests SET progress = LEAST(progress + $3, target)
+		 WHERE user_id = $1 AND template_id = ANY($2) AND claimed_at IS NULL
+		   AND ((period = 'daily' AND period_start = $4) OR (period = 'weekly' AND period_start = $5))`,
+		userID, ids, amount, questPeriodStart("daily", now), questPeriodStart("weekly", now))
+	return err
+}
+
+// reactQuests counts quest progress from game events.
+func reactQuests() {
+	react("quests:case_opened", func(tx *db.Tx, e events.CaseOpened) error {
+		return recordQuestProgress(tx, e.UserID, "case_opened", "", 1)
+	})
+	react("quests:dungeon_floor", func(tx *db.Tx, e events.DungeonFloorCleared) error {
+		if err := recordQuestProgress(tx, e.UserID, "dungeon_floor", e.Dungeon, 1); err != nil {
+			return err
+		}
+		if e.RunCleared {
+			return recordQuestProgress(tx, e.UserID, "dungeon_cleared", e.Dungeon, 1)
+		}
+		return nil
+	})
+	react("quests:battle", recordBattleQuests)
+}
+
+// recordBattleQuests counts the quest events a battle produces for the
+// players in it. Friendly battles don't count.
+func recordBattleQuests(tx *db.Tx, e events.BattleFinished) error {
+	switch e.Mode {
+	case "friendly":
+		return nil
+	case "pvp":
+		for _, userID := range []int64{e.AttackerID, e.DefenderID} {
+			if err := recordQuestProgress(tx, userID, "pvp_battle", "", 1); err != nil {
+				return err
+			}
+		}
+		if e.WinnerID != nil {
+			if err := recordQuestProgress(tx, *e.WinnerID, "pvp_win", "", 1); err != nil {
+				return err
+			}
+		}
+	case "pve":
+		if e.WinnerID != nil {
+			if err := recordQuestProgress(tx, *e.WinnerID, "pve_win", "", 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Kills by deathrattle cards, from the card stats saved with the battle.
+	for _, userID := range []int64{e.AttackerID, e.DefenderID} {
+		if userID <= 0 {
+			continue
+		}
+		var kills int
+		err := tx.QueryRow(context.Background(),
+			`SELECT COALESCE(SUM(s.kills), 0) FROM battle_card_stats s
+			 JOIN card_definitions cd ON cd.id = s.card_id
+			 WHERE s.battle_id = $1 AND s.user_id = $2 AND cd.effects ? 'deathrattle'`,
+			e.BattleID, userID).Scan(&kills)
+		if err != nil {
+			return err
+		}
+		if err := recordQuestProgress(tx, userID, "deathrattle_kill", "", kills); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const questColumns = `id, template_id, period, period_start, progress, target, claimed_at`
+
+func scanQuest(row pgx.Row, quest *models.Quest) error {
+	var start time.Time
+	if err := row.Scan(&quest.ID, &quest.TemplateID, &quest.Period, &start, &quest.Progress, &quest.Target, &quest.ClaimedAt); err != nil {
+		return err
+	}
+	quest.Completed = quest.Progress >= quest.Target
+	quest.ExpiresAt = questPeriodEnd(quest.Period, start)
+	if t, ok := findQuestTemplate(quest.TemplateID); ok {
+		quest.Title = t.Title
+		quest.Reward = t.Reward
+	}
+	return nil
+}
+
+// GetUserQuests returns a player's quests for today and this week, handing
+// them out first if needed.
+func GetUserQuests(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if err := assignQuests(db.Pool, userID, now); err != nil {
+		http.Error(w, `{"error":"assign quests error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+questColumns+` FROM user_quests
+		 WHERE user_id = $1
+		   AND ((period = 'daily' AND period_start = $2) OR (period = 'weekly' AND period_start = $3))
+		 ORDER BY id`,
+		userID, questPeriodStart("daily", now), questPeriodStart("weekly", now))
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	quests := map[string][]models.Quest{"daily": {}, "weekly": {}}
+	for rows.Next() {
+		var quest models.Quest
+		if err := scanQuest(rows, &quest); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		quests[quest.Period] = append(quests[quest.Period], quest)
+	}
+
+	writeJSON(w, http.StatusOK, quests)
+}
+
+// ClaimQuest pays out a completed quest's reward. Quests can only be claimed
+// in the period they were handed out for.
+func ClaimQuest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	questID, err := strconv.ParseInt(vars["quest_id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid quest id"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var quest models.Quest
+	err = scanQuest(tx.QueryRow(ctx,
+		`SELECT `+questColumns+` FROM user_quests WHERE id = $1 AND user_id = $2 FOR UPDATE`,
+		questID, userID), &quest)
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"quest not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if quest.ClaimedAt != nil {
+		http.Error(w, `{"error":"quest already claimed"}`, http.StatusConflict)
+		return
+	}
+	if !time.Now().Before(quest.ExpiresAt) {
+		http.Error(w, `{"error":"quest has expired"}`, http.StatusConflict)
+		return
+	}
+	if !quest.Completed {
+		http.Error(w, `{"error":"quest is not complete"}`, http.StatusBadRequest)
+		return
+	}
+
+	err = tx.QueryRow(ctx,
+		`UPDATE user_quests SET claimed_at = NOW() WHERE id = $1 RETURNING claimed_at`,
+		quest.ID).Scan(&quest.ClaimedAt)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	rewards, err := giveReward(tx, userID, quest.Reward)
+	if err != nil {
+		http.Error(w, `{"error":"give reward error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"quest":   quest,
+		"rewards": rewards,
+	})
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"log"
+	"time"
+)
+
+// StartBackgroundJobs launches the periodic jobs the game needs (closing
+// seasons and so on). Each job runs in its own goroutine.
+func StartBackgroundJobs() {
+	go every(time.Minute, "close seasons", closeEndedSeasons)
+	go every(time.Minute, "backfill battle stats", backfillBattleStats)
+	go every(time.Minute, "expire challenges", expireChallenges)
+	go every(time.Minute, "advance tournaments", advanceTournaments)
+	go every(time.Minute, "close guild wars", closeGuildWars)
+	go every(time.Minute, "open guild wars", openGuildWars)
+	go every(time.Minute, "open world boss", openWorldBoss)
+	go every(5*time.Second, "dispatch webhooks", dispatchWebhooks)
+	go runReactors()
+	go every(time.Hour, "prune outbox", pruneOutbox)
+}
+
+func every(interval time.Duration, name string, job func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := job(); err != nil {
+			log.Printf("job %s: %v", name, err)
+		}
+		<-ticker.C
+	}
+}
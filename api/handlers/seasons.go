@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imperium/db"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// seasonReward is granted to everyone whose final rating rank is at most
+// MaxRank. A MaxRank of 0 matches every ranked player. Only the first
+// matching tier is granted.
+type seasonReward struct {
+	MaxRank int
+	Items   map[string]int
+	CardID  string
+}
+
+var seasonRewards = []seasonReward{
+	{MaxRank: 1, Items: map[string]int{"gold_key": 3}, CardID: "pvp-champion"},
+	{MaxRank: 10, Items: map[string]int{"gold_key": 2}},
+	{MaxRank: 100, Items: map[string]int{"silver_key": 2}},
+	{MaxRank: 0, Items: map[string]int{"bronze_key": 1}},
+}
+
+// rewardBoard is the board whose final standings decide season rewards.
+const rewardBoard = "rating"
+
+type CreateSeasonRequest struct {
+	Name     string    `json:"name"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
+
+func GetSeasons(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, name, starts_at, ends_at, closed_at FROM seasons ORDER BY starts_at DESC`)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	seasons := []models.Season{}
+	for rows.Next() {
+		var s models.Season
+		if err := rows.Scan(&s.ID, &s.Name, &s.StartsAt, &s.EndsAt, &s.ClosedAt); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		seasons = append(seasons, s)
+	}
+
+	writeJSON(w, http.StatusOK, seasons)
+}
+
+func GetCurrentSeason(w http.ResponseWriter, r *http.Request) {
+	season, err := currentSeason(db.Pool)
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"no season running"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, season)
+}
+
+// GetSeasonStandings returns the final standings snapshotted when a season
+// closed.
+func GetSeasonStandings(w http.ResponseWriter, r *http.Request) {
+	seasonID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"invalid season id"}`, http.StatusBadRequest)
+		return
+	}
+	board := r.URL.Query().Get("board")
+	if board == "" {
+		board = rewardBoard
+	}
+	if lb, ok := leaderboards[board]; !ok || !lb.seasonal {
+		http.Error(w, `{"error":"unknown seasonal leaderboard"}`, http.StatusNotFound)
+		return
+	}
+	limit, offset := pageParams(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT ss.rank, ss.user_id, COALESCE(u.username, ''), ss.score
+		 FROM season_standings ss JOIN users u ON u.id = ss.user_id
+		 WHERE ss.season_id = $1 AND ss.board = $2
+		 ORDER BY ss.rank, ss.user_id
+		 LIMIT $3 OFFSET $4`, seasonID, board, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.LeaderboardEntry{}
+	for rows.Next() {
+		var e models.LeaderboardEntry
+		if err := rows.Scan(&e.Rank, &e.UserID, &e.Username, &e.Score); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"board": board, "entries": entries})
+}
+
+// CreateSeason schedules a season. It must not overlap a season that is
+// still open.
+func CreateSeason(w http.ResponseWriter, r *http.Request) {
+	var req CreateSeasonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || !req.EndsAt.After(req.StartsAt) {
+		http.Error(w, `{"error":"name required and ends_at must be after starts_at"}`, http.StatusBadRequest)
+		return
+	}
+
+	var overlaps bool
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT EXISTS(SELECT 1 FROM seasons
+		 WHERE closed_at IS NULL AND starts_at < $2 AND ends_at > $1)`,
+		req.StartsAt, req.EndsAt).Scan(&overlaps)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if overlaps {
+		http.Error(w, `{"error":"season overlaps an open season"}`, http.StatusConflict)
+		return
+	}
+
+	season := models.Season{Name: req.Name, StartsAt: req.StartsAt, EndsAt: req.EndsAt}
+	err = db.Pool.QueryRow(context.Background(),
+		`INSERT INTO seasons (name, starts_at, ends_at) VALUES ($1, $2, $3) RETURNING id`,
+		req.Name, req.StartsAt, req.EndsAt).Scan(&season.ID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, season)
+}
+
+// CloseSeason ends a season early.
+func CloseSeason(w http.ResponseWriter, r *http.Request) {
+	seasonID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"invalid season id"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := closeSeason(seasonID); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := grantSeasonRewards(); err != nil {
+		http.Error(w, `{"error":"reward error: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func currentSeason(q db.Querier) (*models.Season, error) {
+	var s models.Season
+	err := q.QueryRow(context.Background(),
+		`SELECT id, name, starts_at, ends_at, closed_at FROM seasons
+		 WHERE starts_at <= NOW() AND closed_at IS NULL
+		 ORDER BY starts_at DESC LIMIT 1`).Scan(&s.ID, &s.Name, &s.StartsAt, &s.EndsAt, &s.ClosedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// closeEndedSeasons is the background job that closes every season past its
+// end date and hands out any rewards still owed.
+func closeEndedSeasons() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id FROM seasons WHERE closed_at IS NULL AND ends_at <= NOW() ORDER BY ends_at`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := closeSeason(id); err != nil {
+			return fmt.Errorf("closing season %d: %w", id, err)
+		}
+	}
+	return grantSeasonRewards()
+}
+
+// closeSeason snapshots the final standings of the boards that reset each
+// season, softly resets ratings halfway back to 1000 and, unless one is
+// already scheduled, starts the next season with the same length.
+func closeSeason(seasonID int) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var season models.Season
+	err = tx.QueryRow(ctx,
+		`SELECT id, name, starts_at, ends_at FROM seasons WHERE id = $1 AND closed_at IS NULL FOR UPDATE`,
+		seasonID).Scan(&season.ID, &season.Name, &season.StartsAt, &season.EndsAt)
+	if err == pgx.ErrNoRows {
+		return &apiError{http.StatusNotFound, "season not found or already closed"}
+	}
+	if err != nil {
+		return err
+	}
+
+	for board, lb := range leaderboards {
+		if !lb.seasonal {
+			continue
+		}
+		ranked, args := rankedQuery(lb, seasonID)
+		n := len(args)
+		_, err := tx.Exec(ctx,
+			ranked+fmt.Sprintf(`INSERT INTO season_standings (season_id, board, user_id, rank, score)
+			 SELECT $%d, $%d, user_id, rank, score FROM ranked`, n+1, n+2),
+			append(args, seasonID, board)...)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", board, err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET rating = 1000 + (rating - 1000) / 2`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE seasons SET closed_at = NOW() WHERE id = $1`, seasonID); err != nil {
+		return err
+	}
+
+	var scheduled bool
+	err = tx.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM seasons WHERE closed_at IS NULL AND ends_at > NOW())`).Scan(&scheduled)
+	if err != nil {
+		return err
+	}
+	if !scheduled {
+		var count int
+		if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM seasons`).Scan(&count); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			`INSERT INTO seasons (name, starts_at, ends_at) VALUES ($1, NOW(), NOW() + $2 * INTERVAL '1 second')`,
+			fmt.Sprintf("Season %d", count+1), int64(season.EndsAt.Sub(season.StartsAt).Seconds()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// grantSeasonRewards hands out rewards for every closed season standing that
+// has not been rewarded yet, one player per transaction so a failure
+// part-way through resumes where it stopped.
+func grantSeasonRewards() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT ss.season_id, ss.user_id, ss.rank
+		 FROM season_standings ss JOIN seasons s ON s.id = ss.season_id
+		 WHERE ss.board = $1 AND ss.rewarded_at IS NULL AND s.closed_at IS NOT NULL
+		 ORDER BY ss.season_id, ss.rank`, rewardBoard)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		seasonID int
+		userID   int64
+		rank     int
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.seasonID, &p.userID, &p.rank); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+
+	for _, p := range todo {
+		if err := grantSeasonReward(p.seasonID, p.userID, p.rank); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantSeasonReward claims one standing and pays its reward in the same
+// transaction. A standing another instance has already claimed is skipped.
+func grantSeasonReward(seasonID int, userID int64, rank int) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var claimed int64
+	err = tx.QueryRow(ctx,
+		`UPDATE season_standings SET rewarded_at = NOW()
+		 WHERE season_id = $1 AND board = $2 AND user_id = $3 AND rewarded_at IS NULL
+		 RETURNING user_id`, seasonID, rewardBoard, userID).Scan(&claimed)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, reward := range seasonRewards {
+		if reward.MaxRank != 0 && rank > reward.MaxRank {
+			continue
+		}
+		for item, qty := range reward.Items {
+			if err := giveItem(tx, userID, item, qty); err != nil {
+				return err
+			}
+		}
+		if reward.CardID != "" {
+			if _, err := giveCard(tx, userID, reward.CardID); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxSimulationRuns caps batch simulations per request.
+const maxSimulationRuns = 500
+
+// SimulateCard is a catalog card for a simulated deck, optionally with its
+// stats overridden. Card quality doesn't change battle stats, so HP and
+// attack are set directly. A bare string is read as just the card id.
+type SimulateCard struct {
+	CardID string `json:"card_id"`
+	HP     *int16 `json:"hp"`
+	Attack *int16 `json:"attack"`
+}
+
+func (c *SimulateCard) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &c.CardID)
+	}
+	type plain SimulateCard
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// SimulateDeck is one side of a simulation: a list of catalog cards, a deck
+// by id, or a player's active deck for a purpose ("attack" by default).
+type SimulateDeck struct {
+	Cards   []SimulateCard `json:"cards"`
+	DeckID  string         `json:"deck_id"`
+	UserID  int64          `json:"user_id"`
+	Purpose string         `json:"purpose"`
+}
+
+type SimulateRequest struct {
+	Attacker SimulateDeck `json:"attacker"`
+	Defender SimulateDeck `json:"defender"`
+	// Mode plays by the rules of that mode, the standard ones by default.
+	// Rules sets any of them itself. Batches flip a coin for the first move
+	// unless it is set.
+	Mode  string        `json:"mode"`
+	Rules *engine.Rules `json:"rules"`
+	// Seed drives coin flips and shuffles; run i of a batch uses Seed+i. A
+	// random one is used when unset.
+	Seed *int64 `json:"seed"`
+	// Shuffle plays each run with both decks in a random order.
+	Shuffle bool `json:"shuffle"`
+	// Runs above 1 plays a batch and returns only the totals.
+	Runs int `json:"runs"`
+}
+
+// Simulate fights two decks without spending or storing anything, returning
+// the battle log, or win rates over a batch of seeded runs.
+func Simulate(w http.ResponseWriter, r *http.Request) {
+	var req SimulateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Runs > maxSimulationRuns {
+		http.Error(w, `{"error":"at most 500 runs"}`, http.StatusBadRequest)
+		return
+	}
+	batch := req.Runs > 1
+
+	rules := battleRules(req.Mode)
+	if req.Rules != nil {
+		if req.Rules.MaxRounds != 0 {
+			rules.MaxRounds = req.Rules.MaxRounds
+		}
+		if req.Rules.FirstMover != "" {
+			rules.FirstMover = req.Rules.FirstMover
+		}
+		if req.Rules.Tiebreak != "" {
+			rules.Tiebreak = req.Rules.Tiebreak
+		}
+		if req.Rules.RoundDurationMs != 0 {
+			rules.RoundDurationMs = req.Rules.RoundDurationMs
+		}
+	}
+	if batch && (req.Rules == nil || req.Rules.FirstMover == "") {
+		rules.FirstMover = engine.FirstCoinFlip
+	}
+	rules, err := engine.CheckRules(rules)
+	if err != nil {
+		writeError(w, &apiError{http.StatusBadRequest, err.Error()})
+		return
+	}
+
+	attackerDeck, err := simulationDeck(req.Attacker)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defenderDeck, err := simulationDeck(req.Defender)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	seed := rand.Int63()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+
+	run := func(seed int64) (models.BattleLog, []models.BattleCard, []models.BattleCard) {
+		att, def := attackerDeck, defenderDeck
+		if req.Shuffle {
+			rng := rand.New(rand.NewSource(seed))
+			att, def = shuffledDeck(rng, att), shuffledDeck(rng, def)
+		}
+		rules := rules
+		rules.Seed = seed
+		return engine.RunBattleWith(att, def, rules), att, def
+	}
+
+	if !batch {
+		battleLog, att, def := run(seed)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"seed":          seed,
+			"first_mover":   battleLog.Rules.FirstMover,
+			"moved_first":   engine.FirstSide(*battleLog.Rules),
+			"rules":         battleLog.Rules,
+			"winner":        battleLog.Winner,
+			"rounds":        battleLog.TotalRounds,
+			"attacker_deck": att,
+			"defender_deck": def,
+			"battle_log":    battleLog,
+		})
+		return
+	}
+
+	wins := map[string]int{"attacker": 0, "defender": 0, "tie": 0}
+	totalRounds := 0
+	for i := 0; i < req.Runs; i++ {
+		battleLog, _, _ := run(seed + int64(i))
+		wins[battleLog.Winner]++
+		totalRounds += battleLog.TotalRounds
+	}
+	rate := func(n int) float64 {
+		return float64(n) / float64(req.Runs)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"seed":              seed,
+		"runs":              req.Runs,
+		"rules":             rules,
+		"attacker_wins":     wins["attacker"],
+		"defender_wins":     wins["defender"],
+		"ties":              wins["tie"],
+		"attacker_win_rate": rate(wins["attacker"]),
+		"defender_win_rate": rate(wins["defender"]),
+		"tie_rate":          rate(wins["tie"]),
+		"avg_rounds":        float64(totalRounds) / float64(req.Runs),
+	})
+}
+
+// simulationDeck builds one side of a simulation.
+func simulationDeck(d SimulateDeck) ([]models.BattleCard, error) {
+	var deck []models.BattleCard
+	var err error
+	switch {
+	case len(d.Cards) > 0:
+		if len(d.Cards) > 5 {
+			return nil, &apiError{http.StatusBadRequest, "max 5 cards per deck"}
+		}
+		ids := make([]string, len(d.Cards))
+		for i, c := range d.Cards {
+			ids[i] = c.CardID
+		}
+		deck, err = buildBotDeck(ids)
+		if err == pgx.ErrNoRows {
+			return nil, &apiError{http.StatusBadRequest, "unknown card"}
+		}
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "load cards error"}
+		}
+		for i, c := range d.Cards {
+			if c.HP != nil {
+				if *c.HP <= 0 {
+					return nil, &apiError{http.StatusBadRequest, "hp must be positive"}
+				}
+				deck[i].CurrentHP, deck[i].MaxHP = *c.HP, *c.HP
+			}
+			if c.Attack != nil {
+				deck[i].Attack = *c.Attack
+			}
+		}
+	case d.DeckID != "":
+		deck, err = loadDeck(d.DeckID)
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "load deck error"}
+		}
+	case d.UserID != 0:
+		purpose := d.Purpose
+		if purpose == "" {
+			purpose = "attack"
+		}
+		deck, err = loadActiveDeck(d.UserID, purpose)
+		if err != nil {
+			return nil, &apiError{http.StatusInternalServerError, "load deck error"}
+		}
+	}
+	if len(deck) == 0 {
+		return nil, &apiError{http.StatusBadRequest, "each side needs cards, a deck_id or a user_id with a deck"}
+	}
+	return deck, nil
+}
+
+func shuffledDeck(rng *rand.Rand, deck []models.BattleCard) []models.BattleCard {
+	out := append([]models.BattleCard{}, deck...)
+	rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
@@ -0,0 +1,803 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"imperium/db"
+	"imperium/engine"
+	"imperium/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	formatSingleElimination = "single_elimination"
+	formatSwiss             = "swiss"
+)
+
+// tournamentPrizeShares is the percentage of the prize pool paid per final
+// rank. Players sharing a rank split its share; rounding leftovers go to the
+// champion.
+var tournamentPrizeShares = map[int]int{1: 50, 2: 30, 3: 20}
+
+type CreateTournamentRequest struct {
+	Name                 string    `json:"name"`
+	Format               string    `json:"format"`
+	EntryFee             int       `json:"entry_fee"`
+	MaxPlayers           int       `json:"max_players"`
+	SwissRounds          int       `json:"swiss_rounds"`
+	RoundIntervalMinutes int       `json:"round_interval_minutes"`
+	RegistrationClosesAt time.Time `json:"registration_closes_at"`
+}
+
+type RegisterTournamentRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+const tournamentColumns = `id, name, format, status, entry_fee, max_players, swiss_rounds, round_interval_minutes,
+	current_round, prize_pool, registration_closes_at, next_round_at, created_at, finished_at`
+
+func scanTournament(row pgx.Row, t *models.Tournament) error {
+	return row.Scan(&t.ID, &t.Name, &t.Format, &t.Status, &t.EntryFee, &t.MaxPlayers, &t.SwissRounds,
+		&t.RoundIntervalMinutes, &t.CurrentRound, &t.PrizePool, &t.RegistrationClosesAt, &t.NextRoundAt,
+		&t.CreatedAt, &t.FinishedAt)
+}
+
+func CreateTournament(w http.ResponseWriter, r *http.Request) {
+	var req CreateTournamentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, `{"error":"name required"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Format != formatSingleElimination && req.Format != formatSwiss {
+		http.Error(w, `{"error":"format must be single_elimination or swiss"}`, http.StatusBadRequest)
+		return
+	}
+	if req.EntryFee < 0 || req.SwissRounds < 0 {
+		http.Error(w, `{"error":"entry_fee and swiss_rounds must not be negative"}`, http.StatusBadRequest)
+		return
+	}
+	if req.MaxPlayers == 0 {
+		req.MaxPlayers = 32
+	}
+	if req.MaxPlayers < 2 {
+		http.Error(w, `{"error":"max_players must be at least 2"}`, http.StatusBadRequest)
+		return
+	}
+	if req.RoundIntervalMinutes <= 0 {
+		req.RoundIntervalMinutes = 10
+	}
+	if !req.RegistrationClosesAt.After(time.Now()) {
+		http.Error(w, `{"error":"registration_closes_at must be in the future"}`, http.StatusBadRequest)
+		return
+	}
+
+	var t models.Tournament
+	err := scanTournament(db.Pool.QueryRow(context.Background(),
+		`INSERT INTO tournaments (name, format, entry_fee, max_players, swiss_rounds, round_interval_minutes, registration_closes_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING `+tournamentColumns,
+		req.Name, req.Format, req.EntryFee, req.MaxPlayers, req.SwissRounds, req.RoundIntervalMinutes, req.RegistrationClosesAt), &t)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+func GetTournaments(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	limit, offset := pageParams(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+tournamentColumns+` FROM tournaments
+		 WHERE ($1 = '' OR status = $1)
+		 ORDER BY created_at DESC LIMIT $2 OFFSET $3`, status, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tournaments := []models.Tournament{}
+	for rows.Next() {
+		var t models.Tournament
+		if err := scanTournament(rows, &t); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		tournaments = append(tournaments, t)
+	}
+
+	writeJSON(w, http.StatusOK, tournaments)
+}
+
+// GetTournament returns a tournament with its entrants and the full bracket,
+// round by round, linking each played match to its battle replay.
+func GetTournament(w http.ResponseWriter, r *http.Request) {
+	tournamentID := mux.Vars(r)["id"]
+
+	var t models.Tournament
+	err := scanTournament(db.Pool.QueryRow(context.Background(),
+		`SELECT `+tournamentColumns+` FROM tournaments WHERE id = $1`, tournamentID), &t)
+	if err != nil {
+		http.Error(w, `{"error":"tournament not found"}`, http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT te.user_id, COALESCE(u.username, ''), te.seed, te.score, te.eliminated, te.final_rank, te.prize
+		 FROM tournament_entries te JOIN users u ON u.id = te.user_id
+		 WHERE te.tournament_id = $1
+		 ORDER BY te.final_rank NULLS LAST, te.score DESC, te.seed NULLS LAST, te.registered_at`, tournamentID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	entries := []models.TournamentEntry{}
+	for rows.Next() {
+		var e models.TournamentEntry
+		if err := rows.Scan(&e.UserID, &e.Username, &e.Seed, &e.Score, &e.Eliminated, &e.FinalRank, &e.Prize); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	matches, err := loadTournamentMatches(db.Pool, tournamentID, 0)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	type bracketRound struct {
+		Round   int                      `json:"round"`
+		Matches []models.TournamentMatch `json:"matches"`
+	}
+	rounds := []bracketRound{}
+	for _, m := range matches {
+		if m.BattleID != nil {
+			m.ReplayURL = "/battle/" + *m.BattleID
+		}
+		if len(rounds) == 0 || rounds[len(rounds)-1].Round != m.Round {
+			rounds = append(rounds, bracketRound{Round: m.Round})
+		}
+		rounds[len(rounds)-1].Matches = append(rounds[len(rounds)-1].Matches, m)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tournament": t,
+		"entries":    entries,
+		"rounds":     rounds,
+	})
+}
+
+// RegisterTournament signs a player up, charging the entry fee into the prize
+// pool and locking in the current stats of their attack deck.
+func RegisterTournament(w http.ResponseWriter, r *http.Request) {
+	var req RegisterTournamentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	deck, err := loadActiveDeck(req.UserID, "attack")
+	if err != nil {
+		http.Error(w, `{"error":"load deck error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(deck) == 0 {
+		http.Error(w, `{"error":"deck is empty, set your deck first"}`, http.StatusBadRequest)
+		return
+	}
+	deckJSON, _ := json.Marshal(deck)
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var t models.Tournament
+	err = scanTournament(tx.QueryRow(ctx,
+		`SELECT `+tournamentColumns+` FROM tournaments WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]), &t)
+	if err != nil {
+		http.Error(w, `{"error":"tournament not found"}`, http.StatusNotFound)
+		return
+	}
+	if t.Status != "registration" || time.Now().After(t.RegistrationClosesAt) {
+		http.Error(w, `{"error":"registration is closed"}`, http.StatusConflict)
+		return
+	}
+
+	var count int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM tournament_entries WHERE tournament_id = $1`, t.ID).Scan(&count); err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if count >= t.MaxPlayers {
+		http.Error(w, `{"error":"tournament is full"}`, http.StatusConflict)
+		return
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO tournament_entries (tournament_id, user_id, deck) VALUES ($1, $2, $3)
+		 ON CONFLICT (tournament_id, user_id) DO NOTHING`, t.ID, req.UserID, deckJSON)
+	if err != nil {
+		http.Error(w, `{"error":"register error"}`, http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, `{"error":"already registered"}`, http.StatusConflict)
+		return
+	}
+
+	if t.EntryFee > 0 {
+		if err := takeItem(tx, req.UserID, currencyItem, t.EntryFee); err != nil {
+			writeError(w, err)
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE tournaments SET prize_pool = prize_pool + $2 WHERE id = $1`, t.ID, t.EntryFee); err != nil {
+			http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// advanceTournaments is the background job that starts tournaments whose
+// registration has closed and plays the rounds that are due.
+func advanceTournaments() error {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id FROM tournaments
+		 WHERE (status = 'registration' AND registration_closes_at <= NOW())
+		    OR (status = 'running' AND next_round_at <= NOW())
+		 ORDER BY created_at`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := advanceTournament(id); err != nil {
+			return fmt.Errorf("tournament %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func advanceTournament(tournamentID string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var t models.Tournament
+	err = scanTournament(tx.QueryRow(ctx,
+		`SELECT `+tournamentColumns+` FROM tournaments WHERE id = $1 FOR UPDATE`, tournamentID), &t)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case t.Status == "registration" && !time.Now().Before(t.RegistrationClosesAt):
+		err = startTournament(tx, &t)
+	case t.Status == "running" && t.NextRoundAt != nil && !time.Now().Before(*t.NextRoundAt):
+		err = playTournamentRound(tx, &t)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+type tournamentEntry struct {
+	userID     int64
+	deck       []models.BattleCard
+	seed       int
+	score      int
+	eliminated bool
+	hadBye     bool
+}
+
+func loadTournamentEntries(tx pgx.Tx, tournamentID string) ([]*tournamentEntry, error) {
+	rows, err := tx.Query(context.Background(),
+		`SELECT te.user_id, te.deck, COALESCE(te.seed, 0), te.score, te.eliminated,
+		        EXISTS(SELECT 1 FROM tournament_matches tm
+		               WHERE tm.tournament_id = te.tournament_id AND tm.player_a = te.user_id AND tm.player_b IS NULL)
+		 FROM tournament_entries te
+		 WHERE te.tournament_id = $1
+		 ORDER BY te.seed NULLS LAST, te.registered_at`, tournamentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*tournamentEntry
+	for rows.Next() {
+		var e tournamentEntry
+		var deckRaw json.RawMessage
+		if err := rows.Scan(&e.userID, &deckRaw, &e.seed, &e.score, &e.eliminated, &e.hadBye); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(deckRaw, &e.deck); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+func loadTournamentMatches(q db.Querier, tournamentID string, round int) ([]models.TournamentMatch, error) {
+	rows, err := q.Query(context.Background(),
+		`SELECT id, round, position, player_a, player_b, winner_id, battle_id
+		 FROM tournament_matches
+		 WHERE tournament_id = $1 AND ($2 = 0 OR round = $2)
+		 ORDER BY round, position`, tournamentID, round)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []models.TournamentMatch{}
+	for rows.Next() {
+		var m models.TournamentMatch
+		if err := rows.Scan(&m.ID, &m.Round, &m.Position, &m.PlayerA, &m.PlayerB, &m.WinnerID, &m.BattleID); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// startTournament seeds the entrants at random and pairs the first round. With
+// fewer than two entrants the tournament is cancelled and fees refunded.
+func startTournament(tx pgx.Tx, t *models.Tournament) error {
+	ctx := context.Background()
+	entries, err := loadTournamentEntries(tx, t.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) < 2 {
+		for _, e := range entries {
+			if t.EntryFee > 0 {
+				if err := giveItem(tx, e.userID, currencyItem, t.EntryFee); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := tx.Exec(ctx,
+			`UPDATE tournaments SET status = 'cancelled', prize_pool = 0, finished_at = NOW() WHERE id = $1`, t.ID)
+		return err
+	}
+
+	rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	for i, e := range entries {
+		e.seed = i + 1
+		_, err := tx.Exec(ctx,
+			`UPDATE tournament_entries SET seed = $3 WHERE tournament_id = $1 AND user_id = $2`, t.ID, e.userID, e.seed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.Format == formatSwiss && t.SwissRounds == 0 {
+		t.SwissRounds = bits.Len(uint(len(entries) - 1))
+	}
+
+	var pairs [][2]*tournamentEntry
+	if t.Format == formatSwiss {
+		pairs = swissPairings(entries, nil)
+	} else {
+		pairs = eliminationFirstRound(entries)
+	}
+	if err := insertTournamentRound(tx, t.ID, 1, pairs); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE tournaments SET status = 'running', swiss_rounds = $2, current_round = 1,
+		        next_round_at = NOW() + $3 * INTERVAL '1 minute'
+		 WHERE id = $1`, t.ID, t.SwissRounds, t.RoundIntervalMinutes)
+	return err
+}
+
+// eliminationFirstRound places entrants (ordered by seed) into a bracket the
+// size of the next power of two using standard seeding, so the top seeds get
+// the byes and can only meet late.
+func eliminationFirstRound(entries []*tournamentEntry) [][2]*tournamentEntry {
+	size := 1
+	for size < len(entries) {
+		size *= 2
+	}
+	order := []int{1}
+	for len(order) < size {
+		next := make([]int, 0, len(order)*2)
+		for _, s := range order {
+			next = append(next, s, 2*len(order)+1-s)
+		}
+		order = next
+	}
+
+	pairs := make([][2]*tournamentEntry, 0, size/2)
+	for i := 0; i < size; i += 2 {
+		var pair [2]*tournamentEntry
+		for j, seed := range order[i : i+2] {
+			if seed <= len(entries) {
+				pair[j] = entries[seed-1]
+			}
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// swissPairings pairs the entrants still in play by score, avoiding rematches
+// where possible. With an odd count the lowest ranked player who hasn't had a
+// bye yet gets one.
+func swissPairings(entries []*tournamentEntry, played map[[2]int64]bool) [][2]*tournamentEntry {
+	ranked := make([]*tournamentEntry, len(entries))
+	copy(ranked, entries)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].seed < ranked[j].seed
+	})
+
+	var pairs [][2]*tournamentEntry
+	if len(ranked)%2 == 1 {
+		byeIdx := len(ranked) - 1
+		for i := len(ranked) - 1; i >= 0; i-- {
+			if !ranked[i].hadBye {
+				byeIdx = i
+				break
+			}
+		}
+		pairs = append(pairs, [2]*tournamentEntry{ranked[byeIdx], nil})
+		ranked = append(ranked[:byeIdx], ranked[byeIdx+1:]...)
+	}
+
+	paired := make([]bool, len(ranked))
+	for i := range ranked {
+		if paired[i] {
+			continue
+		}
+		opponent := -1
+		for j := i + 1; j < len(ranked); j++ {
+			if paired[j] {
+				continue
+			}
+			if opponent < 0 {
+				opponent = j
+			}
+			if !played[matchKey(ranked[i].userID, ranked[j].userID)] {
+				opponent = j
+				break
+			}
+		}
+		paired[i], paired[opponent] = true, true
+		pairs = append(pairs, [2]*tournamentEntry{ranked[i], ranked[opponent]})
+	}
+	return pairs
+}
+
+func matchKey(a, b int64) [2]int64 {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]int64{a, b}
+}
+
+func insertTournamentRound(tx pgx.Tx, tournamentID string, round int, pairs [][2]*tournamentEntry) error {
+	for position, pair := range pairs {
+		// A bye always has its player in slot A.
+		if pair[0] == nil {
+			pair[0], pair[1] = pair[1], nil
+		}
+		var playerA, playerB *int64
+		if pair[0] != nil {
+			playerA = &pair[0].userID
+		}
+		if pair[1] != nil {
+			playerB = &pair[1].userID
+		}
+		_, err := tx.Exec(context.Background(),
+			`INSERT INTO tournament_matches (tournament_id, round, position, player_a, player_b)
+			 VALUES ($1, $2, $3, $4, $5)`, tournamentID, round, position, playerA, playerB)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// playTournamentRound fights every match of the current round with the
+// locked-in decks, then pairs the next round or finishes the tournament.
+//
+// Single elimination: the loser is out; a tie goes to slot A, the better
+// seed. Swiss: a win or bye is worth 3 points, a tie 1.
+func playTournamentRound(tx pgx.Tx, t *models.Tournament) error {
+	ctx := context.Background()
+	entries, err := loadTournamentEntries(tx, t.ID)
+	if err != nil {
+		return err
+	}
+	byUser := map[int64]*tournamentEntry{}
+	for _, e := range entries {
+		byUser[e.userID] = e
+	}
+
+	matches, err := loadTournamentMatches(tx, t.ID, t.CurrentRound)
+	if err != nil {
+		return err
+	}
+
+	// Bracket size, used to work out the rank of a player knocked out in
+	// this round.
+	bracketSize := 0
+	if t.Format == formatSingleElimination {
+		var firstRound int
+		if err := tx.QueryRow(ctx,
+			`SELECT COUNT(*) FROM tournament_matches WHERE tournament_id = $1 AND round = 1`, t.ID).Scan(&firstRound); err != nil {
+			return err
+		}
+		bracketSize = firstRound * 2
+	}
+
+	for i := range matches {
+		m := &matches[i]
+		if m.PlayerA == nil {
+			continue
+		}
+		a := byUser[*m.PlayerA]
+
+		if m.PlayerB == nil {
+			m.WinnerID = m.PlayerA
+			a.score += 3
+			_, err := tx.Exec(ctx,
+				`UPDATE tournament_matches SET winner_id = $2, resolved_at = NOW() WHERE id = $1`, m.ID, m.WinnerID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		b := byUser[*m.PlayerB]
+
+		battleLog := engine.RunBattleWith(a.deck, b.deck, battleRules("tournament"))
+		battleID, winnerID, err := saveBattle(tx, "tournament", a.userID, b.userID, a.deck, b.deck, battleLog)
+		if err != nil {
+			return err
+		}
+		m.BattleID = &battleID
+
+		if t.Format == formatSingleElimination {
+			if winnerID == nil {
+				winnerID = &a.userID
+			}
+			loser := a
+			if *winnerID == a.userID {
+				loser = b
+			}
+			byUser[*winnerID].score += 3
+			loser.eliminated = true
+			_, err := tx.Exec(ctx,
+				`UPDATE tournament_entries SET eliminated = TRUE, final_rank = $3
+				 WHERE tournament_id = $1 AND user_id = $2`,
+				t.ID, loser.userID, bracketSize>>t.CurrentRound+1)
+			if err != nil {
+				return err
+			}
+		} else if winnerID == nil {
+			a.score++
+			b.score++
+		} else {
+			byUser[*winnerID].score += 3
+		}
+		m.WinnerID = winnerID
+
+		_, err = tx.Exec(ctx,
+			`UPDATE tournament_matches SET winner_id = $2, battle_id = $3, resolved_at = NOW() WHERE id = $1`,
+			m.ID, winnerID, battleID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		_, err := tx.Exec(ctx,
+			`UPDATE tournament_entries SET score = $3 WHERE tournament_id = $1 AND user_id = $2`, t.ID, e.userID, e.score)
+		if err != nil {
+			return err
+		}
+	}
+
+	var next [][2]*tournamentEntry
+	if t.Format == formatSingleElimination {
+		if len(matches) > 1 {
+			for i := 0; i+1 < len(matches); i += 2 {
+				next = append(next, [2]*tournamentEntry{
+					winnerEntry(byUser, matches[i]), winnerEntry(byUser, matches[i+1]),
+				})
+			}
+		}
+	} else if t.CurrentRound < t.SwissRounds {
+		played, err := playedPairs(tx, t.ID)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			e.hadBye = e.hadBye || byeThisRound(matches, e.userID)
+		}
+		next = swissPairings(entries, played)
+	}
+
+	if next == nil {
+		return finishTournament(tx, t, entries)
+	}
+
+	if err := insertTournamentRound(tx, t.ID, t.CurrentRound+1, next); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE tournaments SET current_round = current_round + 1,
+		        next_round_at = NOW() + $2 * INTERVAL '1 minute'
+		 WHERE id = $1`, t.ID, t.RoundIntervalMinutes)
+	return err
+}
+
+func winnerEntry(byUser map[int64]*tournamentEntry, m models.TournamentMatch) *tournamentEntry {
+	if m.WinnerID == nil {
+		return nil
+	}
+	return byUser[*m.WinnerID]
+}
+
+func byeThisRound(matches []models.TournamentMatch, userID int64) bool {
+	for _, m := range matches {
+		if m.PlayerB == nil && m.PlayerA != nil && *m.PlayerA == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func playedPairs(tx pgx.Tx, tournamentID string) (map[[2]int64]bool, error) {
+	rows, err := tx.Query(context.Background(),
+		`SELECT player_a, player_b FROM tournament_matches
+		 WHERE tournament_id = $1 AND player_a IS NOT NULL AND player_b IS NOT NULL`, tournamentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	played := map[[2]int64]bool{}
+	for rows.Next() {
+		var a, b int64
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, err
+		}
+		played[matchKey(a, b)] = true
+	}
+	return played, rows.Err()
+}
+
+// finishTournament assigns final ranks (Swiss: by score, then seed; single
+// elimination: the remaining player wins) and pays out the prize pool.
+func finishTournament(tx pgx.Tx, t *models.Tournament, entries []*tournamentEntry) error {
+	ctx := context.Background()
+
+	ranks := map[int64]int{}
+	if t.Format == formatSwiss {
+		ranked := make([]*tournamentEntry, len(entries))
+		copy(ranked, entries)
+		sort.SliceStable(ranked, func(i, j int) bool {
+			if ranked[i].score != ranked[j].score {
+				return ranked[i].score > ranked[j].score
+			}
+			return ranked[i].seed < ranked[j].seed
+		})
+		for i, e := range ranked {
+			ranks[e.userID] = i + 1
+		}
+	} else {
+		for _, e := range entries {
+			if !e.eliminated {
+				ranks[e.userID] = 1
+			}
+		}
+		rows, err := tx.Query(ctx,
+			`SELECT user_id, final_rank FROM tournament_entries WHERE tournament_id = $1 AND final_rank IS NOT NULL`, t.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var userID int64
+			var rank int
+			if err := rows.Scan(&userID, &rank); err != nil {
+				rows.Close()
+				return err
+			}
+			ranks[userID] = rank
+		}
+		rows.Close()
+	}
+
+	byRank := map[int][]int64{}
+	for userID, rank := range ranks {
+		byRank[rank] = append(byRank[rank], userID)
+	}
+	prizes := map[int64]int{}
+	paid := 0
+	for rank, share := range tournamentPrizeShares {
+		winners := byRank[rank]
+		if len(winners) == 0 {
+			continue
+		}
+		each := t.PrizePool * share / 100 / len(winners)
+		for _, userID := range winners {
+			prizes[userID] += each
+			paid += each
+		}
+	}
+	if champions := byRank[1]; len(champions) > 0 {
+		prizes[champions[0]] += t.PrizePool - paid
+	}
+
+	for userID, rank := range ranks {
+		prize := prizes[userID]
+		if prize > 0 {
+			if err := giveItem(tx, userID, currencyItem, prize); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx,
+			`UPDATE tournament_entries SET final_rank = $3, prize = $4 WHERE tournament_id = $1 AND user_id = $2`,
+			t.ID, userID, rank, prize)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(ctx,
+		`UPDATE tournaments SET status = 'finished', next_round_at = NULL, finished_at = NOW() WHERE id = $1`, t.ID)
+	return err
+}
@@ -28,14 +28,45 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	err := db.Pool.QueryRow(context.Background(),
 		`INSERT INTO users (id, username) VALUES ($1, $2)
 		 ON CONFLICT (id) DO UPDATE SET username = EXCLUDED.username
-		 RETURNING id, username, created_at`,
+		 RETURNING id, username, rating, created_at`,
 		req.ID, req.Username,
-	).Scan(&user.ID, &user.Username, &user.CreatedAt)
+	).Scan(&user.ID, &user.Username, &user.Rating, &user.CreatedAt)
 	if err != nil {
 		http.Error(w, `{"error":"db error: `+err.Error()+`"}`, http.StatusInternalServerError)
 		return
 	}
 
+	user.Guild, err = guildMembership(db.Pool, user.ID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT id, COALESCE(username, ''), rating, created_at FROM users WHERE id = $1`, userID).Scan(
+		&user.ID, &user.Username, &user.Rating, &user.CreatedAt)
+	if err != nil {
+		http.Error(w, `{"error":"user not found"}`, http.StatusNotFound)
+		return
+	}
+
+	user.Guild, err = guildMembership(db.Pool, user.ID)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
 	writeJSON(w, http.StatusOK, user)
 }
 
@@ -85,3 +116,22 @@ func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
+
+// apiError is returned by helpers shared between handlers so the caller can
+// report the failure with the right status code.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if ae, ok := err.(*apiError); ok {
+		http.Error(w, `{"error":"`+ae.Message+`"}`, ae.Status)
+		return
+	}
+	http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusInternalServerError)
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"imperium/db"
+	"imperium/models"
+	"imperium/webhook"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried before it
+	// goes to the dead letters.
+	webhookMaxAttempts = 8
+	// webhookRetryBase is the wait after the first failed attempt; it
+	// doubles with every attempt after that, up to webhookRetryMax.
+	webhookRetryBase = 10 * time.Second
+	webhookRetryMax  = time.Hour
+	// webhookBatch is how many deliveries one dispatcher pass sends.
+	webhookBatch = 50
+	// outboxRetention is how long delivered events are kept.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is generated when left empty.
+	Secret string `json:"secret"`
+}
+
+// webhookRetryDelay is the wait before the next attempt after attempts
+// failed ones.
+func webhookRetryDelay(attempts int) time.Duration {
+	d := webhookRetryBase
+	for i := 1; i < attempts && d < webhookRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, webhookRetryMax)
+}
+
+// CreateWebhook registers a URL to receive game events. The response is the
+// only time the signing secret is shown.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, `{"error":"url must be an absolute http(s) url"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Events == nil {
+		req.Events = []string{}
+	}
+	if req.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			http.Error(w, `{"error":"secret error"}`, http.StatusInternalServerError)
+			return
+		}
+		req.Secret = hex.EncodeToString(buf)
+	}
+
+	hook := models.Webhook{URL: req.URL, Secret: req.Secret, Events: req.Events, Active: true}
+	err = db.Pool.QueryRow(context.Background(),
+		`INSERT INTO webhooks (url, secret, events) VALUES ($1, $2, $3) RETURNING id, created_at`,
+		hook.URL, hook.Secret, hook.Events).Scan(&hook.ID, &hook.CreatedAt)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, url, events, active, created_at FROM webhooks ORDER BY id`)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []models.Webhook{}
+	for rows.Next() {
+		var h models.Webhook
+		if err := rows.Scan(&h.ID, &h.URL, &h.Events, &h.Active, &h.CreatedAt); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		hooks = append(hooks, h)
+	}
+
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// DeleteWebhook switches a webhook off and drops its pending deliveries.
+// Dead letters are kept for inspection.
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid webhook id"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, `{"error":"tx error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE webhooks SET active = FALSE WHERE id = $1`, id)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, `{"error":"webhook not found"}`, http.StatusNotFound)
+		return
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = $1 AND status = 'pending'`, id)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, `{"error":"commit error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "active": false})
+}
+
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.outbox_id, o.event, o.payload, d.status, d.attempts,
+	d.next_attempt_at, d.last_status, d.last_error, d.delivered_at, d.created_at`
+
+func scanWebhookDelivery(row pgx.Row, d *models.WebhookDelivery) error {
+	return row.Scan(&d.ID, &d.WebhookID, &d.OutboxID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastStatus, &d.LastError, &d.DeliveredAt, &d.CreatedAt)
+}
+
+// GetDeadLetters lists deliveries that were given up on, newest first
+// (?webhook_id=, limit, offset).
+func GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	var webhookID *int64
+	if s := r.URL.Query().Get("webhook_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"invalid webhook id"}`, http.StatusBadRequest)
+			return
+		}
+		webhookID = &id
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries d
+		 JOIN outbox o ON o.id = d.outbox_id
+		 WHERE d.status = 'dead' AND ($1::BIGINT IS NULL OR d.webhook_id = $1)
+		 ORDER BY d.id DESC LIMIT $2 OFFSET $3`, webhookID, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			http.Error(w, `{"error":"scan error"}`, http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// RetryWebhookDelivery puts a dead delivery back in the queue with a fresh
+// set of attempts.
+func RetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"invalid delivery id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var d models.WebhookDelivery
+	err = scanWebhookDelivery(db.Pool.QueryRow(context.Background(),
+		`WITH d AS (
+		     UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		     WHERE id = $1 AND status = 'dead'
+		       AND webhook_id IN (SELECT id FROM webhooks WHERE active)
+		     RETURNING *
+		 )
+		 SELECT `+webhookDeliveryColumns+` FROM d JOIN outbox o ON o.id = d.outbox_id`, id), &d)
+	if err == pgx.ErrNoRows {
+		http.Error(w, `{"error":"no dead delivery with that id for an active webhook"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"db error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// dispatchWebhooks is the background job that turns new outbox events into
+// deliveries for every subscribed webhook and then sends whatever is due.
+func dispatchWebhooks() error {
+	if err := fanOutOutbox(); err != nil {
+		return err
+	}
+	return sendDueWebhooks()
+}
+
+// fanOutOutbox creates a delivery per subscribed webhook for each event not
+// dispatched yet. Webhooks only get events from after they were registered.
+func fanOutOutbox() error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT id FROM outbox WHERE dispatched_at IS NULL ORDER BY id LIMIT 1000 FOR UPDATE SKIP LOCKED`)
+	if err != nil {
+		return err
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO webhook_deliveries (webhook_id, outbox_id)
+		 SELECT w.id, o.id FROM outbox o
+		 JOIN webhooks w ON w.active AND o.created_at >= w.created_at
+		                AND (cardinality(w.events) = 0 OR o.event = ANY(w.events))
+		 WHERE o.id = ANY($1)
+		 ON CONFLICT (webhook_id, outbox_id) DO NOTHING`, ids)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE outbox SET dispatched_at = NOW() WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+type dueDelivery struct {
+	id        int64
+	attempts  int
+	url       string
+	secret    string
+	outboxID  int64
+	event     string
+	payload   json.RawMessage
+	createdAt time.Time
+}
+
+// sendDueWebhooks sends a batch of due deliveries. They are leased for a
+// minute first so a second dispatcher won't pick them up while they're in
+// flight.
+func sendDueWebhooks() error {
+	ctx := context.Background()
+	rows, err := db.Pool.Query(ctx,
+		`UPDATE webhook_deliveries d SET next_attempt_at = NOW() + INTERVAL '1 minute'
+		 FROM webhooks w, outbox o
+		 WHERE d.id IN (
+		         SELECT id FROM webhook_deliveries
+		         WHERE status = 'pending' AND next_attempt_at <= NOW()
+		         ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED
+		       )
+		   AND w.id = d.webhook_id AND o.id = d.outbox_id
+		 RETURNING d.id, d.attempts, w.url, w.secret, o.id, o.event, o.payload, o.created_at`, webhookBatch)
+	if err != nil {
+		return err
+	}
+	var due []dueDelivery
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.attempts, &d.url, &d.secret, &d.outboxID, &d.event, &d.payload, &d.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		status, sendErr := sendWebhook(d)
+		var err error
+		if sendErr == nil {
+			_, err = db.Pool.Exec(ctx,
+				`UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1,
+				        last_status = $2, last_error = NULL, delivered_at = NOW()
+				 WHERE id = $1`, d.id, status)
+		} else {
+			attempts := d.attempts + 1
+			var lastStatus *int
+			if status != 0 {
+				lastStatus = &status
+			}
+			next := "pending"
+			if attempts >= webhookMaxAttempts {
+				next = "dead"
+			}
+			_, err = db.Pool.Exec(ctx,
+				`UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status = $4, last_error = $5,
+				        next_attempt_at = NOW() + $6 * INTERVAL '1 second'
+				 WHERE id = $1`,
+				d.id, next, attempts, lastStatus, sendErr.Error(), int(webhookRetryDelay(attempts).Seconds()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendWebhook POSTs one signed delivery. It returns the HTTP status (0 if the
+// request never got one) and an error unless the receiver answered 2xx.
+func sendWebhook(d dueDelivery) (int, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":         d.outboxID,
+		"event":      d.event,
+		"created_at": d.createdAt,
+		"data":       d.payload,
+	})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.EventHeader, d.event)
+	req.Header.Set(webhook.DeliveryHeader, strconv.FormatInt(d.id, 10))
+	req.Header.Set(webhook.TimestampHeader, timestamp)
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(d.secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// pruneOutbox is the background job that deletes old events once every
+// delivery of them has gone through and the reactors are done with them.
+// Dead letters keep their event.
+func pruneOutbox() error {
+	_, err := db.Pool.Exec(context.Background(),
+		`DELETE FROM outbox o
+		 WHERE o.dispatched_at < NOW() - $1 * INTERVAL '1 second'
+		   AND (o.reacted_at IS NOT NULL OR o.react_attempts >= $2)
+		   AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.outbox_id = o.id AND d.status <> 'delivered')`,
+		int(outboxRetention.Seconds()), maxReactAttempts)
+	return err
+}
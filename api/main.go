@@ -24,6 +24,10 @@ func main() {
 	}
 	log.Println("Database migrated successfully")
 
+	handlers.AdminToken = cfg.AdminToken
+	handlers.RegisterSubscribers()
+	handlers.StartBackgroundJobs()
+
 	r := mux.NewRouter()
 
 	// CORS middleware
@@ -31,7 +35,7 @@ func main() {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Token, Last-Event-ID")
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
 				return
@@ -42,23 +46,110 @@ func main() {
 
 	// Users
 	r.HandleFunc("/users", handlers.CreateUser).Methods("POST")
+	r.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
 	r.HandleFunc("/users/{id}/inventory", handlers.GetInventory).Methods("GET")
 	r.HandleFunc("/users/{id}/deck", handlers.GetDeck).Methods("GET")
 	r.HandleFunc("/users/{id}/deck", handlers.SetDeck).Methods("PUT")
+	r.HandleFunc("/users/{id}/deck/active", handlers.SetActiveDeck).Methods("PUT")
+	r.HandleFunc("/users/{id}/decks", handlers.GetDecks).Methods("GET")
+	r.HandleFunc("/users/{id}/decks/{name}", handlers.DeleteDeck).Methods("DELETE")
 	r.HandleFunc("/users/{id}/items", handlers.GetItems).Methods("GET")
+	r.HandleFunc("/users/{id}/battles", handlers.GetUserBattles).Methods("GET")
+	r.HandleFunc("/users/{id}/battles/stats", handlers.GetUserBattleStats).Methods("GET")
+	r.HandleFunc("/users/{id}/challenges", handlers.GetUserChallenges).Methods("GET")
+	r.HandleFunc("/users/{id}/notifications", handlers.GetNotifications).Methods("GET")
+	r.HandleFunc("/users/{id}/notifications/unread-count", handlers.GetUnreadNotificationCount).Methods("GET")
+	r.HandleFunc("/users/{id}/notifications/read", handlers.MarkNotificationsRead).Methods("POST")
+	r.HandleFunc("/users/{id}/dungeon/runs", handlers.GetUserDungeonRuns).Methods("GET")
+	r.HandleFunc("/users/{id}/friends", handlers.GetFriends).Methods("GET")
+	r.HandleFunc("/users/{id}/friends", handlers.SendFriendRequest).Methods("POST")
+	r.HandleFunc("/users/{id}/friends/{friend_id}/accept", handlers.AcceptFriendRequest).Methods("POST")
+	r.HandleFunc("/users/{id}/friends/{friend_id}", handlers.RemoveFriend).Methods("DELETE")
+	r.HandleFunc("/users/{id}/quests", handlers.GetUserQuests).Methods("GET")
+	r.HandleFunc("/users/{id}/quests/{quest_id}/claim", handlers.ClaimQuest).Methods("POST")
+	r.HandleFunc("/users/{id}/achievements", handlers.GetUserAchievements).Methods("GET")
+
+	// Achievements
+	r.HandleFunc("/achievements/backfill", handlers.AdminOnly(handlers.BackfillAchievements)).Methods("POST")
+
+	// Bot notification feed
+	r.HandleFunc("/notifications/feed", handlers.AdminOnly(handlers.GetNotificationFeed)).Methods("GET")
+	r.HandleFunc("/notifications/delivered", handlers.AdminOnly(handlers.MarkNotificationsDelivered)).Methods("POST")
 
 	// Cards
 	r.HandleFunc("/cards", handlers.GetCards).Methods("GET")
 
 	// Loot
 	r.HandleFunc("/loot/case", handlers.OpenCase).Methods("POST")
-	r.HandleFunc("/loot/dungeon", handlers.EnterDungeon).Methods("POST")
+	r.HandleFunc("/loot/dungeon", handlers.EnterDungeon).Methods("POST") // deprecated: use /dungeon/runs
+
+	// Dungeon runs
+	r.HandleFunc("/dungeon/runs", handlers.StartDungeonRun).Methods("POST")
+	r.HandleFunc("/dungeon/runs/{id}", handlers.GetDungeonRun).Methods("GET")
+	r.HandleFunc("/dungeon/runs/{id}/continue", handlers.ContinueDungeonRun).Methods("POST")
+	r.HandleFunc("/dungeon/runs/{id}/abandon", handlers.AbandonDungeonRun).Methods("POST")
+
+	// Campaign
+	r.HandleFunc("/campaign", handlers.GetCampaign).Methods("GET")
+	r.HandleFunc("/campaign/stages/{id}", handlers.GetCampaignStage).Methods("GET")
+	r.HandleFunc("/campaign/stages/{id}/battle", handlers.BattleCampaignStage).Methods("POST")
+
+	// World boss
+	r.HandleFunc("/world-boss", handlers.GetWorldBoss).Methods("GET")
+	r.HandleFunc("/world-boss/attack", handlers.AttackWorldBoss).Methods("POST")
 
 	// Battle
 	r.HandleFunc("/battle/pve", handlers.BattlePvE).Methods("POST")
 	r.HandleFunc("/battle/pvp", handlers.BattlePvP).Methods("POST")
+	r.HandleFunc("/battle/pvp/find", handlers.FindPvP).Methods("POST")
+	r.HandleFunc("/battle/pvp/find", handlers.LeavePvPQueue).Methods("DELETE")
+	r.HandleFunc("/battle/friendly", handlers.BattleFriendly).Methods("POST")
+	r.HandleFunc("/battle/interactive", handlers.CreateInteractiveBattle).Methods("POST")
+	r.HandleFunc("/battle/interactive/{id}/ws", handlers.InteractiveBattleSocket).Methods("GET")
+	r.HandleFunc("/simulate", handlers.Simulate).Methods("POST")
+	r.HandleFunc("/battle/{id}/stream", handlers.StreamBattle).Methods("GET")
 	r.HandleFunc("/battle/{id}", handlers.GetBattle).Methods("GET")
 
+	// Challenges
+	r.HandleFunc("/challenges", handlers.CreateChallenge).Methods("POST")
+	r.HandleFunc("/challenges/{id}", handlers.GetChallenge).Methods("GET")
+	r.HandleFunc("/challenges/{id}/accept", handlers.AcceptChallenge).Methods("POST")
+	r.HandleFunc("/challenges/{id}/decline", handlers.DeclineChallenge).Methods("POST")
+	r.HandleFunc("/challenges/{id}/cancel", handlers.CancelChallenge).Methods("POST")
+
+	// Tournaments
+	r.HandleFunc("/tournaments", handlers.GetTournaments).Methods("GET")
+	r.HandleFunc("/tournaments", handlers.AdminOnly(handlers.CreateTournament)).Methods("POST")
+	r.HandleFunc("/tournaments/{id}", handlers.GetTournament).Methods("GET")
+	r.HandleFunc("/tournaments/{id}/register", handlers.RegisterTournament).Methods("POST")
+
+	// Guilds
+	r.HandleFunc("/guilds", handlers.GetGuilds).Methods("GET")
+	r.HandleFunc("/guilds", handlers.CreateGuild).Methods("POST")
+	r.HandleFunc("/guilds/{id}", handlers.GetGuild).Methods("GET")
+	r.HandleFunc("/guilds/{id}/join", handlers.JoinGuild).Methods("POST")
+	r.HandleFunc("/guilds/{id}/leave", handlers.LeaveGuild).Methods("POST")
+	r.HandleFunc("/guilds/{id}/kick", handlers.KickGuildMember).Methods("POST")
+	r.HandleFunc("/guilds/{id}/contribute", handlers.ContributeToGuild).Methods("POST")
+	r.HandleFunc("/guilds/{id}/members/{user_id}/role", handlers.SetGuildRole).Methods("PUT")
+	r.HandleFunc("/guilds/{id}/wars", handlers.GetGuildWars).Methods("GET")
+	r.HandleFunc("/guild-wars/{id}", handlers.GetGuildWar).Methods("GET")
+
+	// Webhooks
+	r.HandleFunc("/webhooks", handlers.AdminOnly(handlers.GetWebhooks)).Methods("GET")
+	r.HandleFunc("/webhooks", handlers.AdminOnly(handlers.CreateWebhook)).Methods("POST")
+	r.HandleFunc("/webhooks/dead-letters", handlers.AdminOnly(handlers.GetDeadLetters)).Methods("GET")
+	r.HandleFunc("/webhooks/deliveries/{id}/retry", handlers.AdminOnly(handlers.RetryWebhookDelivery)).Methods("POST")
+	r.HandleFunc("/webhooks/{id}", handlers.AdminOnly(handlers.DeleteWebhook)).Methods("DELETE")
+
+	// Leaderboards & seasons
+	r.HandleFunc("/leaderboards/{board}", handlers.GetLeaderboard).Methods("GET")
+	r.HandleFunc("/seasons", handlers.GetSeasons).Methods("GET")
+	r.HandleFunc("/seasons", handlers.AdminOnly(handlers.CreateSeason)).Methods("POST")
+	r.HandleFunc("/seasons/current", handlers.GetCurrentSeason).Methods("GET")
+	r.HandleFunc("/seasons/{id}/standings", handlers.GetSeasonStandings).Methods("GET")
+	r.HandleFunc("/seasons/{id}/close", handlers.AdminOnly(handlers.CloseSeason)).Methods("POST")
+
 	log.Printf("Imperium API starting on :%s", cfg.Port)
 	log.Fatal(http.ListenAndServe(":"+cfg.Port, r))
 }
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type Achievement struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Reward      *Reward    `json:"reward,omitempty"`
+	Unlocked    bool       `json:"unlocked"`
+	UnlockedAt  *time.Time `json:"unlocked_at,omitempty"`
+	BattleID    *string    `json:"battle_id,omitempty"`
+}
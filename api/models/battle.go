@@ -8,10 +8,31 @@ type Battle struct {
 	DefenderID *int64     `json:"defender_id,omitempty"`
 	WinnerID   *int64     `json:"winner_id,omitempty"`
 	BattleLog  *BattleLog `json:"battle_log,omitempty"`
+	Encounter  *Encounter `json:"encounter,omitempty"`
 	CreatedAt  time.Time     `json:"created_at"`
 }
 
+// BattleLogVersion is the version of the battle log model written now. Bump
+// it whenever the log's fields change and teach package battlelog how to
+// upgrade logs from the version before.
+const BattleLogVersion = 3
+
+// BattleRules are the rules a battle was played by.
+type BattleRules struct {
+	MaxRounds int `json:"max_rounds"`
+	// FirstMover is "defender", "attacker" or "coin_flip".
+	FirstMover string `json:"first_mover"`
+	// Tiebreak settles a battle still going after MaxRounds: "total_hp",
+	// "cards_remaining" or "sudden_death".
+	Tiebreak        string `json:"tiebreak"`
+	RoundDurationMs int64  `json:"round_duration_ms"`
+	// Seed decides the coin flip.
+	Seed int64 `json:"seed,omitempty"`
+}
+
 type BattleLog struct {
+	Version           int              `json:"version"`
+	Rules             *BattleRules     `json:"rules,omitempty"`
 	Entries           []BattleLogEntry `json:"entries"`
 	Winner            string           `json:"winner"`
 	TotalRounds       int              `json:"total_rounds"`
@@ -32,10 +53,11 @@ type BattleLogEntry struct {
 type BattleLogAction struct {
 	Type string `json:"type"`
 
-	// attack fields
-	AttackerID *int64 `json:"attacker_id,omitempty"`
-	DefenderID *int64 `json:"defender_id,omitempty"`
-	Damage     *int16 `json:"damage,omitempty"`
+	// attack fields; TargetSide is the side of the card taking the damage
+	AttackerID *int64  `json:"attacker_id,omitempty"`
+	DefenderID *int64  `json:"defender_id,omitempty"`
+	Damage     *int16  `json:"damage,omitempty"`
+	TargetSide *string `json:"target_side,omitempty"`
 
 	// spawn_card fields
 	Side        *string     `json:"side,omitempty"`
@@ -44,6 +66,10 @@ type BattleLogAction struct {
 	// card_died fields
 	DiedCardID *int64  `json:"died_card_id,omitempty"`
 	DiedSide   *string `json:"died_side,omitempty"`
+
+	// phase fields (a boss changing phase, e.g. gaining taunt or enraging)
+	CardID *int64  `json:"card_id,omitempty"`
+	Phase  *string `json:"phase,omitempty"`
 }
 
 type BattleCard struct {
@@ -56,3 +82,17 @@ type BattleCard struct {
 	Rarity    string   `json:"rarity"`
 	Effects   []string `json:"effects"`
 }
+
+// BattleSummary is a battle as seen from one player's side, without the log.
+type BattleSummary struct {
+	ID         string    `json:"id"`
+	Mode       string    `json:"mode"`
+	AttackerID int64     `json:"attacker_id"`
+	DefenderID *int64    `json:"defender_id,omitempty"`
+	WinnerID   *int64    `json:"winner_id,omitempty"`
+	OpponentID *int64    `json:"opponent_id,omitempty"`
+	Side       string    `json:"side"`
+	Result     string    `json:"result"`
+	Rounds     int       `json:"rounds"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,29 @@
+package models
+
+type CampaignChapter struct {
+	Number        int             `json:"number"`
+	Name          string          `json:"name"`
+	StarsToUnlock int             `json:"stars_to_unlock"`
+	Unlocked      bool            `json:"unlocked"`
+	Stars         int             `json:"stars"`
+	Stages        []CampaignStage `json:"stages"`
+}
+
+type CampaignStage struct {
+	ID         string              `json:"id"`
+	Name       string              `json:"name"`
+	Enemy      []string            `json:"enemy"`
+	Conditions []CampaignCondition `json:"conditions"`
+	Reward     Reward              `json:"reward"`
+	Unlocked   bool                `json:"unlocked"`
+	Stars      int                 `json:"stars"`
+	Attempts   int                 `json:"attempts"`
+}
+
+// CampaignCondition is an extra goal worth a star on top of winning.
+type CampaignCondition struct {
+	// max_rounds: win within Value rounds; no_losses: win without losing a
+	// card; min_remaining: win with at least Value cards left.
+	Kind  string `json:"kind"`
+	Value int    `json:"value,omitempty"`
+}
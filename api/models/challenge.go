@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+type Challenge struct {
+	ID               string     `json:"id"`
+	ChallengerID     int64      `json:"challenger_id"`
+	DefenderID       int64      `json:"defender_id"`
+	Status           string     `json:"status"`
+	StakeCoins       int        `json:"stake_coins"`
+	ChallengerCardID *string    `json:"challenger_card_id,omitempty"`
+	DefenderCardID   *string    `json:"defender_card_id,omitempty"`
+	BattleID         *string    `json:"battle_id,omitempty"`
+	WinnerID         *int64     `json:"winner_id,omitempty"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ResolvedAt       *time.Time `json:"resolved_at,omitempty"`
+}
+
+type Notification struct {
+	ID          int64                  `json:"id"`
+	UserID      int64                  `json:"user_id"`
+	Kind        string                 `json:"kind"`
+	Payload     map[string]interface{} `json:"payload"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ReadAt      *time.Time             `json:"read_at,omitempty"`
+	DeliveredAt *time.Time             `json:"delivered_at,omitempty"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type DungeonRun struct {
+	ID          string            `json:"id"`
+	UserID      int64             `json:"user_id"`
+	Dungeon     string            `json:"dungeon"`
+	Status      string            `json:"status"`
+	Floor       int               `json:"floor"`
+	Floors      int               `json:"floors"`
+	CoinsEarned int               `json:"coins_earned"`
+	CreatedAt   time.Time         `json:"created_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Deck        []DungeonRunCard  `json:"deck,omitempty"`
+	History     []DungeonRunFloor `json:"history,omitempty"`
+}
+
+// DungeonRunCard is a card in a run with the health it carries into the next
+// floor.
+type DungeonRunCard struct {
+	UserCardID string `json:"user_card_id"`
+	CardID     string `json:"card_id"`
+	Name       string `json:"name"`
+	CurrentHP  int    `json:"current_hp"`
+	MaxHP      int    `json:"max_hp"`
+}
+
+type DungeonRunFloor struct {
+	Floor    int             `json:"floor"`
+	BattleID *string         `json:"battle_id,omitempty"`
+	Cleared  bool            `json:"cleared"`
+	Loot     json.RawMessage `json:"loot"`
+}
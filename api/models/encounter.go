@@ -0,0 +1,11 @@
+package models
+
+// Encounter is everything needed to regenerate a procedurally generated PvE
+// bot deck.
+type Encounter struct {
+	Generator string   `json:"generator"`
+	Dungeon   string   `json:"dungeon"`
+	Seed      int64    `json:"seed"`
+	Budget    int      `json:"budget"`
+	Modifiers []string `json:"modifiers"`
+}
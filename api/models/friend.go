@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type Friend struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Rating   int    `json:"rating"`
+	Status   string `json:"status"`
+	// incoming or outgoing, for pending requests
+	Direction  string     `json:"direction,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
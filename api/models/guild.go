@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+type Guild struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	MemberCap   int       `json:"member_cap"`
+	MemberCount int       `json:"member_count"`
+	Treasury    int       `json:"treasury"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type GuildMember struct {
+	UserID      int64     `json:"user_id"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	Contributed int       `json:"contributed"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+// GuildMembership is the guild a user belongs to, as shown on the user.
+type GuildMembership struct {
+	GuildID  string    `json:"guild_id"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type GuildStats struct {
+	Battles    int     `json:"battles"`
+	Wins       int     `json:"wins"`
+	Losses     int     `json:"losses"`
+	Ties       int     `json:"ties"`
+	PvPWins    int     `json:"pvp_wins"`
+	PvEWins    int     `json:"pve_wins"`
+	WinRate    float64 `json:"win_rate"`
+	AvgRating  float64 `json:"avg_rating"`
+	TotalKills int     `json:"total_kills"`
+}
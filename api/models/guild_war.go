@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+type GuildWar struct {
+	ID          string     `json:"id"`
+	GuildA      string     `json:"guild_a"`
+	GuildB      string     `json:"guild_b"`
+	GuildAName  string     `json:"guild_a_name"`
+	GuildBName  string     `json:"guild_b_name"`
+	Status      string     `json:"status"`
+	ScoreA      int        `json:"score_a"`
+	ScoreB      int        `json:"score_b"`
+	WinnerGuild *string    `json:"winner_guild,omitempty"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      time.Time  `json:"ends_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+type GuildWarPairing struct {
+	Position  int     `json:"position"`
+	MemberA   int64   `json:"member_a"`
+	MemberB   int64   `json:"member_b"`
+	BattleID  *string `json:"battle_id,omitempty"`
+	WinnerID  *int64  `json:"winner_id,omitempty"`
+	ScoreA    int     `json:"score_a"`
+	ScoreB    int     `json:"score_b"`
+	ReplayURL string  `json:"replay_url,omitempty"`
+}
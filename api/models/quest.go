@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type Quest struct {
+	ID         int64      `json:"id"`
+	TemplateID string     `json:"template_id"`
+	Title      string     `json:"title"`
+	Period     string     `json:"period"`
+	Progress   int        `json:"progress"`
+	Target     int        `json:"target"`
+	Completed  bool       `json:"completed"`
+	ClaimedAt  *time.Time `json:"claimed_at,omitempty"`
+	Reward     Reward     `json:"reward"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
@@ -0,0 +1,9 @@
+package models
+
+// Reward is a fixed bundle of coins, an item and/or a card, paid out for
+// campaign stages, quests and the like.
+type Reward struct {
+	Coins  int    `json:"coins,omitempty"`
+	Item   string `json:"item,omitempty"`
+	CardID string `json:"card_id,omitempty"`
+}
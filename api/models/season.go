@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type Season struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   time.Time  `json:"ends_at"`
+	ClosedAt *time.Time `json:"closed_at,omitempty"`
+}
+
+type LeaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+type Tournament struct {
+	ID                   string     `json:"id"`
+	Name                 string     `json:"name"`
+	Format               string     `json:"format"`
+	Status               string     `json:"status"`
+	EntryFee             int        `json:"entry_fee"`
+	MaxPlayers           int        `json:"max_players"`
+	SwissRounds          int        `json:"swiss_rounds,omitempty"`
+	RoundIntervalMinutes int        `json:"round_interval_minutes"`
+	CurrentRound         int        `json:"current_round"`
+	PrizePool            int        `json:"prize_pool"`
+	RegistrationClosesAt time.Time  `json:"registration_closes_at"`
+	NextRoundAt          *time.Time `json:"next_round_at,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+	FinishedAt           *time.Time `json:"finished_at,omitempty"`
+}
+
+type TournamentEntry struct {
+	UserID     int64  `json:"user_id"`
+	Username   string `json:"username"`
+	Seed       *int   `json:"seed,omitempty"`
+	Score      int    `json:"score"`
+	Eliminated bool   `json:"eliminated"`
+	FinalRank  *int   `json:"final_rank,omitempty"`
+	Prize      int    `json:"prize"`
+}
+
+type TournamentMatch struct {
+	ID        string  `json:"id"`
+	Round     int     `json:"round"`
+	Position  int     `json:"position"`
+	PlayerA   *int64  `json:"player_a,omitempty"`
+	PlayerB   *int64  `json:"player_b,omitempty"`
+	WinnerID  *int64  `json:"winner_id,omitempty"`
+	BattleID  *string `json:"battle_id,omitempty"`
+	ReplayURL string  `json:"replay_url,omitempty"`
+}
@@ -4,7 +4,9 @@ import "time"
 type User struct {
 	ID        int64  `json:"id"`
 	Username  string `json:"username"`
+	Rating    int    `json:"rating"`
 	CreatedAt time.Time `json:"created_at"`
+	Guild     *GuildMembership `json:"guild,omitempty"`
 }
 
 type UserItem struct {
@@ -14,7 +16,16 @@ type UserItem struct {
 }
 
 type DeckSlot struct {
-	UserID     int64  `json:"user_id"`
+	DeckID     string `json:"deck_id"`
 	Slot       int    `json:"slot"`
 	UserCardID string `json:"user_card_id"`
 }
+
+type Deck struct {
+	ID        string    `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	CardCount int       `json:"card_count"`
+	ActiveFor []string  `json:"active_for"`
+	CreatedAt time.Time `json:"created_at"`
+}
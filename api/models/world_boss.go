@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type WorldBossEvent struct {
+	ID          string     `json:"id"`
+	BossID      string     `json:"boss_id"`
+	Name        string     `json:"name"`
+	MaxHP       int        `json:"max_hp"`
+	HPRemaining int        `json:"hp_remaining"`
+	Attack      int        `json:"attack,omitempty"`
+	Effects     []string   `json:"effects,omitempty"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      time.Time  `json:"ends_at"`
+	DefeatedAt  *time.Time `json:"defeated_at,omitempty"`
+}
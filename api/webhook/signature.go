@@ -0,0 +1,50 @@
+// Package webhook signs outbound webhook requests and verifies them on the
+// receiving end.
+//
+// Every request carries the Unix time it was sent in TimestampHeader and
+// "sha256=" plus the hex HMAC-SHA256 of "<timestamp>.<body>", keyed with the
+// webhook's secret, in SignatureHeader.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Imperium-Signature"
+	TimestampHeader = "X-Imperium-Timestamp"
+	EventHeader     = "X-Imperium-Event"
+	DeliveryHeader  = "X-Imperium-Delivery"
+)
+
+// MaxAge is how old a signed request may be before Verify rejects it.
+const MaxAge = 5 * time.Minute
+
+// Sign returns the SignatureHeader value for body sent at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a request's signature and that it isn't older than MaxAge.
+func Verify(secret, timestamp, signature string, body []byte, now time.Time) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > MaxAge || age < -MaxAge {
+		return errors.New("timestamp out of range")
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
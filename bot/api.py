@@ -1,10 +1,11 @@
 import aiohttp
-from config import API_URL
+from config import API_URL, ADMIN_TOKEN
 
 
-async def _request(method: str, path: str, json=None):
+async def _request(method: str, path: str, json=None, admin: bool = False):
+    headers = {"X-Admin-Token": ADMIN_TOKEN} if admin else None
     async with aiohttp.ClientSession() as session:
-        async with session.request(method, f"{API_URL}{path}", json=json) as resp:
+        async with session.request(method, f"{API_URL}{path}", json=json, headers=headers) as resp:
             if resp.status >= 400:
                 text = await resp.text()
                 raise Exception(f"API error {resp.status}: {text}")
@@ -35,8 +36,21 @@ async def open_case(user_id: int):
     return await _request("POST", "/loot/case", {"user_id": user_id})
 
 
-async def enter_dungeon(user_id: int, dungeon: str):
-    return await _request("POST", "/loot/dungeon", {"user_id": user_id, "dungeon": dungeon})
+async def start_dungeon_run(user_id: int, dungeon: str):
+    return await _request("POST", "/dungeon/runs", {"user_id": user_id, "dungeon": dungeon})
+
+
+async def continue_dungeon_run(user_id: int, run_id: str):
+    return await _request("POST", f"/dungeon/runs/{run_id}/continue", {"user_id": user_id})
+
+
+async def abandon_dungeon_run(user_id: int, run_id: str):
+    return await _request("POST", f"/dungeon/runs/{run_id}/abandon", {"user_id": user_id})
+
+
+async def get_active_dungeon_run(user_id: int):
+    runs = await _request("GET", f"/users/{user_id}/dungeon/runs?status=active")
+    return runs[0] if runs else None
 
 
 async def battle_pve(user_id: int, dungeon: str):
@@ -47,5 +61,21 @@ async def battle_pvp(attacker_id: int, defender_id: int):
     return await _request("POST", "/battle/pvp", {"attacker_id": attacker_id, "defender_id": defender_id})
 
 
+async def find_pvp(user_id: int):
+    return await _request("POST", "/battle/pvp/find", {"user_id": user_id})
+
+
 async def get_battle(battle_id: str):
     return await _request("GET", f"/battle/{battle_id}")
+
+
+async def get_user(user_id: int):
+    return await _request("GET", f"/users/{user_id}")
+
+
+async def get_notification_feed(wait: int = 30, limit: int = 50):
+    return await _request("GET", f"/notifications/feed?wait={wait}&limit={limit}", admin=True)
+
+
+async def mark_notifications_delivered(ids: list):
+    return await _request("POST", "/notifications/delivered", {"ids": ids}, admin=True)
@@ -6,6 +6,8 @@ from aiogram.fsm.storage.memory import MemoryStorage
 
 from config import BOT_TOKEN
 from handlers import register_all_handlers
+from notifications import poll_notifications
+from webhooks import start_webhook_server
 
 logging.basicConfig(level=logging.INFO)
 logger = logging.getLogger(__name__)
@@ -21,8 +23,16 @@ async def main():
 
     register_all_handlers(dp)
 
+    runner = await start_webhook_server(bot)
+    poller = asyncio.create_task(poll_notifications(bot))
+
     logger.info("Imperium bot starting...")
-    await dp.start_polling(bot)
+    try:
+        await dp.start_polling(bot)
+    finally:
+        poller.cancel()
+        if runner:
+            await runner.cleanup()
 
 
 if __name__ == "__main__":
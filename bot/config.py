@@ -6,3 +6,12 @@ load_dotenv()
 BOT_TOKEN = os.getenv("BOT_TOKEN", "")
 API_URL = os.getenv("API_URL", "http://localhost:8090")
 MINI_APP_URL = os.getenv("MINI_APP_URL", "https://imperium.p5ina.dev")
+# Needed to read the API's notification feed (see notifications.py).
+ADMIN_TOKEN = os.getenv("ADMIN_TOKEN", "")
+
+# Push events from the API (see webhooks.py). The receiver only starts when a
+# secret is set; register http://<bot host>:WEBHOOK_PORT/imperium/events with
+# the same secret via the API's POST /webhooks.
+WEBHOOK_SECRET = os.getenv("WEBHOOK_SECRET", "")
+WEBHOOK_HOST = os.getenv("WEBHOOK_HOST", "0.0.0.0")
+WEBHOOK_PORT = int(os.getenv("WEBHOOK_PORT", "8081"))
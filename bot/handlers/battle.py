@@ -1,3 +1,5 @@
+import asyncio
+
 from aiogram import Router, F
 from aiogram.types import CallbackQuery, Message
 from aiogram.fsm.context import FSMContext
@@ -13,6 +15,8 @@ class PvPStates(StatesGroup):
     waiting_for_opponent_id = State()
 
 
+PVP_POLL_SECONDS = 5
+
 DUNGEON_NAMES = {"easy": "Лёгкий", "medium": "Средний", "hard": "Сложный"}
 
 
@@ -29,6 +33,55 @@ async def cb_pvp(callback: CallbackQuery):
     await callback.answer()
 
 
+@router.callback_query(F.data == "pvp_find")
+async def cb_pvp_find(callback: CallbackQuery):
+    # The search widens its rating window the longer it runs, so keep asking
+    # until the API finds someone or gives up.
+    await callback.answer()
+    shown_window = None
+    try:
+        while True:
+            result = await api.find_pvp(callback.from_user.id)
+            if result.get("status") != "searching":
+                break
+            window = result["window"]
+            if window != shown_window:
+                shown_window = window
+                spread = "любой рейтинг" if window < 0 else f"±{window} рейтинга"
+                await callback.message.edit_text(
+                    f"🔎 <b>Ищем противника...</b>\n\n{spread}",
+                    parse_mode="HTML",
+                )
+            await asyncio.sleep(PVP_POLL_SECONDS)
+    except Exception as e:
+        err = str(e)
+        if "no opponents" in err:
+            text = "Противники не найдены, попробуй позже!"
+        elif "deck is empty" in err:
+            text = "Сначала собери колоду!"
+        else:
+            text = f"Ошибка: {e}"
+        await callback.message.edit_text(text, reply_markup=pvp_menu())
+        return
+
+    winner = result["winner"]
+    if winner == "attacker":
+        result_text = "🎉 Ты победил!"
+    elif winner == "defender":
+        result_text = "💀 Ты проиграл..."
+    else:
+        result_text = "🤝 Ничья!"
+
+    await callback.message.edit_text(
+        f"🏆 <b>PvP Бой</b>\n\n"
+        f"{result_text}\n"
+        f"Раундов: {result['rounds']}\n"
+        f"Рейтинг: {result['attacker_rating']}",
+        reply_markup=battle_result_keyboard(result["battle_id"]),
+        parse_mode="HTML",
+    )
+
+
 @router.callback_query(F.data == "pvp_enter_id")
 async def cb_pvp_enter_id(callback: CallbackQuery, state: FSMContext):
     await callback.message.edit_text(
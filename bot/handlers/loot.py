@@ -2,7 +2,7 @@ from aiogram import Router, F
 from aiogram.types import CallbackQuery
 
 import api
-from keyboards import RARITY_EMOJI, main_menu, dungeon_menu, battle_result_keyboard
+from keyboards import RARITY_EMOJI, main_menu, dungeon_menu, dungeon_run_keyboard
 
 router = Router()
 
@@ -21,6 +21,8 @@ def format_loot_result(result: dict) -> str:
         stars = "⭐" * quality
         return f"{emoji} <b>{result['card_id']}</b> {stars}"
     elif result["type"] == "item":
+        if result.get("item_id") == "coins":
+            return f"🪙 {result.get('amount', 0)} монет"
         name = ITEM_NAMES.get(result.get("item_id", ""), result.get("item_id", "?"))
         return f"🎁 {name}"
     return "???"
@@ -78,62 +80,107 @@ async def cb_dungeon_menu(callback: CallbackQuery):
     await callback.answer()
 
 
+DUNGEON_NAMES = {"easy": "Лёгкий", "medium": "Средний", "hard": "Сложный"}
+
+
+def format_dungeon_run(run: dict) -> list:
+    lines = [
+        f"⚔️ <b>Данж: {DUNGEON_NAMES.get(run['dungeon'], run['dungeon'])}</b>",
+        f"Этаж: {run['floor']}/{run['floors']}\n",
+    ]
+    for card in run.get("deck", []):
+        hp = card["current_hp"]
+        mark = "💀" if hp <= 0 else "❤️"
+        lines.append(f"  {mark} {card['name']} {max(hp, 0)}/{card['max_hp']}")
+    return lines
+
+
 @router.callback_query(F.data.startswith("dungeon:"))
 async def cb_dungeon(callback: CallbackQuery):
     dungeon = callback.data.split(":")[1]
     user_id = callback.from_user.id
-    dungeon_names = {"easy": "Лёгкий", "medium": "Средний", "hard": "Сложный"}
 
-    # Consume key and get loot
+    # Consume key and start a run, or pick up the one in progress
     try:
-        data = await api.enter_dungeon(user_id, dungeon)
+        run = await api.start_dungeon_run(user_id, dungeon)
     except Exception as e:
         err = str(e)
-        if "not enough keys" in err:
+        if "current dungeon run" in err:
+            run = await api.get_active_dungeon_run(user_id)
+        elif "not enough" in err:
             await callback.answer("Недостаточно ключей!", show_alert=True)
+            return
+        elif "deck is empty" in err:
+            await callback.answer("⚠️ Сначала собери колоду! Зайди в 🃏 Колода и добавь карты.", show_alert=True)
+            return
         else:
             await callback.answer(f"Ошибка: {e}", show_alert=True)
-        return
+            return
 
-    loot_results = data.get("results", [])
+    await callback.message.edit_text(
+        "\n".join(format_dungeon_run(run)),
+        reply_markup=dungeon_run_keyboard(run["id"]),
+        parse_mode="HTML",
+    )
+    await callback.answer()
+
+
+@router.callback_query(F.data.startswith("dungeon_next:"))
+async def cb_dungeon_next(callback: CallbackQuery):
+    run_id = callback.data.split(":", 1)[1]
+    user_id = callback.from_user.id
 
-    # Run PvE battle
-    battle_id = None
-    battle_winner = None
-    battle_rounds = 0
     try:
-        battle = await api.battle_pve(user_id, dungeon)
-        battle_id = battle.get("battle_id")
-        battle_winner = battle.get("winner")
-        battle_rounds = battle.get("rounds", 0)
+        data = await api.continue_dungeon_run(user_id, run_id)
     except Exception as e:
-        err = str(e)
-        if "deck is empty" in err:
-            await callback.answer("⚠️ Сначала собери колоду! Зайди в 🃏 Колода и добавь карты.", show_alert=True)
-            return
-        # other battle errors — show result without battle info
+        await callback.answer(f"Ошибка: {e}", show_alert=True)
+        return
 
-    lines = [f"⚔️ <b>Данж: {dungeon_names.get(dungeon, dungeon)}</b>\n"]
+    run = data["run"]
+    lines = format_dungeon_run(run)
+    lines.append("")
 
-    if battle_winner == "attacker":
-        lines.append("🎉 Победа!\n")
-    elif battle_winner == "defender":
-        lines.append("💀 Поражение...\n")
-    elif battle_winner:
-        lines.append("🤝 Ничья!\n")
+    if run["status"] == "cleared":
+        lines.append("🏆 Данж пройден!")
+    elif run["status"] == "failed":
+        lines.append("💀 Поражение... Забег окончен.")
+    else:
+        lines.append("🎉 Этаж пройден!")
 
-    if battle_rounds:
-        lines.append(f"Раундов: {battle_rounds}\n")
+    if data.get("rounds"):
+        lines.append(f"Раундов: {data['rounds']}")
 
-    lines.append("Награда:")
-    for r in loot_results:
-        lines.append(f"  {format_loot_result(r)}")
+    loot = data.get("loot", [])
+    if loot:
+        lines.append("\nНаграда:")
+        for r in loot:
+            lines.append(f"  {format_loot_result(r)}")
+
+    await callback.message.edit_text(
+        "\n".join(lines),
+        reply_markup=dungeon_run_keyboard(run["id"], data.get("battle_id"), run["status"] == "active"),
+        parse_mode="HTML",
+    )
+    await callback.answer()
 
-    kb = battle_result_keyboard(battle_id) if battle_id else main_menu()
+
+@router.callback_query(F.data.startswith("dungeon_abandon:"))
+async def cb_dungeon_abandon(callback: CallbackQuery):
+    run_id = callback.data.split(":", 1)[1]
+    user_id = callback.from_user.id
+
+    try:
+        run = await api.abandon_dungeon_run(user_id, run_id)
+    except Exception as e:
+        await callback.answer(f"Ошибка: {e}", show_alert=True)
+        return
+
+    lines = format_dungeon_run(run)
+    lines.append("\n🏳️ Ты покинул данж.")
 
     await callback.message.edit_text(
         "\n".join(lines),
-        reply_markup=kb,
+        reply_markup=main_menu(),
         parse_mode="HTML",
     )
     await callback.answer()
@@ -100,11 +100,28 @@ def dungeon_menu():
     ])
 
 
-def battle_result_keyboard(battle_id: str):
-    return InlineKeyboardMarkup(inline_keyboard=[
-        [InlineKeyboardButton(
+def dungeon_run_keyboard(run_id: str, battle_id: str = None, active: bool = True):
+    buttons = []
+    if battle_id:
+        buttons.append([InlineKeyboardButton(
             text="▶️ Смотреть бой",
             web_app=WebAppInfo(url=f"{MINI_APP_URL}?battle_id={battle_id}")
+        )])
+    if active:
+        buttons.append([InlineKeyboardButton(text="⬆️ Следующий этаж", callback_data=f"dungeon_next:{run_id}")])
+        buttons.append([InlineKeyboardButton(text="🏳️ Покинуть данж", callback_data=f"dungeon_abandon:{run_id}")])
+    buttons.append([InlineKeyboardButton(text="🔙 Меню", callback_data="main_menu")])
+    return InlineKeyboardMarkup(inline_keyboard=buttons)
+
+
+def battle_result_keyboard(battle_id: str, live: bool = False):
+    # live=1 watches the battle on the shared live timeline over the
+    # stream endpoint instead of replaying it from the start.
+    url = f"{MINI_APP_URL}?battle_id={battle_id}" + ("&live=1" if live else "")
+    return InlineKeyboardMarkup(inline_keyboard=[
+        [InlineKeyboardButton(
+            text="🔴 Смотреть в прямом эфире" if live else "▶️ Смотреть бой",
+            web_app=WebAppInfo(url=url)
         )],
         [InlineKeyboardButton(text="🔙 Меню", callback_data="main_menu")],
     ])
@@ -112,6 +129,7 @@ def battle_result_keyboard(battle_id: str):
 
 def pvp_menu():
     return InlineKeyboardMarkup(inline_keyboard=[
+        [InlineKeyboardButton(text="🔎 Найти противника", callback_data="pvp_find")],
         [InlineKeyboardButton(text="⚔️ Ввести ID противника", callback_data="pvp_enter_id")],
         [InlineKeyboardButton(text="🔙 Меню", callback_data="main_menu")],
     ])
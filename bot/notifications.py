@@ -0,0 +1,108 @@
+import asyncio
+import logging
+
+from aiogram import Bot
+from aiogram.exceptions import TelegramBadRequest, TelegramForbiddenError
+
+import api
+from config import ADMIN_TOKEN, WEBHOOK_SECRET
+from keyboards import battle_result_keyboard
+
+logger = logging.getLogger(__name__)
+
+# How long one feed request waits for new notifications.
+POLL_WAIT = 30
+
+# Kinds the webhook receiver already tells players about.
+PUSHED_BY_WEBHOOK = {"pvp_attacked"} if WEBHOOK_SECRET else set()
+
+WINNER_TEXT = {
+    "defender": "🛡 Твоя защита выстояла!",
+    "attacker": "💀 Твоя защита пала...",
+}
+
+
+def format_notification(n: dict) -> str | None:
+    kind = n["kind"]
+    p = n.get("payload") or {}
+    if kind == "pvp_attacked":
+        return (
+            f"⚔️ <b>На тебя напали в PvP!</b>\n\n"
+            f"Атаковал: ID {p.get('attacker_id')}\n"
+            f"{WINNER_TEXT.get(p.get('winner'), '🤝 Ничья!')}\n"
+            f"Раундов: {p.get('rounds', 0)}"
+        )
+    if kind == "challenge_received":
+        stake = f"\nСтавка: {p['stake_coins']} 🪙" if p.get("stake_coins") else ""
+        return f"🤺 <b>Тебе бросили вызов!</b>\n\nОт: ID {p.get('challenger_id')}{stake}"
+    if kind == "challenge_completed":
+        return "🤺 <b>Вызов завершён!</b> Посмотри, чем закончился бой."
+    if kind == "challenge_declined":
+        return "🤺 Твой вызов отклонили."
+    if kind == "challenge_cancelled":
+        return "🤺 Вызов отменён."
+    if kind == "challenge_expired":
+        return "⌛ Твой вызов истёк, ставка возвращена."
+    if kind == "friend_request":
+        return f"👋 Заявка в друзья от ID {p.get('user_id')}"
+    if kind == "friend_accepted":
+        return f"🤝 ID {p.get('user_id')} принял заявку в друзья!"
+    if kind == "guild_war_started":
+        return "🏰 <b>Началась война гильдий!</b>"
+    if kind == "guild_war_finished":
+        return f"🏰 <b>Война гильдий окончена!</b>\n\nСчёт: {p.get('score_a')} : {p.get('score_b')}"
+    if kind == "achievement_unlocked":
+        return f"🏅 <b>Достижение получено!</b>\n\n{p.get('name')}"
+    return None
+
+
+async def deliver(bot: Bot, n: dict):
+    if n["kind"] in PUSHED_BY_WEBHOOK:
+        return
+    text = format_notification(n)
+    if text is None:
+        return
+    battle_id = (n.get("payload") or {}).get("battle_id")
+    await bot.send_message(
+        n["user_id"],
+        text,
+        reply_markup=battle_result_keyboard(battle_id) if battle_id else None,
+        parse_mode="HTML",
+    )
+
+
+async def poll_notifications(bot: Bot):
+    """Long-polls the API's notification feed and messages players. Needs
+    ADMIN_TOKEN."""
+    if not ADMIN_TOKEN:
+        logger.info("ADMIN_TOKEN is not set, not delivering notifications")
+        return
+
+    while True:
+        try:
+            feed = await api.get_notification_feed(wait=POLL_WAIT)
+        except Exception:
+            logger.exception("reading notification feed")
+            await asyncio.sleep(5)
+            continue
+
+        delivered = []
+        for n in feed:
+            try:
+                await deliver(bot, n)
+            except (TelegramForbiddenError, TelegramBadRequest) as e:
+                # Blocked the bot or never started it; nothing to retry.
+                logger.info("notification %s to %s not sent: %s", n["id"], n["user_id"], e)
+            except Exception:
+                # Try again on the next poll, keeping the order.
+                logger.exception("sending notification %s", n["id"])
+                break
+            delivered.append(n["id"])
+
+        if delivered:
+            try:
+                await api.mark_notifications_delivered(delivered)
+            except Exception:
+                logger.exception("marking notifications delivered")
+        if len(delivered) < len(feed):
+            await asyncio.sleep(5)
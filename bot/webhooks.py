@@ -0,0 +1,106 @@
+import hashlib
+import hmac
+import json
+import logging
+import time
+
+from aiogram import Bot
+from aiohttp import web
+
+import api
+from config import WEBHOOK_SECRET, WEBHOOK_HOST, WEBHOOK_PORT
+from keyboards import battle_result_keyboard
+
+logger = logging.getLogger(__name__)
+
+# Signed requests older than this are rejected (matches the API's webhook.MaxAge).
+MAX_AGE = 5 * 60
+
+
+def verify_signature(secret: str, timestamp: str, signature: str, body: bytes) -> bool:
+    try:
+        sent = int(timestamp)
+    except (TypeError, ValueError):
+        return False
+    if abs(time.time() - sent) > MAX_AGE:
+        return False
+    mac = hmac.new(secret.encode(), f"{timestamp}.".encode() + body, hashlib.sha256)
+    return hmac.compare_digest(signature or "", "sha256=" + mac.hexdigest())
+
+
+async def on_battle_finished(bot: Bot, data: dict):
+    # Only PvP defenders need telling: everyone else started the battle
+    # themselves and already saw the result.
+    if data.get("mode") != "pvp" or data.get("defender_id", 0) <= 0:
+        return
+
+    attacker = f"ID {data['attacker_id']}"
+    try:
+        user = await api.get_user(data["attacker_id"])
+        if user.get("username"):
+            attacker = f"@{user['username']}"
+    except Exception:
+        pass
+
+    winner = data.get("winner")
+    if winner == "defender":
+        result_text = "🛡 Твоя защита выстояла!"
+    elif winner == "attacker":
+        result_text = "💀 Твоя защита пала..."
+    else:
+        result_text = "🤝 Ничья!"
+
+    await bot.send_message(
+        data["defender_id"],
+        f"⚔️ <b>На тебя напали в PvP!</b>\n\n"
+        f"Атаковал: {attacker}\n"
+        f"{result_text}\n"
+        f"Раундов: {data.get('rounds', 0)}",
+        reply_markup=battle_result_keyboard(data["battle_id"], live=True),
+        parse_mode="HTML",
+    )
+
+
+EVENT_HANDLERS = {
+    "battle_finished": on_battle_finished,
+}
+
+
+async def handle_event(request: web.Request):
+    body = await request.read()
+    if not verify_signature(
+        WEBHOOK_SECRET,
+        request.headers.get("X-Imperium-Timestamp"),
+        request.headers.get("X-Imperium-Signature"),
+        body,
+    ):
+        return web.Response(status=401, text="bad signature")
+
+    event = json.loads(body)
+    handler = EVENT_HANDLERS.get(event.get("event"))
+    if handler:
+        try:
+            await handler(request.app["bot"], event.get("data") or {})
+        except Exception:
+            # A failed send is answered with 500 so the API retries it.
+            logger.exception("handling %s event %s", event.get("event"), event.get("id"))
+            return web.Response(status=500, text="handler error")
+    return web.Response(status=204)
+
+
+async def start_webhook_server(bot: Bot):
+    """Serves POST /imperium/events for the API's webhooks. Does nothing
+    unless WEBHOOK_SECRET is set."""
+    if not WEBHOOK_SECRET:
+        logger.info("WEBHOOK_SECRET is not set, not receiving API events")
+        return None
+
+    app = web.Application()
+    app["bot"] = bot
+    app.router.add_post("/imperium/events", handle_event)
+
+    runner = web.AppRunner(app)
+    await runner.setup()
+    await web.TCPSite(runner, WEBHOOK_HOST, WEBHOOK_PORT).start()
+    logger.info("Receiving API events on %s:%s", WEBHOOK_HOST, WEBHOOK_PORT)
+    return runner